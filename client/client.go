@@ -0,0 +1,372 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package client talks to a roller server over its JSON API, for bots and tools
+// written in Go. Import it as roller/client.
+//
+//	c := client.New("https://rollforyour.party", "my-bot")
+//	room, err := c.NewRoom(ctx)
+//	res, err := c.Roll(ctx, room, client.RollRequest{Expression: "3d6+2"})
+//
+// Methods that change one die take the revision of the die they are acting on, or
+// AnyRevision. If the die has changed since, they return an *Error for which
+// IsConflict is true, holding the die as it is now.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AnyRevision acts on a die whatever has happened to it.
+const AnyRevision int64 = -1
+
+// Client acts in rooms on one server as one player.
+type Client struct {
+	// BaseURL is the server, such as https://rollforyour.party.
+	BaseURL string
+	// Fingerprint identifies the player; cards hidden by this client are hidden by it.
+	Fingerprint string
+	// HTTPClient makes the requests. Subscribe needs one without a timeout.
+	HTTPClient *http.Client
+	// Token is sent as a bearer token. Managing a room's webhooks needs the owner token
+	// NewOwnedRoom returns, or the server's admin token.
+	Token string
+}
+
+// New returns a client for the server at baseURL acting as the player fingerprint.
+func New(baseURL, fingerprint string) *Client {
+	return &Client{
+		BaseURL:     strings.TrimRight(baseURL, "/"),
+		Fingerprint: fingerprint,
+		HTTPClient:  http.DefaultClient,
+	}
+}
+
+// Error is a request the server turned down.
+type Error struct {
+	StatusCode int
+	Message    string
+	// Current is the die as it is now, when the request lost a revision conflict.
+	Current *Die
+
+	body []byte
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("roller: %v %v", e.StatusCode, e.Message)
+}
+
+// IsConflict says whether err is a change to a die that someone else changed first.
+func IsConflict(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusConflict
+}
+
+// IsNotFound says whether err is about a room, die or custom set that isn't there.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// roomPath is the API path for room, followed by parts.
+func roomPath(room string, parts ...string) string {
+	p := "/api/v1/rooms/" + url.PathEscape(room)
+	for _, part := range parts {
+		p += "/" + url.PathEscape(part)
+	}
+	return p
+}
+
+// do sends body as JSON and decodes the response into out.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	var in io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		in = bytes.NewReader(raw)
+	}
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, in)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("roller: could not read response: %v", err)
+	}
+	if res.StatusCode == http.StatusConflict {
+		var d Die
+		if err := json.Unmarshal(raw, &d); err == nil && d.Key != "" {
+			return &Error{StatusCode: res.StatusCode, Message: "the die changed first", Current: &d}
+		}
+	}
+	if res.StatusCode >= 300 {
+		var e struct{ Error string }
+		if json.Unmarshal(raw, &e) != nil || e.Error == "" {
+			e.Error = strings.TrimSpace(string(raw))
+		}
+		return &Error{StatusCode: res.StatusCode, Message: e.Error, body: raw}
+	}
+	if out == nil || len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("roller: could not parse response: %v", err)
+	}
+	return nil
+}
+
+// fp is the query that says who is asking.
+func (c *Client) fp() url.Values {
+	if c.Fingerprint == "" {
+		return nil
+	}
+	return url.Values{"fp": {c.Fingerprint}}
+}
+
+// NewRoom makes a room and returns its name.
+func (c *Client) NewRoom(ctx context.Context) (string, error) {
+	room, _, err := c.NewOwnedRoom(ctx)
+	return room, err
+}
+
+// NewOwnedRoom makes a room and returns its name and owner token, which is needed to
+// manage its webhooks and isn't shown again.
+func (c *Client) NewOwnedRoom(ctx context.Context) (room, token string, err error) {
+	var res struct{ Slug, OwnerToken string }
+	if err := c.do(ctx, "POST", "/api/v1/rooms", nil, nil, &res); err != nil {
+		return "", "", err
+	}
+	return res.Slug, res.OwnerToken, nil
+}
+
+// Room returns the room: its table, totals, custom sets and who is there.
+func (c *Client) Room(ctx context.Context, room string) (*Room, error) {
+	var res Room
+	if err := c.do(ctx, "GET", roomPath(room), c.fp(), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Dice returns everything on the room's table.
+func (c *Client) Dice(ctx context.Context, room string) ([]Die, error) {
+	var res []Die
+	if err := c.do(ctx, "GET", roomPath(room, "dice"), c.fp(), nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Die returns one die on the table.
+func (c *Client) Die(ctx context.Context, room, key string) (*Die, error) {
+	var res Die
+	if err := c.do(ctx, "GET", roomPath(room, "dice", key), c.fp(), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Events returns the room's events after seq. Pass the Seq it returns to the next call.
+func (c *Client) Events(ctx context.Context, room string, seq int64) (*Events, error) {
+	q := c.fp()
+	if q == nil {
+		q = url.Values{}
+	}
+	q.Set("seq", fmt.Sprint(seq))
+	var res Events
+	if err := c.do(ctx, "GET", roomPath(room, "events"), q, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Roll puts dice, clocks, labels, tokens and cards on the table.
+func (c *Client) Roll(ctx context.Context, room string, req RollRequest) (*RollResult, error) {
+	var res RollResult
+	body := struct {
+		RollRequest
+		Fp string
+	}{req, c.Fingerprint}
+	if err := c.do(ctx, "POST", roomPath(room, "roll"), nil, body, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Draw draws cards from the room's deck or one of its custom sets.
+func (c *Client) Draw(ctx context.Context, room string, req DrawRequest) ([]Die, error) {
+	var res []Die
+	body := struct {
+		DrawRequest
+		Fp string
+	}{req, c.Fingerprint}
+	if err := c.do(ctx, "POST", roomPath(room, "draw"), nil, body, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Shuffle shuffles the discards of the custom set called deck, or of the room's deck
+// if it's empty, back in. It returns the room as it is afterwards.
+func (c *Client) Shuffle(ctx context.Context, room, deck string) (*Room, error) {
+	var res Room
+	body := struct{ Deck, Fp string }{deck, c.Fingerprint}
+	if err := c.do(ctx, "POST", roomPath(room, "shuffle"), nil, body, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Clear takes everything off the table. If it stops part way it returns both how much
+// it took off and an error; clearing again picks up from there.
+func (c *Client) Clear(ctx context.Context, room string) (*ClearResult, error) {
+	var res ClearResult
+	err := c.do(ctx, "POST", roomPath(room, "clear"), nil, struct{ Fp string }{c.Fingerprint}, &res)
+	var e *Error
+	if errors.As(err, &e) && json.Unmarshal(e.body, &res) == nil && res.Error != "" {
+		// The clear stopped part way; say how far it got.
+		return &res, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Alert shows everyone in the room a message.
+func (c *Client) Alert(ctx context.Context, room, message string) error {
+	return c.do(ctx, "POST", roomPath(room, "alert"), nil, struct{ Message string }{message}, nil)
+}
+
+// SetBackground changes the room's background to the image at imageURL; an empty URL
+// clears it.
+func (c *Client) SetBackground(ctx context.Context, room, imageURL string) error {
+	return c.do(ctx, "POST", roomPath(room, "background"), nil, struct{ URL string }{imageURL}, nil)
+}
+
+// AddImage puts an image on the table.
+func (c *Client) AddImage(ctx context.Context, room string, img Image) (*Die, error) {
+	var res Die
+	body := struct {
+		Image
+		Fp string
+	}{img, c.Fingerprint}
+	if err := c.do(ctx, "POST", roomPath(room, "images"), nil, body, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// AddCustomSet adds a custom set to the room, replacing any with the same name.
+func (c *Client) AddCustomSet(ctx context.Context, room string, set NewCustomSet) (*CustomSet, error) {
+	var res CustomSet
+	if err := c.do(ctx, "POST", roomPath(room, "customsets"), nil, set, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// RemoveCustomSet removes the custom set called name from the room.
+func (c *Client) RemoveCustomSet(ctx context.Context, room, name string) error {
+	return c.do(ctx, "DELETE", roomPath(room, "customsets", name), nil, nil, nil)
+}
+
+// dieChange is the body of a change to one die.
+type dieChange struct {
+	X     *float64 `json:",omitempty"`
+	Y     *float64 `json:",omitempty"`
+	White bool     `json:",omitempty"`
+	Rev   *int64   `json:",omitempty"`
+	Fp    string
+}
+
+func (c *Client) changeDie(ctx context.Context, room, key, action string, rev int64, change dieChange) (*Die, error) {
+	change.Fp = c.Fingerprint
+	if rev != AnyRevision {
+		change.Rev = &rev
+	}
+	var res Die
+	if err := c.do(ctx, "POST", roomPath(room, "dice", key, action), nil, change, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Move moves a die to (x, y).
+func (c *Client) Move(ctx context.Context, room, key string, x, y float64, rev int64) (*Die, error) {
+	return c.changeDie(ctx, room, key, "move", rev, dieChange{X: &x, Y: &y})
+}
+
+// Reroll rerolls a die, draws a new card in place of a card, or flips a token. Tokens
+// flip to white if white is set.
+func (c *Client) Reroll(ctx context.Context, room, key string, rev int64, white bool) (*Die, error) {
+	return c.changeDie(ctx, room, key, "reroll", rev, dieChange{White: white})
+}
+
+// Hide hides a card, custom set item, clock, image or token from everyone else.
+func (c *Client) Hide(ctx context.Context, room, key string, rev int64) (*Die, error) {
+	return c.changeDie(ctx, room, key, "hide", rev, dieChange{})
+}
+
+// Reveal shows everyone something this client hid.
+func (c *Client) Reveal(ctx context.Context, room, key string, rev int64) (*Die, error) {
+	return c.changeDie(ctx, room, key, "reveal", rev, dieChange{})
+}
+
+// WindBack takes a segment off a clock.
+func (c *Client) WindBack(ctx context.Context, room, key string) (*Die, error) {
+	return c.changeDie(ctx, room, key, "decrement", AnyRevision, dieChange{})
+}
+
+// Delete takes a die off the table.
+func (c *Client) Delete(ctx context.Context, room, key string) error {
+	return c.do(ctx, "DELETE", roomPath(room, "dice", key), c.fp(), nil, nil)
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRollSendsRequestAndFingerprint(t *testing.T) {
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v1/rooms/QuietOwl/roll" {
+			t.Errorf("got %v %v; want POST /api/v1/rooms/QuietOwl/roll", r.Method, r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"Total":7,"Modifier":2,"Dice":[{"KeyStr":"k1","Size":"d6","Result":5,"Revision":1,"SVG":"<svg/>"}]}`)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL+"/", "bot")
+	res, err := c.Roll(context.Background(), "QuietOwl", RollRequest{Dice: map[string]int{"d6": 1}, Modifier: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 7 || len(res.Dice) != 1 || res.Dice[0].Key != "k1" || res.Dice[0].Result != 5 {
+		t.Errorf("Roll == %+v; want the die the server sent", res)
+	}
+	if got["Fp"] != "bot" || got["Modifier"] != 2.0 || got["Dice"] == nil || got["Expression"] != nil {
+		t.Errorf("sent %v; want the dice, the modifier and the fingerprint", got)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var rev interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/rooms/QuietOwl/dice/k1/move":
+			var req map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&req)
+			rev = req["Rev"]
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"KeyStr":"k1","X":10,"Revision":4}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"Error":"no room called Nowhere"}`)
+		}
+	}))
+	defer srv.Close()
+	c := New(srv.URL, "bot")
+	ctx := context.Background()
+
+	_, err := c.Move(ctx, "QuietOwl", "k1", 50, 60, 3)
+	var e *Error
+	if !IsConflict(err) || !errors.As(err, &e) || e.Current == nil || e.Current.Revision != 4 {
+		t.Errorf("Move at a stale revision == %v; want a conflict holding the die", err)
+	}
+	if rev != 3.0 {
+		t.Errorf("Move sent Rev %v; want 3", rev)
+	}
+	if _, err := c.Room(ctx, "Nowhere"); !IsNotFound(err) || err.(*Error).Message != "no room called Nowhere" {
+		t.Errorf("Room of a missing room == %v; want not found with the server's message", err)
+	}
+}
+
+func TestSubscribePicksUpWhereItLeftOff(t *testing.T) {
+	var lastIDs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/room/Missing/events" {
+			http.NotFound(w, r)
+			return
+		}
+		lastIDs = append(lastIDs, r.Header.Get("Last-Event-ID"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "retry: 1000\n\n: ping\n\n")
+		// Each connection sends one event and then drops.
+		seq := len(lastIDs)
+		fmt.Fprintf(w, "id: %v\nevent: roll\ndata: {\"Seq\":%v,\"Type\":\"roll\",\"DieKeys\":[\"k%v\"]}\n\n", seq, seq, seq)
+	}))
+	defer srv.Close()
+	c := New(srv.URL, "bot")
+
+	done := errors.New("done")
+	var got []Event
+	err := c.Subscribe(context.Background(), "QuietOwl", 0, func(e Event) error {
+		got = append(got, e)
+		if len(got) == 2 {
+			return done
+		}
+		return nil
+	})
+	if err != done {
+		t.Errorf("Subscribe == %v; want the handler's error", err)
+	}
+	if len(got) != 2 || got[0].Seq != 1 || got[1].Seq != 2 || got[1].Type != EventRoll || got[1].DieKeys[0] != "k2" {
+		t.Errorf("events == %+v; want 1 and 2", got)
+	}
+	if fmt.Sprint(lastIDs) != "[ 1]" {
+		t.Errorf("Last-Event-IDs == %q; want none and then 1", lastIDs)
+	}
+
+	if err := c.Subscribe(context.Background(), "Missing", 0, func(Event) error { return nil }); !IsNotFound(err) {
+		t.Errorf("Subscribe to a missing room == %v; want not found", err)
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	body := []byte(`{"Room":"QuietOwl","Event":{"Seq":1,"Type":"roll"}}`)
+	// HMAC-SHA256 of body with the secret "s3cret".
+	sig := "sha256=8afa5badcbaf471f4f3ba4ba1e1fadaa5295884caf56e67fb71d9fbaf12ee9f1"
+	if !VerifyWebhook("s3cret", body, sig) {
+		t.Errorf("VerifyWebhook rejected a good signature")
+	}
+	if VerifyWebhook("other", body, sig) || VerifyWebhook("s3cret", append(body, ' '), sig) || VerifyWebhook("s3cret", body, "") {
+		t.Errorf("VerifyWebhook accepted a signature for another secret or body")
+	}
+}
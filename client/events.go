@@ -0,0 +1,136 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBackoff is the longest Subscribe waits before trying a dropped stream again.
+const maxBackoff = 30 * time.Second
+
+// Subscribe calls handle with each event in the room, in order, until ctx is done or
+// handle returns an error, and returns why it stopped. It starts after the event
+// numbered since, or with the next event if since is zero. If the stream drops it
+// picks up where it left off, waiting longer each time up to 30 seconds; a stream the
+// server refuses, such as one for a room that doesn't exist, stops it with an *Error.
+//
+// The client's own changes are left out, as the room page leaves out a player's own
+// changes, and the client counts as at the table while it is subscribed.
+func (c *Client) Subscribe(ctx context.Context, room string, since int64, handle func(Event) error) error {
+	last := since
+	wait := time.Second
+	for {
+		seen, err := c.follow(ctx, room, &last, handle)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch err := err.(type) {
+		case handlerError:
+			return err.err
+		case *Error:
+			return err
+		}
+		if seen {
+			wait = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait < maxBackoff {
+			wait *= 2
+		}
+	}
+}
+
+// handlerError is an error from Subscribe's handler, which ends the subscription.
+type handlerError struct {
+	err error
+}
+
+func (e handlerError) Error() string {
+	return e.err.Error()
+}
+
+// follow reads one event stream, handing its events to handle and moving last along,
+// and says whether it got any.
+func (c *Client) follow(ctx context.Context, room string, last *int64, handle func(Event) error) (bool, error) {
+	u := c.BaseURL + "/room/" + url.PathEscape(room) + "/events"
+	if q := c.fp(); q != nil {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	if *last > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(*last, 10))
+	}
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 && res.StatusCode < 500 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return false, &Error{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("roller: event stream got %v", res.Status)
+	}
+	seen := false
+	var data string
+	sc := bufio.NewScanner(res.Body)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if data != "" {
+				var e Event
+				if err := json.Unmarshal([]byte(data), &e); err == nil {
+					*last = e.Seq
+					seen = true
+					if err := handle(e); err != nil {
+						return seen, handlerError{err}
+					}
+				}
+			}
+			data = ""
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return seen, err
+	}
+	return seen, io.ErrUnexpectedEOF
+}
@@ -0,0 +1,221 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+// These types mirror the JSON the server sends. Fields the server keeps for itself,
+// such as the SVG it draws dice with, are left out.
+
+// Die is anything on the table: a die, card, custom set item, clock, label, token or
+// image.
+type Die struct {
+	// Key identifies the die; the methods that act on one die take it.
+	Key       string `json:"KeyStr"`
+	Size      string
+	Result    int
+	ResultStr string
+	X         float64
+	Y         float64
+	Timestamp int64
+	Image     string
+	Color     string
+
+	IsCard        bool
+	IsLabel       bool
+	IsCustomItem  bool
+	CustomSetName string
+	CustomHeight  string
+	CustomWidth   string
+	IsImage       bool
+	IsClock       bool
+	IsFunky       bool
+	IsToken       bool
+	IsFlipped     bool
+
+	// HiddenBy is the player who hid the die. Dice hidden by someone else come back
+	// with their face left out.
+	IsHidden bool
+	HiddenBy string
+
+	// Expression and ExpressionTotal are set on dice rolled from an expression such
+	// as 3d6+2, along with how the expression treated each die.
+	Expression      string
+	ExpressionTotal int
+	IsDropped       bool
+	ExplodeRule     string
+	ExplodedFrom    string
+	IsPenetrated    bool
+	SuccessRule     string
+	IsSuccess       bool
+	IsFailure       bool
+	History         []int
+	RerollRule      string
+
+	// Nonce and SeedHash are set on dice rolled in a provably fair session.
+	Nonce    int64
+	SeedHash string
+
+	// Revision goes up every time the die changes. Pass it to the methods that change
+	// a die to make sure nobody changed it first.
+	Revision int64
+}
+
+// Room is a room as one player sees it.
+type Room struct {
+	Slug         string
+	Seq          int64
+	BgURL        string
+	FairSeedHash string
+	Totals       Totals
+	CustomSets   []CustomSet
+	Dice         []Die
+	Players      []Player
+}
+
+// Totals are the numbers shown above the table.
+type Totals struct {
+	RoomTotal           int
+	RollTotal           int
+	ModifiedRollTotal   int
+	Modifier            int
+	Expression          string
+	Successes           int
+	IsPool              bool
+	TokenCount          int
+	CardsLeft           int
+	LastChangeTimestamp string
+}
+
+// CustomSet is one of a room's custom sets and how many items are left to draw.
+type CustomSet struct {
+	Name      string
+	Remaining int
+}
+
+// Player is someone who has been at the table lately.
+type Player struct {
+	// ID is the same as the Updater of the player's events.
+	ID    string
+	Label string
+	// Status is "connected", "idle" or "dropped".
+	Status     string
+	LastSeen   int64
+	SecondsAgo int64
+}
+
+// Event is something that happened in a room. Type says what, and is one of the
+// Event constants; events from before types existed have none.
+type Event struct {
+	Seq       int64
+	Timestamp int64
+	// Updater is an ID for the player who made the change, the same for them
+	// throughout a room.
+	Updater   string
+	UpdateAll bool
+	Message   string
+	Type      string
+	// DieKey is the die the event happened to, when it was just one. DieKeys has the
+	// dice a roll or draw added, or a clear removed.
+	DieKey   string
+	DieKeys  []string
+	Modifier int
+	// Players is who is at the table, sent with presence events.
+	Players []Player
+}
+
+// Event types.
+const (
+	EventRoll       = "roll"
+	EventDraw       = "draw"
+	EventMove       = "move"
+	EventHide       = "hide"
+	EventReveal     = "reveal"
+	EventClear      = "clear"
+	EventAlert      = "alert"
+	EventBackground = "background"
+	EventCustomSet  = "customset"
+	EventDelete     = "delete"
+	EventShuffle    = "shuffle"
+	EventClock      = "clock"
+	EventImage      = "image"
+	EventFair       = "fair"
+	EventImport     = "import"
+	EventPresence   = "presence"
+)
+
+// Events is a batch of events, as returned by Client.Events.
+type Events struct {
+	// Seq is the newest event in the room; pass it to the next call.
+	Seq     int64
+	Events  []Event
+	Players []Player
+}
+
+// RollRequest says what to put on the table. Dice are counts by size, such as
+// {"d6": 3}; the sizes are d3, d4, d5, d6, d6p, d7, d8, d10, d12, d14, d16, d20, d24,
+// d30, d100, dF and dH. Clocks are names by size, such as {"c6": "Alarm"}; the sizes
+// are c4, c6, c8 and ct. Expression is a roll expression such as "3d6+2" or "4d6kh3".
+type RollRequest struct {
+	Dice       map[string]int    `json:",omitempty"`
+	Expression string            `json:",omitempty"`
+	Clocks     map[string]string `json:",omitempty"`
+	Label      string            `json:",omitempty"`
+	Tokens     int               `json:",omitempty"`
+	Cards      int               `json:",omitempty"`
+	Color      string            `json:",omitempty"`
+	// Modifier becomes the room's modifier, which is added to the roll total.
+	Modifier int `json:",omitempty"`
+	// Hidden deals Cards face down.
+	Hidden bool `json:",omitempty"`
+}
+
+// RollResult is what a roll put on the table.
+type RollResult struct {
+	Total    int
+	Modifier int
+	Dice     []Die
+}
+
+// DrawRequest draws Count cards, or one if it's zero, from the custom set called Deck
+// or from the room's deck if Deck is empty.
+type DrawRequest struct {
+	Count  int    `json:",omitempty"`
+	Deck   string `json:",omitempty"`
+	Hidden bool   `json:",omitempty"`
+}
+
+// ClearResult says how much a clear took off the table. If Error is set, the clear
+// stopped part way and clearing again picks up from there.
+type ClearResult struct {
+	Removed int
+	Error   string
+}
+
+// Image is an image to put on the table. Height and Width are CSS lengths.
+type Image struct {
+	URL    string
+	Height string `json:",omitempty"`
+	Width  string `json:",omitempty"`
+}
+
+// NewCustomSet is a custom set to add to a room, one entry per item. Height and Width
+// are CSS lengths for how its items are shown.
+type NewCustomSet struct {
+	Name    string
+	Entries []string
+	Height  string `json:",omitempty"`
+	Width   string `json:",omitempty"`
+}
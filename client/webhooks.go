@@ -0,0 +1,105 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Headers on every webhook request. SignatureHeader is "sha256=" and the hex
+// HMAC-SHA256 of the body, keyed with the webhook's secret.
+const (
+	SignatureHeader = "X-Roller-Signature"
+	EventHeader     = "X-Roller-Event"
+)
+
+// Webhook is a URL the server POSTs a room's rolls, draws, reveals, clears and alerts
+// to. Secret is only set on the webhook AddWebhook returns.
+type Webhook struct {
+	ID      int64
+	URL     string
+	Created int64
+	Secret  string
+}
+
+// WebhookDelivery is one attempt to send an event to a webhook. Status is what the
+// webhook answered with, or zero if it couldn't be reached.
+type WebhookDelivery struct {
+	Webhook   int64
+	URL       string
+	Seq       int64
+	Type      string
+	Attempt   int
+	Status    int
+	Error     string
+	Timestamp int64
+}
+
+// WebhookPayload is the body of a webhook request. Dice are set for rolls, draws and
+// reveals, as everyone at the table sees them.
+type WebhookPayload struct {
+	Room  string
+	Event Event
+	Dice  []Die
+}
+
+// VerifyWebhook says whether signature, the SignatureHeader of a webhook request, is
+// right for body and the webhook's secret.
+func VerifyWebhook(secret string, body []byte, signature string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(want), []byte(signature))
+}
+
+// Webhooks returns the room's webhooks, without their secrets. Like the other webhook
+// methods, it needs the room's owner token or the admin token in c.Token.
+func (c *Client) Webhooks(ctx context.Context, room string) ([]Webhook, error) {
+	var res []Webhook
+	if err := c.do(ctx, "GET", roomPath(room, "webhooks"), nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// AddWebhook has the server send the room's events to webhookURL. The webhook it
+// returns holds the secret the requests are signed with; it isn't shown again.
+func (c *Client) AddWebhook(ctx context.Context, room, webhookURL string) (*Webhook, error) {
+	var res Webhook
+	if err := c.do(ctx, "POST", roomPath(room, "webhooks"), nil, struct{ URL string }{webhookURL}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// RemoveWebhook stops sending the room's events to webhook id.
+func (c *Client) RemoveWebhook(ctx context.Context, room string, id int64) error {
+	return c.do(ctx, "DELETE", roomPath(room, "webhooks", fmt.Sprint(id)), nil, nil, nil)
+}
+
+// WebhookLog returns the room's recent webhook delivery attempts, newest first.
+func (c *Client) WebhookLog(ctx context.Context, room string) ([]WebhookDelivery, error) {
+	var res []WebhookDelivery
+	if err := c.do(ctx, "GET", roomPath(room, "webhooks", "log"), nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,537 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command roller rolls dice and runs rooms from a terminal, talking to a roller server
+// over its JSON API.
+//
+// Usage:
+//
+//	roller [-server URL] [-fp ID] [-json] <command> [room] [arguments]
+//
+// The commands are:
+//
+//	new                                   make a room and print its name
+//	roll <room> [expression] [flags]      roll dice, e.g. roller roll Room 3d6+2
+//	draw <room> [-deck name] [-count n]   draw cards from the deck or a custom set
+//	shuffle <room> [-deck name]           shuffle discards back into a deck
+//	clear <room>                          clear the table
+//	export <room> [-o file]               save the room as JSON, for /import
+//	watch <room> [-since seq]             print the room's events as they happen
+//
+// The room can be left out when ROLLER_ROOM is set, and the server defaults to
+// ROLLER_SERVER or https://rollforyour.party. Flags may come before or after the room.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultServer = "https://rollforyour.party"
+	// everyoneUpdater is the updater the server gives changes every page should reload
+	// for, whoever made them.
+	everyoneUpdater = "safari y u no work"
+)
+
+// die mirrors the fields of the server's Die that the CLI shows.
+type die struct {
+	Size            string
+	Result          int
+	ResultStr       string
+	KeyStr          string
+	IsCard          bool
+	IsLabel         bool
+	IsClock         bool
+	IsImage         bool
+	IsCustomItem    bool
+	CustomSetName   string
+	IsHidden        bool
+	IsDropped       bool
+	Expression      string
+	ExpressionTotal int
+}
+
+// event mirrors a room event as sent by /room/{slug}/events.
+type event struct {
+	Seq       int64
+	Timestamp int64
+	Updater   string
+	Message   string
+	Type      string
+	DieKey    string
+	DieKeys   []string
+	Modifier  int
+}
+
+// roller talks to one server on behalf of one player.
+type roller struct {
+	server string
+	fp     string
+	json   bool
+	out    io.Writer
+	http   *http.Client
+}
+
+// apiError is what the server says when a request fails.
+type apiError struct {
+	Status int
+	Error  string
+}
+
+// call sends body as JSON to the room API and decodes the response into out.
+func (r *roller) call(method, path string, body, out interface{}) error {
+	var in io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		in = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, r.server+"/api/v1/rooms"+path, in)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := r.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("could not read response: %v", err)
+	}
+	if res.StatusCode >= 300 {
+		e := apiError{Status: res.StatusCode}
+		if json.Unmarshal(raw, &e) != nil || e.Error == "" {
+			e.Error = strings.TrimSpace(string(raw))
+		}
+		return fmt.Errorf("%v: %v", res.Status, e.Error)
+	}
+	if r.json {
+		_, err := r.out.Write(raw)
+		return err
+	}
+	if out == nil || len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// describe is how a die is shown on one line.
+func describe(d die) string {
+	var s string
+	switch {
+	case d.IsLabel:
+		s = "label " + d.ResultStr
+	case d.IsClock:
+		s = fmt.Sprintf("clock %v (%v)", d.ResultStr, d.Size)
+	case d.IsImage:
+		s = "image"
+	case d.IsCustomItem:
+		s = fmt.Sprintf("%v: %v", d.CustomSetName, d.ResultStr)
+	case d.IsCard:
+		s = "card " + d.ResultStr
+	case d.Size == "tokens":
+		s = "token"
+	default:
+		s = fmt.Sprintf("d%v %v", d.Size, d.ResultStr)
+	}
+	if d.IsHidden && d.ResultStr == "" {
+		s += " (hidden)"
+	} else if d.IsHidden {
+		s += " (hidden from the others)"
+	}
+	if d.IsDropped {
+		s += " (dropped)"
+	}
+	return s
+}
+
+func (r *roller) newRoom(args []string) error {
+	var res struct{ Slug string }
+	if err := r.call("POST", "", nil, &res); err != nil || r.json {
+		return err
+	}
+	_, err := fmt.Fprintln(r.out, res.Slug)
+	return err
+}
+
+// clocks collects -clock flags, each a size and a name such as c6=Alarm.
+type clocks map[string]string
+
+func (c clocks) String() string {
+	return fmt.Sprint(map[string]string(c))
+}
+
+func (c clocks) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return errors.New("clocks look like c6=Name")
+	}
+	c[parts[0]] = parts[1]
+	return nil
+}
+
+func (r *roller) roll(room string, args []string) error {
+	fs := flag.NewFlagSet("roll", flag.ContinueOnError)
+	color := fs.String("color", "", "color of the dice")
+	modifier := fs.Int("modifier", 0, "modifier to add to the room's total")
+	hidden := fs.Bool("hidden", false, "deal cards face down")
+	tokens := fs.Int("tokens", 0, "tokens to put on the table")
+	cards := fs.Int("cards", 0, "cards to draw from the deck")
+	label := fs.String("label", "", "a label to put on the table")
+	cl := clocks{}
+	fs.Var(cl, "clock", "a clock to put on the table, as c4, c6, c8 or ct=Name; may be repeated")
+	rest, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	req := map[string]interface{}{
+		"Expression": strings.Join(rest, ""),
+		"Color":      *color,
+		"Modifier":   *modifier,
+		"Hidden":     *hidden,
+		"Tokens":     *tokens,
+		"Cards":      *cards,
+		"Label":      *label,
+		"Clocks":     cl,
+		"Fp":         r.fp,
+	}
+	var res struct {
+		Total int
+		Dice  []die
+	}
+	if err := r.call("POST", "/"+url.PathEscape(room)+"/roll", req, &res); err != nil || r.json {
+		return err
+	}
+	for _, d := range res.Dice {
+		fmt.Fprintln(r.out, describe(d))
+	}
+	if *modifier != 0 {
+		_, err = fmt.Fprintf(r.out, "total %v (%+d = %v)\n", res.Total, *modifier, res.Total+*modifier)
+	} else {
+		_, err = fmt.Fprintf(r.out, "total %v\n", res.Total)
+	}
+	return err
+}
+
+func (r *roller) draw(room string, args []string) error {
+	fs := flag.NewFlagSet("draw", flag.ContinueOnError)
+	deck := fs.String("deck", "", "custom set to draw from; the room's deck if empty")
+	count := fs.Int("count", 1, "how many to draw")
+	hidden := fs.Bool("hidden", false, "draw face down")
+	if _, err := parseInterspersed(fs, args); err != nil {
+		return err
+	}
+	var res []die
+	req := map[string]interface{}{"Deck": *deck, "Count": *count, "Hidden": *hidden, "Fp": r.fp}
+	if err := r.call("POST", "/"+url.PathEscape(room)+"/draw", req, &res); err != nil || r.json {
+		return err
+	}
+	for _, d := range res {
+		fmt.Fprintln(r.out, describe(d))
+	}
+	return nil
+}
+
+func (r *roller) shuffle(room string, args []string) error {
+	fs := flag.NewFlagSet("shuffle", flag.ContinueOnError)
+	deck := fs.String("deck", "", "custom set to shuffle; the room's deck if empty")
+	if _, err := parseInterspersed(fs, args); err != nil {
+		return err
+	}
+	var res struct{ Totals struct{ CardsLeft int } }
+	if err := r.call("POST", "/"+url.PathEscape(room)+"/shuffle", map[string]string{"Deck": *deck, "Fp": r.fp}, &res); err != nil || r.json {
+		return err
+	}
+	if *deck != "" {
+		_, err := fmt.Fprintf(r.out, "shuffled %v\n", *deck)
+		return err
+	}
+	_, err := fmt.Fprintf(r.out, "shuffled; %v cards left\n", res.Totals.CardsLeft)
+	return err
+}
+
+func (r *roller) clear(room string, args []string) error {
+	var res struct{ Removed int }
+	if err := r.call("POST", "/"+url.PathEscape(room)+"/clear", map[string]string{"Fp": r.fp}, &res); err != nil || r.json {
+		return err
+	}
+	_, err := fmt.Fprintf(r.out, "cleared %v things\n", res.Removed)
+	return err
+}
+
+func (r *roller) export(room string, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	file := fs.String("o", "", "file to write; standard output if empty")
+	if _, err := parseInterspersed(fs, args); err != nil {
+		return err
+	}
+	res, err := r.http.Get(r.server + "/room/" + url.PathEscape(room) + "/export?fp=" + url.QueryEscape(r.fp))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not export %v: %v", room, res.Status)
+	}
+	out := r.out
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	_, err = io.Copy(out, res.Body)
+	return err
+}
+
+// watch prints the room's events until it is interrupted, picking up where it left off
+// if the stream drops.
+func (r *roller) watch(room string, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	since := fs.Int64("since", 0, "also print the events after this sequence number")
+	if _, err := parseInterspersed(fs, args); err != nil {
+		return err
+	}
+	last := *since
+	wait := time.Second
+	for {
+		seen, err := r.follow(room, &last)
+		if err != nil {
+			var fatal *streamError
+			if errors.As(err, &fatal) {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "lost the stream (%v); trying again in %v\n", err, wait)
+		}
+		if seen {
+			wait = time.Second
+		}
+		time.Sleep(wait)
+		if wait < 30*time.Second {
+			wait *= 2
+		}
+	}
+}
+
+// streamError is a stream the server refused, which trying again won't fix.
+type streamError struct {
+	status string
+}
+
+func (e *streamError) Error() string {
+	return "the server refused the stream: " + e.status
+}
+
+// follow reads one event stream, printing its events and moving last along, and says
+// whether it got any.
+func (r *roller) follow(room string, last *int64) (bool, error) {
+	u := r.server + "/room/" + url.PathEscape(room) + "/events"
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if *last > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(*last, 10))
+	}
+	// Streams stay open, so they get a client without the usual timeout.
+	res, err := (&http.Client{Transport: r.http.Transport}).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 && res.StatusCode < 500 {
+		return false, &streamError{status: res.Status}
+	}
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("got %v", res.Status)
+	}
+	seen := false
+	var name, data string
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if data != "" {
+				var e event
+				if err := json.Unmarshal([]byte(data), &e); err == nil {
+					r.printEvent(name, e, data)
+					*last = e.Seq
+					seen = true
+				}
+			}
+			name, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return seen, err
+	}
+	return seen, io.ErrUnexpectedEOF
+}
+
+func (r *roller) printEvent(name string, e event, raw string) {
+	if r.json {
+		fmt.Fprintln(r.out, raw)
+		return
+	}
+	at := time.Unix(e.Timestamp, 0).Format("15:04:05")
+	if e.Timestamp == 0 {
+		at = time.Now().Format("15:04:05")
+	}
+	line := fmt.Sprintf("%v %v", at, name)
+	if who := e.Updater; who != "" && who != everyoneUpdater {
+		// Player IDs are long; six characters are enough to tell players apart.
+		if len(who) > 6 {
+			who = who[:6]
+		}
+		line += " by " + who
+	}
+	if n := len(e.DieKeys); n > 0 {
+		line += fmt.Sprintf(" (%v things)", n)
+	}
+	if e.Message != "" {
+		line += ": " + e.Message
+	}
+	fmt.Fprintln(r.out, line)
+}
+
+// parseInterspersed parses fs from args, allowing flags after positional arguments,
+// and returns the positional ones.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	fs.SetOutput(ioutil.Discard)
+	rest := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return rest, nil
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+}
+
+// commands take the room they act on and the rest of their arguments.
+var commands = map[string]func(*roller, string, []string) error{
+	"clear":   (*roller).clear,
+	"draw":    (*roller).draw,
+	"export":  (*roller).export,
+	"roll":    (*roller).roll,
+	"shuffle": (*roller).shuffle,
+	"watch":   (*roller).watch,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: roller [-server URL] [-fp ID] [-json] <command> [room] [arguments]
+
+commands:
+  new                                  make a room and print its name
+  roll <room> [expression] [flags]     roll dice; flags: -color -modifier -hidden
+                                       -tokens n -cards n -label text -clock c6=Name
+  draw <room> [-deck name] [-count n]  draw cards from the deck or a custom set
+  shuffle <room> [-deck name]          shuffle discards back into a deck
+  clear <room>                         clear the table
+  export <room> [-o file]              save the room as JSON
+  watch <room> [-since seq]            print the room's events as they happen
+
+The room can be left out when ROLLER_ROOM is set.`)
+}
+
+func main() {
+	server := os.Getenv("ROLLER_SERVER")
+	if server == "" {
+		server = defaultServer
+	}
+	fp := os.Getenv("ROLLER_FP")
+	if fp == "" {
+		fp = "roller-cli"
+	}
+	flag.StringVar(&server, "server", server, "the roller server")
+	flag.StringVar(&fp, "fp", fp, "who to act as; hidden cards are hidden by this")
+	asJSON := flag.Bool("json", false, "print the server's JSON responses")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	r := &roller{
+		server: strings.TrimRight(server, "/"),
+		fp:     fp,
+		json:   *asJSON,
+		out:    os.Stdout,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+	name, args := args[0], args[1:]
+	if name == "new" {
+		if err := r.newRoom(args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "roller: unknown command %q\n", name)
+		usage()
+		os.Exit(2)
+	}
+	room := os.Getenv("ROLLER_ROOM")
+	// Room names are words, so an argument that looks like dice is the roll itself.
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") && !(name == "roll" && looksLikeRoll(args[0])) {
+		room, args = args[0], args[1:]
+	}
+	if room == "" {
+		fmt.Fprintf(os.Stderr, "roller %v: which room? Name it or set ROLLER_ROOM\n", name)
+		os.Exit(2)
+	}
+	if err := cmd(r, room, args); err != nil {
+		fmt.Fprintf(os.Stderr, "roller %v: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// looksLikeRoll says whether arg is a dice expression rather than a room name.
+func looksLikeRoll(arg string) bool {
+	return strings.ContainsAny(arg, "0123456789") && strings.Contains(strings.ToLower(arg), "d")
+}
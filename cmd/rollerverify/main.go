@@ -0,0 +1,169 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command rollerverify checks the dice of a provably fair room against its revealed seeds.
+//
+// Usage:
+//
+//	rollerverify https://<host>/room/<slug>/fairness
+//	rollerverify fairness.json
+//
+// It exits non-zero if any seed doesn't match its published hash or any die doesn't
+// match the result derived from its nonce.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// record mirrors the JSON served at /room/{slug}/fairness.
+type record struct {
+	Room     string
+	SeedHash string
+	Revealed bool
+	Seeds    map[string]string
+	Dice     []struct {
+		Key      string
+		Size     string
+		Result   int
+		Nonce    int64
+		SeedHash string
+	}
+}
+
+// fairIntn must stay identical to fairIntn in project/fair.go.
+func fairIntn(seed []byte, nonce int64, n int) int {
+	limit := math.MaxUint64 - math.MaxUint64%uint64(n)
+	for round := 0; ; round++ {
+		mac := hmac.New(sha256.New, seed)
+		fmt.Fprintf(mac, "%d:%d", nonce, round)
+		v := binary.BigEndian.Uint64(mac.Sum(nil)[:8])
+		if v < limit {
+			return int(v % uint64(n))
+		}
+	}
+}
+
+// result follows getNewResult in project/roller.go.
+func result(seed []byte, nonce int64, size string) (int, error) {
+	switch size {
+	case "6p":
+		return fairIntn(seed, nonce, 6) + 1, nil
+	case "10p":
+		return fairIntn(seed, nonce, 10) + 1, nil
+	case "F":
+		return fairIntn(seed, nonce, 3) + 1, nil
+	}
+	s, err := strconv.Atoi(size)
+	if err != nil {
+		return fairIntn(seed, nonce, 2), nil
+	}
+	if s <= 0 {
+		return 0, fmt.Errorf("bad die size %q", size)
+	}
+	return fairIntn(seed, nonce, s) + 1, nil
+}
+
+func load(src string) (io.ReadCloser, error) {
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		resp, err := http.Get(src)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("fetching %v: %v", src, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(src)
+}
+
+func verify(rec record, out io.Writer) (checked, failed int) {
+	seeds := map[string][]byte{}
+	for hash, s := range rec.Seeds {
+		seed, err := hex.DecodeString(s)
+		if err != nil {
+			fmt.Fprintf(out, "seed for %v is not hex: %v\n", hash, err)
+			failed++
+			continue
+		}
+		sum := sha256.Sum256(seed)
+		if hex.EncodeToString(sum[:]) != hash {
+			fmt.Fprintf(out, "seed %v does not hash to %v\n", s, hash)
+			failed++
+			continue
+		}
+		seeds[hash] = seed
+	}
+	unrevealed := 0
+	for _, d := range rec.Dice {
+		seed, ok := seeds[d.SeedHash]
+		if !ok {
+			unrevealed++
+			continue
+		}
+		checked++
+		want, err := result(seed, d.Nonce, d.Size)
+		if err != nil {
+			fmt.Fprintf(out, "die %v: %v\n", d.Key, err)
+			failed++
+			continue
+		}
+		if want != d.Result {
+			fmt.Fprintf(out, "die %v (d%v, nonce %v) shows %v; the seed gives %v\n", d.Key, d.Size, d.Nonce, d.Result, want)
+			failed++
+		}
+	}
+	if unrevealed > 0 {
+		fmt.Fprintf(out, "%v dice belong to a session whose seed is not revealed yet\n", unrevealed)
+	}
+	return checked, failed
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: rollerverify <fairness URL or file>")
+		os.Exit(2)
+	}
+	body, err := load(os.Args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defer body.Close()
+	var rec record
+	if err := json.NewDecoder(body).Decode(&rec); err != nil {
+		fmt.Fprintf(os.Stderr, "could not read fairness record: %v\n", err)
+		os.Exit(2)
+	}
+	checked, failed := verify(rec, os.Stdout)
+	fmt.Printf("room %v: checked %v dice, %v problems\n", rec.Room, checked, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
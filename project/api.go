@@ -0,0 +1,803 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// The JSON API under /api/v1/rooms does everything the room page's forms do, for
+// integrations that would otherwise have to scrape the page. Requests and responses
+// are JSON, failures come back as {"Error": "..."} with a status code that says what
+// went wrong, and anything created or changed is sent back as the player sees it.
+//
+//	POST   /api/v1/rooms                           make a room
+//	GET    /api/v1/rooms/{slug}                    the table, totals and who is there
+//	GET    /api/v1/rooms/{slug}/events?seq=        events since seq, as /refresh sends them
+//	POST   /api/v1/rooms/{slug}/roll               roll dice, clocks, labels, tokens and cards
+//	POST   /api/v1/rooms/{slug}/draw               draw cards from the deck or a custom set
+//	POST   /api/v1/rooms/{slug}/shuffle            shuffle discards back into a deck
+//	POST   /api/v1/rooms/{slug}/clear              clear the table
+//	POST   /api/v1/rooms/{slug}/alert              show everyone a message
+//	POST   /api/v1/rooms/{slug}/background         change the background
+//	POST   /api/v1/rooms/{slug}/images             put an image on the table
+//	POST   /api/v1/rooms/{slug}/customsets         add a custom set
+//	DELETE /api/v1/rooms/{slug}/customsets/{name}  remove a custom set
+//	GET    /api/v1/rooms/{slug}/dice               everything on the table
+//	GET    /api/v1/rooms/{slug}/dice/{key}         one die
+//	DELETE /api/v1/rooms/{slug}/dice/{key}         take a die off the table
+//	POST   /api/v1/rooms/{slug}/dice/{key}/move    move, reroll, hide, reveal or
+//	       .../reroll, .../hide, .../reveal,       wind back a clock
+//	       .../decrement
+//	GET    /api/v1/rooms/{slug}/webhooks           the room's webhooks
+//	POST   /api/v1/rooms/{slug}/webhooks           send the room's events to a URL
+//	DELETE /api/v1/rooms/{slug}/webhooks/{id}      stop sending them
+//	GET    /api/v1/rooms/{slug}/webhooks/log       recent webhook deliveries, newest first
+//
+// Making a room gives back an OwnerToken. The webhook routes need it, or the admin
+// token, as a bearer token.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	apiPrefix = "/api/v1/rooms"
+	// maxAPIBody is the most a request body may be; custom sets are the biggest thing sent.
+	maxAPIBody = 1 << 20
+)
+
+// apiActions are served under /api/v1/rooms/{slug}/. Each gets what's left of the path.
+var apiActions = map[string]func(http.ResponseWriter, *http.Request, roomRef, []string){
+	"":           apiGetRoom,
+	"alert":      apiAlert,
+	"background": apiBackground,
+	"clear":      apiClear,
+	"customsets": apiCustomSets,
+	"dice":       apiDice,
+	"draw":       apiDraw,
+	"events":     apiEvents,
+	"images":     apiImages,
+	"roll":       apiRoll,
+	"shuffle":    apiShuffle,
+	"webhooks":   apiWebhooks,
+}
+
+// apiError is the body of every failed API request.
+type apiError struct {
+	Error string
+}
+
+func writeAPI(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if v == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("could not write API response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	writeAPI(w, code, apiError{Error: fmt.Sprintf(format, args...)})
+}
+
+// writeAPIFailure reports err with the status its kind calls for. A revision conflict
+// sends the die as it is now, as the room page's handlers do.
+func writeAPIFailure(w http.ResponseWriter, fp string, err error) {
+	switch e := err.(type) {
+	case *revisionConflict:
+		writeAPI(w, http.StatusConflict, e.Current.seenBy(fp))
+	case *refusal:
+		writeAPIError(w, e.Code, "%v", e.Msg)
+	case *expressionError:
+		writeAPIError(w, http.StatusBadRequest, "%v", e)
+	default:
+		log.Printf("API request failed: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "%v", err)
+	}
+}
+
+// allowMethods answers with a 405 unless r uses one of methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, "%v is not allowed here", r.Method)
+	return false
+}
+
+// readAPIBody decodes the JSON body of r into v. An empty body leaves v as it is.
+func readAPIBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil && err != io.EOF {
+		writeAPIError(w, http.StatusBadRequest, "could not parse request: %v", err)
+		return false
+	}
+	return true
+}
+
+// revision is the revision a request acted on; leaving it out acts on any.
+func revision(rev *int64) int64 {
+	if rev == nil {
+		return anyRevision
+	}
+	return *rev
+}
+
+// APIRooms serves the JSON API.
+func APIRooms(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	if rest == "" {
+		apiNewRoom(w, r)
+		return
+	}
+	parts := strings.Split(rest, "/")
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	handle, ok := apiActions[action]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "no such action %q", action)
+		return
+	}
+	room, err := findRoom(r.Context(), parts[0])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "no room called %q", parts[0])
+		return
+	}
+	var more []string
+	if len(parts) > 2 {
+		more = parts[2:]
+	}
+	handle(w, r, room, more)
+}
+
+func apiNewRoom(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	c := r.Context()
+	slug, err := newRoom(c)
+	if err != nil {
+		writeAPIFailure(w, "", err)
+		return
+	}
+	token, err := setRoomOwner(c, slug)
+	if err != nil {
+		writeAPIFailure(w, "", err)
+		return
+	}
+	writeAPI(w, http.StatusCreated, map[string]string{"Slug": slug, "OwnerToken": token})
+}
+
+// apiRoomState is a room as player Fp sees it.
+type apiRoomState struct {
+	Slug         string
+	Seq          int64
+	BgURL        string
+	FairSeedHash string `json:",omitempty"`
+	Totals       Totals
+	CustomSets   []apiCustomSet
+	Dice         []Die
+	Players      []Player
+}
+
+// apiCustomSet is how much of a custom set is left to draw.
+type apiCustomSet struct {
+	Name      string
+	Remaining int
+}
+
+// tableFor is everything on the room's table that player fp can see, in the order the
+// room page shows it.
+func tableFor(c context.Context, room roomRef, fp string) ([]Die, error) {
+	dice, err := getRoomDice(c, room.KeyStr, "Result", "true")
+	if err != nil {
+		return nil, err
+	}
+	out := []Die{}
+	for _, d := range dice {
+		if shown, ok := d.shownTo(fp); ok {
+			out = append(out, shown.seenBy(fp))
+		}
+	}
+	return out, nil
+}
+
+func apiGetRoom(w http.ResponseWriter, r *http.Request, room roomRef, rest []string) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	fp := r.URL.Query().Get("fp")
+	out, err := roomState(r.Context(), room, fp)
+	if err != nil {
+		writeAPIFailure(w, fp, err)
+		return
+	}
+	writeAPI(w, http.StatusOK, out)
+}
+
+// roomState is the room as player fp sees it now.
+func roomState(c context.Context, room roomRef, fp string) (apiRoomState, error) {
+	dice, err := getRoomDice(c, room.KeyStr, "Result", "true")
+	if err != nil {
+		return apiRoomState{}, err
+	}
+	table, err := tableFor(c, room, fp)
+	if err != nil {
+		return apiRoomState{}, err
+	}
+	p := roomPasser(c, room.Slug, room.KeyStr, fp, dice)
+	out := apiRoomState{
+		Slug:         room.Slug,
+		Seq:          p.Seq,
+		BgURL:        p.BgURL,
+		FairSeedHash: p.FairSeedHash,
+		Totals:       p.totals(),
+		CustomSets:   []apiCustomSet{},
+		Dice:         table,
+	}
+	for _, cs := range p.CustomSets {
+		out.CustomSets = append(out.CustomSets, apiCustomSet{Name: cs.Name, Remaining: cs.Remaining})
+	}
+	out.Players, err = roomPlayers(c, room.Key, time.Now())
+	return out, err
+}
+
+func apiEvents(w http.ResponseWriter, r *http.Request, room roomRef, rest []string) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	c := r.Context()
+	fp := r.URL.Query().Get("fp")
+	seq, err := strconv.ParseInt(r.URL.Query().Get("seq"), 10, 64)
+	if err != nil {
+		seq = 0
+	}
+	out := refreshRoom(c, room.KeyStr, fp, seq)
+	addPlayers(c, room.Key, &out)
+	writeAPI(w, http.StatusOK, out)
+}
+
+// apiRollRequest is what to put on the table. Dice are counts by size, with or without
+// the "d", as in {"d6": 3}; Clocks are names by size, as in {"c6": "Alarm"}.
+type apiRollRequest struct {
+	Dice       map[string]int
+	Expression string
+	Clocks     map[string]string
+	Label      string
+	Tokens     int
+	Cards      int
+	Color      string
+	Modifier   int
+	Hidden     bool
+	Fp         string
+}
+
+// sizes is the request in the form newRoll takes.
+func (req apiRollRequest) sizes() (map[string]string, error) {
+	known := map[string]bool{}
+	for _, size := range dieSizes {
+		known[size] = true
+	}
+	out := map[string]string{"xdy": req.Expression, "label": req.Label}
+	for size, n := range req.Dice {
+		size = strings.TrimPrefix(size, "d")
+		if !known[size] {
+			return nil, fmt.Errorf("there is no d%v", size)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("can't roll %v d%v", n, size)
+		}
+		out[size] = strconv.Itoa(n)
+	}
+	for size, name := range req.Clocks {
+		if !isClockSize(size) {
+			return nil, fmt.Errorf("there is no %v clock", size)
+		}
+		out[size] = name
+	}
+	if req.Tokens > 0 {
+		out["tokens"] = strconv.Itoa(req.Tokens)
+	}
+	if req.Cards > 0 {
+		out["card"] = strconv.Itoa(req.Cards)
+	}
+	return out, nil
+}
+
+func isClockSize(size string) bool {
+	for _, s := range clockSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// apiRollResult is what a roll put on the table.
+type apiRollResult struct {
+	Total    int
+	Modifier int
+	Dice     []Die
+}
+
+// getDice gets the dice with the given encoded keys.
+func getDice(c context.Context, keyStrs []string) ([]Die, error) {
+	dice := []Die{}
+	for _, ks := range keyStrs {
+		k, err := datastore.DecodeKey(ks)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode die key %v: %v", ks, err)
+		}
+		var d Die
+		if err := store.Get(c, k, &d); err != nil {
+			return nil, fmt.Errorf("could not get die %v: %v", ks, err)
+		}
+		dice = append(dice, d)
+	}
+	return dice, nil
+}
+
+func apiRoll(w http.ResponseWriter, r *http.Request, room roomRef, rest []string) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var req apiRollRequest
+	if !readAPIBody(w, r, &req) {
+		return
+	}
+	toRoll, err := req.sizes()
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	c := r.Context()
+	total, added, err := newRoll(c, toRoll, room.Key, req.Color, strconv.FormatBool(req.Hidden), req.Fp)
+	if err != nil {
+		writeAPIFailure(w, req.Fp, err)
+		return
+	}
+	if len(added) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "nothing to roll")
+		return
+	}
+	lastRoll[room.Slug] = total
+	lastAction[room.Slug] = "roll"
+	updateRoom(c, room.KeyStr, Update{Updater: req.Fp, Timestamp: time.Now().Unix(), Type: eventRoll, DieKeys: added}, req.Modifier)
+	dice, err := getDice(c, added)
+	if err != nil {
+		writeAPIFailure(w, req.Fp, err)
+		return
+	}
+	out := apiRollResult{Total: total, Modifier: req.Modifier, Dice: []Die{}}
+	for _, d := range dice {
+		out.Dice = append(out.Dice, d.seenBy(req.Fp))
+	}
+	writeAPI(w, http.StatusCreated, out)
+}
+
+// apiDrawRequest draws Count cards, one if it's left out, from the custom set called
+// Deck or the room's deck if that's empty.
+type apiDrawRequest struct {
+	Count  int
+	Deck   string
+	Hidden bool
+	Fp     string
+}
+
+func apiDraw(w http.ResponseWriter, r *http.Request, room roomRef, rest []string) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	req := apiDrawRequest{Count: 1}
+	if !readAPIBody(w, r, &req) {
+		return
+	}
+	if req.Count < 1 {
+		writeAPIError(w, http.StatusBadRequest, "can't draw %v cards", req.Count)
+		return
+	}
+	c := r.Context()
+	if req.Deck != "" {
+		if _, ok, err := roomCustomSet(c, room, req.Deck); err != nil {
+			writeAPIFailure(w, req.Fp, err)
+			return
+		} else if !ok {
+			writeAPIError(w, http.StatusNotFound, "no custom set called %q", req.Deck)
+			return
+		}
+	}
+	drawn, err := drawIntoRoom(c, req.Count, room.Key, req.Deck, strconv.FormatBool(req.Hidden), req.Fp)
+	if err != nil {
+		writeAPIFailure(w, req.Fp, err)
+		return
+	}
+	added := []string{}
+	out := []Die{}
+	for _, d := range drawn {
+		added = append(added, d.KeyStr)
+		out = append(out, d.seenBy(req.Fp))
+	}
+	lastAction[room.Slug] = "draw"
+	updateRoom(c, room.KeyStr, Update{Updater: req.Fp, Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventDraw, DieKeys: added}, 0)
+	writeAPI(w, http.StatusCreated, out)
+}
+
+// roomCustomSet gets the room's custom set called name, if it has one.
+func roomCustomSet(c context.Context, room roomRef, name string) (CustomSet, bool, error) {
+	var rm Room
+	if err := store.Get(c, room.Key, &rm); err != nil {
+		return CustomSet{}, false, fmt.Errorf("could not get room %v: %v", room.Slug, err)
+	}
+	sets, err := rm.GetCustomSets()
+	if err != nil {
+		return CustomSet{}, false, err
+	}
+	cs, ok := sets[name]
+	return cs, ok, nil
+}
+
+// apiDeckRequest names the custom set to act on, or the room's deck if Deck is empty.
+type apiDeckRequest struct {
+	Deck string
+	Fp   string
+}
+
+func apiShuffle(w http.ResponseWriter, r *http.Request, room roomRef, rest []string) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var req apiDeckRequest
+	if !readAPIBody(w, r, &req) {
+		return
+	}
+	c := r.Context()
+	if err := shuffleDiscards(c, room.KeyStr, req.Deck); err != nil {
+		writeAPIFailure(w, req.Fp, err)
+		return
+	}
+	lastAction[room.Slug] = "shuffle"
+	updateRoom(c, room.KeyStr, Update{Updater: req.Fp, Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventShuffle}, 0)
+	out, err := roomState(c, room, req.Fp)
+	if err != nil {
+		writeAPIFailure(w, req.Fp, err)
+		return
+	}
+	writeAPI(w, http.StatusOK, out)
+}
+
+// apiFpRequest is a request that only says who is making it.
+type apiFpRequest struct {
+	Fp string
+}
+
+func apiClear(w http.ResponseWriter, r *http.Request, room roomRef, rest []string) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var req apiFpRequest
+	if !readAPIBody(w, r, &req) {
+		return
+	}
+	c := r.Context()
+	removed, err := clearRoomDice(c, room.KeyStr)
+	res := clearResult{Removed: removed}
+	code := http.StatusOK
+	if err != nil {
+		log.Printf("clear failed: %v", err)
+		res.Error = err.Error()
+		code = http.StatusInternalServerError
+	}
+	lastAction[room.Slug] = "clear"
+	writeAPI(w, code, res)
+}
+
+// apiAlertRequest is a message to show everyone in the room.
+type apiAlertRequest struct {
+	Message string
+}
+
+func apiAlert(w http.ResponseWriter, r *http.Request, room roomRef, rest []string) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var req apiAlertRequest
+	if !readAPIBody(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		writeAPIError(w, http.StatusBadRequest, "no message")
+		return
+	}
+	u := Update{Updater: "", Timestamp: time.Now().Unix(), Message: req.Message, Type: eventAlert}
+	updateRoom(r.Context(), room.KeyStr, u, 0)
+	writeAPI(w, http.StatusCreated, u)
+}
+
+// apiBackgroundRequest is the URL of the new background; an empty one clears it.
+type apiBackgroundRequest struct {
+	URL string
+}
+
+func apiBackground(w http.ResponseWriter, r *http.Request, room roomRef, rest []string) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var req apiBackgroundRequest
+	if !readAPIBody(w, r, &req) {
+		return
+	}
+	if err := setBackground(r.Context(), room.Slug, req.URL); err != nil {
+		writeAPIFailure(w, "", err)
+		return
+	}
+	writeAPI(w, http.StatusOK, req)
+}
+
+// apiImageRequest is an image to put on the table. Height and Width are CSS lengths.
+type apiImageRequest struct {
+	URL    string
+	Height string
+	Width  string
+	Fp     string
+}
+
+func apiImages(w http.ResponseWriter, r *http.Request, room roomRef, rest []string) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var req apiImageRequest
+	if !readAPIBody(w, r, &req) {
+		return
+	}
+	if req.URL == "" {
+		writeAPIError(w, http.StatusBadRequest, "no image URL")
+		return
+	}
+	c := r.Context()
+	d, err := addImage(c, room.Key, req.URL, req.Height, req.Width)
+	if err != nil {
+		writeAPIFailure(w, req.Fp, err)
+		return
+	}
+	lastAction[room.Slug] = "image"
+	updateRoom(c, room.KeyStr, Update{Updater: req.Fp, Timestamp: time.Now().Unix(), Type: eventImage, DieKey: d.KeyStr}, 0)
+	writeAPI(w, http.StatusCreated, d)
+}
+
+// apiCustomSetRequest is a custom set to add, one entry per item. Height and Width are
+// CSS lengths for how its items are shown.
+type apiCustomSetRequest struct {
+	Name    string
+	Entries []string
+	Height  string
+	Width   string
+}
+
+func apiCustomSets(w http.ResponseWriter, r *http.Request, room roomRef, rest []string) {
+	c := r.Context()
+	if len(rest) == 1 {
+		if !allowMethods(w, r, http.MethodDelete) {
+			return
+		}
+		if _, ok, err := roomCustomSet(c, room, rest[0]); err != nil {
+			writeAPIFailure(w, "", err)
+			return
+		} else if !ok {
+			writeAPIError(w, http.StatusNotFound, "no custom set called %q", rest[0])
+			return
+		}
+		if err := removeCustomSet(c, room.Slug, rest[0]); err != nil {
+			writeAPIFailure(w, "", err)
+			return
+		}
+		writeAPI(w, http.StatusNoContent, nil)
+		return
+	}
+	if len(rest) > 1 {
+		writeAPIError(w, http.StatusNotFound, "no such custom set path")
+		return
+	}
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var req apiCustomSetRequest
+	if !readAPIBody(w, r, &req) {
+		return
+	}
+	entries := []string{}
+	for _, e := range req.Entries {
+		if e = strings.TrimSpace(e); e != "" {
+			entries = append(entries, e)
+		}
+	}
+	if req.Name == "" || len(entries) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "a custom set needs a name and entries")
+		return
+	}
+	if err := addCustomSet(c, room.Slug, req.Name, strings.Join(entries, "\n"), req.Height, req.Width); err != nil {
+		writeAPIFailure(w, "", err)
+		return
+	}
+	writeAPI(w, http.StatusCreated, apiCustomSet{Name: req.Name, Remaining: len(entries)})
+}
+
+// apiDieRequest is a change to one die. Rev is the revision the client last saw; if
+// the die has changed since, nothing happens and the die comes back with a 409.
+type apiDieRequest struct {
+	X     float64
+	Y     float64
+	White bool
+	Rev   *int64
+	Fp    string
+}
+
+// apiDieActions change one die on the table.
+var apiDieActions = map[string]func(context.Context, roomRef, string, apiDieRequest) (Die, error){
+	"decrement": func(c context.Context, room roomRef, keyStr string, req apiDieRequest) (Die, error) {
+		if err := decrementClock(c, room.Key, keyStr); err != nil {
+			return Die{}, err
+		}
+		lastAction[room.Slug] = "decrementClock"
+		return getDie(c, keyStr)
+	},
+	"hide": func(c context.Context, room roomRef, keyStr string, req apiDieRequest) (Die, error) {
+		lastRoll[room.Slug] = 0
+		d, err := hideDieHelper(c, room.Key, keyStr, req.Fp, revision(req.Rev))
+		if err == nil {
+			lastAction[room.Slug] = "hide"
+		}
+		return d, err
+	},
+	"move": func(c context.Context, room roomRef, keyStr string, req apiDieRequest) (Die, error) {
+		d, err := updateDieLocation(c, room.Key, keyStr, req.Fp, req.X, req.Y, revision(req.Rev))
+		if err == nil {
+			lastAction[room.Slug] = "move"
+		}
+		return d, err
+	},
+	"reroll": func(c context.Context, room roomRef, keyStr string, req apiDieRequest) (Die, error) {
+		lastRoll[room.Slug] = 0
+		d, err := rerollDieHelper(c, room.Key, keyStr, room.Slug, req.Fp, req.White, revision(req.Rev))
+		if err == nil {
+			lastAction[room.Slug] = "reroll"
+		}
+		return d, err
+	},
+	"reveal": func(c context.Context, room roomRef, keyStr string, req apiDieRequest) (Die, error) {
+		lastRoll[room.Slug] = 0
+		d, err := revealDieHelper(c, room.Key, keyStr, req.Fp, revision(req.Rev))
+		if err == nil {
+			lastAction[room.Slug] = "reveal"
+		}
+		return d, err
+	},
+}
+
+func getDie(c context.Context, keyStr string) (Die, error) {
+	dice, err := getDice(c, []string{keyStr})
+	if err != nil {
+		return Die{}, err
+	}
+	return dice[0], nil
+}
+
+// roomDie finds the die with key keyStr among the room's. Dice in other rooms aren't found.
+func roomDie(c context.Context, room roomRef, keyStr string) (Die, bool, error) {
+	k, err := dieKeyIn(room.Key, keyStr)
+	if err != nil {
+		return Die{}, false, nil
+	}
+	var d Die
+	if err := store.Get(c, k, &d); err == datastore.ErrNoSuchEntity {
+		return Die{}, false, nil
+	} else if err != nil {
+		return Die{}, false, fmt.Errorf("could not get die %v: %v", keyStr, err)
+	}
+	return d, true, nil
+}
+
+func apiDice(w http.ResponseWriter, r *http.Request, room roomRef, rest []string) {
+	c := r.Context()
+	if len(rest) == 0 {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		fp := r.URL.Query().Get("fp")
+		table, err := tableFor(c, room, fp)
+		if err != nil {
+			writeAPIFailure(w, fp, err)
+			return
+		}
+		writeAPI(w, http.StatusOK, table)
+		return
+	}
+	keyStr := rest[0]
+	if len(rest) > 2 {
+		writeAPIError(w, http.StatusNotFound, "no such die path")
+		return
+	}
+	fp := r.URL.Query().Get("fp")
+	d, ok, err := roomDie(c, room, keyStr)
+	if err != nil {
+		writeAPIFailure(w, fp, err)
+		return
+	}
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "no die %v in %v", keyStr, room.Slug)
+		return
+	}
+	if len(rest) == 1 {
+		if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+			return
+		}
+		if r.Method == http.MethodGet {
+			shown, ok := d.shownTo(fp)
+			if !ok {
+				writeAPIError(w, http.StatusNotFound, "no die %v in %v", keyStr, room.Slug)
+				return
+			}
+			writeAPI(w, http.StatusOK, shown.seenBy(fp))
+			return
+		}
+		if err := deleteDieHelper(c, room.Key, keyStr); err != nil {
+			writeAPIFailure(w, fp, err)
+			return
+		}
+		lastAction[room.Slug] = "delete"
+		writeAPI(w, http.StatusNoContent, nil)
+		return
+	}
+	act, ok := apiDieActions[rest[1]]
+	if !ok {
+		names := []string{}
+		for name := range apiDieActions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writeAPIError(w, http.StatusNotFound, "no die action %q; try one of %v", rest[1], strings.Join(names, ", "))
+		return
+	}
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	req := apiDieRequest{X: d.X, Y: d.Y}
+	if !readAPIBody(w, r, &req) {
+		return
+	}
+	changed, err := act(c, room, keyStr, req)
+	if err != nil {
+		writeAPIFailure(w, req.Fp, err)
+		return
+	}
+	writeAPI(w, http.StatusOK, changed.seenBy(req.Fp))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// callAPI sends body as JSON to the API and decodes the response into out, if given.
+func callAPI(t *testing.T, method, path string, body, out interface{}) int {
+	t.Helper()
+	return callAPIWithToken(t, "", method, path, body, out)
+}
+
+// callAPIWithToken is callAPI sending token as a bearer token.
+func callAPIWithToken(t *testing.T, token, method, path string, body, out interface{}) int {
+	t.Helper()
+	var raw []byte
+	if body != nil {
+		var err error
+		if raw, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(raw))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	APIRooms(w, req)
+	if out != nil && w.Code < 300 && w.Code != http.StatusNoContent {
+		if err := json.NewDecoder(w.Body).Decode(out); err != nil {
+			t.Fatalf("%v %v: could not decode %q: %v", method, path, w.Body, err)
+		}
+	}
+	return w.Code
+}
+
+// fakeDieSVGs fills the SVG cache for plain dice with the given number of sides, so
+// rolling them doesn't go to the network.
+func fakeDieSVGs(sides ...int) {
+	for _, n := range sides {
+		for i := 1; i <= n; i++ {
+			previousSVGs[fmt.Sprintf("d%v-%v-", n, i)] = []byte("<svg></svg>")
+		}
+	}
+}
+
+// apiTestRoom makes a room through the API and returns its path.
+func apiTestRoom(t *testing.T) string {
+	t.Helper()
+	var res struct{ Slug string }
+	if code := callAPI(t, "POST", "/api/v1/rooms", nil, &res); code != http.StatusCreated || res.Slug == "" {
+		t.Fatalf("POST /api/v1/rooms == %v %+v; want 201 and a slug", code, res)
+	}
+	return "/api/v1/rooms/" + res.Slug
+}
+
+func TestAPIRollMoveDelete(t *testing.T) {
+	defer withMemoryStore()()
+	fakeDieSVGs(6, 20)
+	room := apiTestRoom(t)
+
+	var rolled apiRollResult
+	code := callAPI(t, "POST", room+"/roll", map[string]interface{}{"Dice": map[string]int{"d6": 2}, "Expression": "1d20", "Label": "Goblins", "Fp": "alice"}, &rolled)
+	if code != http.StatusCreated || len(rolled.Dice) != 4 {
+		t.Fatalf("roll == %v %+v; want 201 and four dice", code, rolled)
+	}
+	sum := 0
+	for _, d := range rolled.Dice {
+		sum += d.Result
+	}
+	if rolled.Total != sum {
+		t.Errorf("roll Total == %v; want %v, the sum of the dice", rolled.Total, sum)
+	}
+
+	var state apiRoomState
+	if code := callAPI(t, "GET", room, nil, &state); code != http.StatusOK || len(state.Dice) != 4 || state.Totals.RollTotal != sum {
+		t.Errorf("GET room == %v %+v; want the four dice and their total", code, state)
+	}
+
+	d := rolled.Dice[0]
+	stale := d.Revision + 5
+	var current Die
+	if code := callAPI(t, "POST", room+"/dice/"+d.KeyStr+"/move", map[string]interface{}{"X": 50, "Rev": stale}, &current); code != http.StatusConflict {
+		t.Errorf("move at a stale revision == %v; want 409", code)
+	}
+	var moved Die
+	if code := callAPI(t, "POST", room+"/dice/"+d.KeyStr+"/move", map[string]interface{}{"X": 50, "Y": 60, "Rev": d.Revision}, &moved); code != http.StatusOK || moved.X != 50 || moved.Y != 60 || moved.Revision != d.Revision+1 {
+		t.Errorf("move == %v %+v; want 200 and the die at (50, 60) one revision on", code, moved)
+	}
+
+	if code := callAPI(t, "DELETE", room+"/dice/"+d.KeyStr, nil, nil); code != http.StatusNoContent {
+		t.Errorf("DELETE die == %v; want 204", code)
+	}
+	if code := callAPI(t, "GET", room+"/dice/"+d.KeyStr, nil, nil); code != http.StatusNotFound {
+		t.Errorf("GET deleted die == %v; want 404", code)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	defer withMemoryStore()()
+	fakeDieSVGs(6)
+	room := apiTestRoom(t)
+	other := apiTestRoom(t)
+	var rolled apiRollResult
+	callAPI(t, "POST", other+"/roll", map[string]interface{}{"Dice": map[string]int{"6": 1}}, &rolled)
+	var cards apiRollResult
+	callAPI(t, "POST", room+"/roll", map[string]interface{}{"Cards": 1, "Hidden": true, "Fp": "alice"}, &cards)
+	if len(rolled.Dice) != 1 || len(cards.Dice) != 1 {
+		t.Fatalf("could not set up the rooms: %+v %+v", rolled, cards)
+	}
+	card := cards.Dice[0].KeyStr
+
+	for _, tc := range []struct {
+		method, path string
+		body         interface{}
+		want         int
+	}{
+		{"GET", "/api/v1/rooms/NoSuchRoom", nil, http.StatusNotFound},
+		{"POST", room + "/juggle", nil, http.StatusNotFound},
+		{"GET", room + "/roll", nil, http.StatusMethodNotAllowed},
+		{"POST", room + "/roll", "not an object", http.StatusBadRequest},
+		{"POST", room + "/roll", map[string]interface{}{"Dice": map[string]int{"d13": 1}}, http.StatusBadRequest},
+		{"POST", room + "/roll", map[string]interface{}{"Expression": "2d"}, http.StatusBadRequest},
+		{"POST", room + "/roll", map[string]interface{}{"Dcie": map[string]int{"d6": 1}}, http.StatusBadRequest},
+		{"POST", room + "/roll", nil, http.StatusBadRequest},
+		{"POST", room + "/draw", map[string]interface{}{"Deck": "missing"}, http.StatusNotFound},
+		{"DELETE", room + "/dice/" + rolled.Dice[0].KeyStr, nil, http.StatusNotFound},
+		{"POST", room + "/dice/" + card + "/reveal", map[string]interface{}{"Fp": "bob"}, http.StatusForbidden},
+		{"POST", room + "/dice/" + card + "/hide", map[string]interface{}{"Fp": "bob"}, http.StatusConflict},
+		{"POST", room + "/dice/" + card + "/decrement", nil, http.StatusUnprocessableEntity},
+		{"POST", room + "/dice/" + card + "/flip", nil, http.StatusNotFound},
+	} {
+		var res apiError
+		w := httptest.NewRecorder()
+		raw, _ := json.Marshal(tc.body)
+		if tc.body == nil {
+			raw = nil
+		}
+		APIRooms(w, httptest.NewRequest(tc.method, tc.path, bytes.NewReader(raw)))
+		if w.Code != tc.want {
+			t.Errorf("%v %v %s == %v %v; want %v", tc.method, tc.path, raw, w.Code, w.Body, tc.want)
+			continue
+		}
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil || res.Error == "" {
+			t.Errorf("%v %v: error body %v, %v; want an Error", tc.method, tc.path, res, err)
+		}
+	}
+
+	var seen Die
+	if code := callAPI(t, "GET", room+"/dice/"+card+"?fp=bob", nil, &seen); code != http.StatusOK || seen.ResultStr != "" || seen.Result != 0 {
+		t.Errorf("GET alice's hidden card as bob == %v %+v; want its back", code, seen)
+	}
+	var revealed Die
+	if code := callAPI(t, "POST", room+"/dice/"+card+"/reveal", map[string]interface{}{"Fp": "alice"}, &revealed); code != http.StatusOK || revealed.IsHidden || revealed.ResultStr == "" {
+		t.Errorf("reveal by alice == %v %+v; want the card face up", code, revealed)
+	}
+}
+
+func TestAPICustomSets(t *testing.T) {
+	defer withMemoryStore()()
+	room := apiTestRoom(t)
+	var added apiCustomSet
+	body := map[string]interface{}{"Name": "loot", "Entries": []string{"sword", "shield", " ", "gold"}}
+	if code := callAPI(t, "POST", room+"/customsets", body, &added); code != http.StatusCreated || added.Remaining != 3 {
+		t.Fatalf("POST customsets == %v %+v; want 201 and three entries", code, added)
+	}
+	var drawn []Die
+	if code := callAPI(t, "POST", room+"/draw", map[string]interface{}{"Deck": "loot", "Count": 2}, &drawn); code != http.StatusCreated || len(drawn) != 2 {
+		t.Fatalf("draw from loot == %v %+v; want 201 and two items", code, drawn)
+	}
+	for _, d := range drawn {
+		if !d.IsCustomItem || d.CustomSetName != "loot" {
+			t.Errorf("drew %+v; want an item from loot", d)
+		}
+	}
+	var state apiRoomState
+	callAPI(t, "GET", room, nil, &state)
+	if len(state.CustomSets) != 1 || state.CustomSets[0].Remaining != 1 {
+		t.Errorf("room custom sets == %+v; want loot with one left", state.CustomSets)
+	}
+	if code := callAPI(t, "POST", room+"/shuffle", map[string]interface{}{"Deck": "loot"}, &state); code != http.StatusOK {
+		t.Errorf("shuffle == %v; want 200", code)
+	}
+	if code := callAPI(t, "DELETE", room+"/customsets/loot", nil, nil); code != http.StatusNoContent {
+		t.Errorf("DELETE customsets/loot == %v; want 204", code)
+	}
+	if code := callAPI(t, "DELETE", room+"/customsets/loot", nil, nil); code != http.StatusNotFound {
+		t.Errorf("DELETE customsets/loot again == %v; want 404", code)
+	}
+
+	var cleared clearResult
+	if code := callAPI(t, "POST", room+"/clear", nil, &cleared); code != http.StatusOK || cleared.Removed != 2 {
+		t.Errorf("clear == %v %+v; want the two items removed", code, cleared)
+	}
+	var events refreshResponse
+	callAPI(t, "GET", room+"/events?seq=0", nil, &events)
+	types := map[string]bool{}
+	for _, e := range events.Events {
+		types[e.Type] = true
+	}
+	for _, want := range []string{eventCustomSet, eventDraw, eventShuffle, eventClear} {
+		if !types[want] {
+			t.Errorf("events == %v; want a %v event", fmt.Sprint(types), want)
+		}
+	}
+	if types[eventRoll] {
+		t.Errorf("events == %v; want the draw told apart from a roll", fmt.Sprint(types))
+	}
+}
@@ -0,0 +1,270 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// auditSignificance is the p-value below which a die size is reported as suspicious.
+	auditSignificance = 0.01
+	// auditMaxSides is the biggest die tallied face by face.
+	auditMaxSides = 1000
+)
+
+// faceTally is how often one face of a die size came up.
+type faceTally struct {
+	Face     string
+	Count    int
+	Expected float64
+}
+
+// sizeAudit is the frequency table and chi-square test for one die size.
+type sizeAudit struct {
+	Size  string
+	Rolls int
+	Faces []faceTally
+	// ChiSquare and PValue test the counts against a uniform distribution.
+	ChiSquare        float64
+	DegreesOfFreedom int
+	PValue           float64
+	// Suspicious is set when PValue is below auditSignificance.
+	Suspicious bool
+	// LowCounts is set when some face is expected fewer than 5 times, which makes the test unreliable.
+	LowCounts bool
+}
+
+// roomAudit is the report served at /room/{slug}/audit.
+type roomAudit struct {
+	Room  string
+	Sizes []sizeAudit
+	// Skipped counts dice left out because their results aren't uniform, such as
+	// dice kept by a reroll rule, or can't be tallied, such as funky dice and dice
+	// with more than auditMaxSides sides.
+	Skipped int
+}
+
+// auditFaces returns the face labels for a die size, indexed so face i is stored as
+// Result i+offset, or nil if the size isn't a plain die of at most auditMaxSides.
+func auditFaces(size string) (faces []string, offset int) {
+	switch size {
+	case "F":
+		// Fate dice are stored as 1-3.
+		return []string{"-", "0", "+"}, 1
+	case "H":
+		// dH comes up 0 or 1.
+		return []string{"0", "1"}, 0
+	case "6p":
+		size = "6"
+	case "10p":
+		size = "10"
+	}
+	s, err := strconv.Atoi(size)
+	if err != nil || s < 2 || s > auditMaxSides {
+		return nil, 0
+	}
+	faces = make([]string, s)
+	for i := range faces {
+		faces[i] = strconv.Itoa(i + 1)
+	}
+	return faces, 1
+}
+
+// auditDice builds the report for a room's dice.
+func auditDice(room string, dice []Die) roomAudit {
+	out := roomAudit{Room: room, Sizes: []sizeAudit{}}
+	counts := map[string][]int{}
+	for _, d := range dice {
+		if d.IsCard || d.IsClock || d.IsImage || d.IsToken || d.Size == "tokens" || (d.IsLabel && !d.IsFunky) {
+			continue
+		}
+		if d.IsFunky {
+			out.Skipped++
+			continue
+		}
+		faces, offset := auditFaces(d.Size)
+		if faces == nil {
+			if s, err := strconv.Atoi(d.Size); err == nil && s > auditMaxSides {
+				out.Skipped++
+			}
+			continue
+		}
+		// A reroll rule deliberately skews the results it keeps.
+		if d.RerollRule != "" {
+			out.Skipped++
+			continue
+		}
+		i := d.Result - offset
+		if i < 0 || i >= len(faces) {
+			out.Skipped++
+			continue
+		}
+		if counts[d.Size] == nil {
+			counts[d.Size] = make([]int, len(faces))
+		}
+		counts[d.Size][i]++
+	}
+	for size, c := range counts {
+		out.Sizes = append(out.Sizes, auditSize(size, c))
+	}
+	sort.Slice(out.Sizes, func(i, j int) bool {
+		a, b := out.Sizes[i], out.Sizes[j]
+		if len(a.Faces) != len(b.Faces) {
+			return len(a.Faces) < len(b.Faces)
+		}
+		return a.Size < b.Size
+	})
+	return out
+}
+
+func auditSize(size string, counts []int) sizeAudit {
+	faces, _ := auditFaces(size)
+	sa := sizeAudit{Size: size, DegreesOfFreedom: len(counts) - 1}
+	for _, c := range counts {
+		sa.Rolls += c
+	}
+	expected := float64(sa.Rolls) / float64(len(counts))
+	for i, c := range counts {
+		sa.Faces = append(sa.Faces, faceTally{Face: faces[i], Count: c, Expected: expected})
+		diff := float64(c) - expected
+		sa.ChiSquare += diff * diff / expected
+	}
+	sa.LowCounts = expected < 5
+	sa.PValue = chiSquarePValue(sa.ChiSquare, sa.DegreesOfFreedom)
+	sa.Suspicious = sa.PValue < auditSignificance
+	return sa
+}
+
+// chiSquarePValue is the chance of a statistic at least x with df degrees of freedom.
+func chiSquarePValue(x float64, df int) float64 {
+	if df <= 0 || x <= 0 {
+		return 1
+	}
+	return upperGamma(float64(df)/2, x/2)
+}
+
+// upperGamma is the regularized upper incomplete gamma function Q(a, x), using the
+// series for small x and a continued fraction otherwise.
+func upperGamma(a, x float64) float64 {
+	lg, _ := math.Lgamma(a)
+	if x < a+1 {
+		sum, term := 1/a, 1/a
+		for n := 1; n < 1000; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*1e-15 {
+				break
+			}
+		}
+		return 1 - sum*math.Exp(-x+a*math.Log(x)-lg)
+	}
+	const tiny = 1e-300
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1; i < 1000; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < 1e-15 {
+			break
+		}
+	}
+	return math.Exp(-x+a*math.Log(x)-lg) * h
+}
+
+func getRoomAudit(c context.Context, room, keyStr string) (roomAudit, error) {
+	dice, err := getRoomDice(c, keyStr, "Timestamp", "true")
+	if err != nil {
+		return roomAudit{}, err
+	}
+	return auditDice(room, dice), nil
+}
+
+var auditTemplate = template.Must(template.New("audit").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Dice audit for {{.Room}}</title>
+<style>
+    body { font-family: sans-serif; }
+    table { border-collapse: collapse; margin-bottom: 1em; }
+    td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: right; }
+    .suspicious { color: darkred; }
+</style>
+</head>
+<body>
+<h1>Dice audit for <a href="/room/{{.Room}}">{{.Room}}</a></h1>
+{{if not .Sizes}}<p>No dice have been rolled in this room.</p>{{end}}
+{{range .Sizes}}
+<h2>d{{.Size}}: {{.Rolls}} rolls</h2>
+<table>
+    <tr><th>Face</th>{{range .Faces}}<th>{{.Face}}</th>{{end}}</tr>
+    <tr><th>Count</th>{{range .Faces}}<td>{{.Count}}</td>{{end}}</tr>
+    <tr><th>Expected</th>{{range .Faces}}<td>{{printf "%.1f" .Expected}}</td>{{end}}</tr>
+</table>
+<p{{if .Suspicious}} class="suspicious"{{end}}>&chi;&sup2; = {{printf "%.2f" .ChiSquare}} with {{.DegreesOfFreedom}} degrees of freedom, p = {{printf "%.4f" .PValue}}{{if .Suspicious}} (unlikely to be uniform){{end}}{{if .LowCounts}} &mdash; too few rolls for the test to mean much{{end}}</p>
+{{end}}
+{{if .Skipped}}<p>{{.Skipped}} dice were left out because their results are not uniform, such as dice kept by a reroll rule.</p>{{end}}
+</body>
+</html>
+`))
+
+// Audit serves /room/{slug}/audit as JSON (with ?format=json or an Accept header asking
+// for it) or as an HTML report.
+func Audit(w http.ResponseWriter, r *http.Request, room string) {
+	c := r.Context()
+	keyStr, err := getEncodedRoomKeyFromName(c, room)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	report, err := getRoomAudit(c, room, keyStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Printf("could not write audit: %v", err)
+		}
+		return
+	}
+	if err := auditTemplate.Execute(w, report); err != nil {
+		log.Printf("could not render audit: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestChiSquarePValue(t *testing.T) {
+	for _, tc := range []struct {
+		x    float64
+		df   int
+		want float64
+	}{
+		{0, 5, 1},
+		{3.841, 1, 0.05},
+		{11.070, 5, 0.05},
+		{15.086, 5, 0.01},
+		{30.144, 19, 0.05},
+		{2, 2, math.Exp(-1)},
+	} {
+		if got := chiSquarePValue(tc.x, tc.df); math.Abs(got-tc.want) > 1e-3 {
+			t.Errorf("chiSquarePValue(%v, %v) == %v; want %v", tc.x, tc.df, got, tc.want)
+		}
+	}
+}
+
+func TestAuditDice(t *testing.T) {
+	dice := []Die{}
+	for i := 0; i < 60; i++ {
+		dice = append(dice, Die{Size: "6", Result: i%6 + 1})
+	}
+	for i := 0; i < 30; i++ {
+		dice = append(dice, Die{Size: "F", Result: 1})
+	}
+	dice = append(dice,
+		Die{Size: "H", Result: 0},
+		Die{Size: "H", Result: 1},
+		Die{Size: "card", IsCard: true},
+		Die{Size: "tokens"},
+		Die{Size: "6", Result: 6, RerollRule: "r1"},
+		Die{Size: "7", Result: 3, ResultStr: "3 (d7)", IsFunky: true},
+		Die{Size: "2000000000", Result: 5},
+	)
+	got := auditDice("room", dice)
+	if got.Skipped != 3 {
+		t.Errorf("Skipped == %v; want 3", got.Skipped)
+	}
+	if len(got.Sizes) != 3 {
+		t.Fatalf("audited %v sizes; want 3 (%+v)", len(got.Sizes), got.Sizes)
+	}
+	h, f, d6 := got.Sizes[0], got.Sizes[1], got.Sizes[2]
+	if h.Size != "H" || h.Rolls != 2 || h.ChiSquare != 0 || !h.LowCounts {
+		t.Errorf("dH audit == %+v; want 2 even rolls with low counts", h)
+	}
+	if f.Size != "F" || f.Faces[0].Face != "-" || f.Faces[0].Count != 30 || !f.Suspicious {
+		t.Errorf("dF audit == %+v; want 30 minuses flagged as suspicious", f)
+	}
+	if d6.Size != "6" || d6.Rolls != 60 || d6.ChiSquare != 0 || d6.Suspicious || d6.PValue != 1 {
+		t.Errorf("d6 audit == %+v; want a perfectly even table", d6)
+	}
+}
@@ -0,0 +1,179 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// brokerChannel is the topic or channel room changes are published on.
+const brokerChannel = "room-updates"
+
+// RoomChange says a room has a new event. Room is the room's encoded key.
+type RoomChange struct {
+	Room string
+	Seq  int64
+	Type string `json:",omitempty"`
+}
+
+// Broker carries room changes between instances sharing a store, so each can keep its
+// cache and feed up to date.
+type Broker interface {
+	Publish(c context.Context, m RoomChange) error
+	// Subscribe hands every change published from now on, by any instance, to handle.
+	// It returns when c is done or the broker closes. handle may be called concurrently.
+	Subscribe(c context.Context, handle func(context.Context, RoomChange)) error
+	Close() error
+}
+
+// broker is the Broker updateRoom publishes to; main picks it with the -broker flag.
+// It is nil when there is nobody to tell.
+var broker Broker
+
+// openBroker sets up the broker described by setting: "pubsub" for Cloud Pub/Sub,
+// "memory" for one process, "redis://host:port" for Redis, or "none". An empty
+// setting uses Pub/Sub along with Datastore and nothing otherwise.
+func openBroker(c context.Context, setting, projectID string) (Broker, error) {
+	if setting == "" {
+		if _, ok := store.(*datastoreStore); ok {
+			setting = "pubsub"
+		} else {
+			setting = "none"
+		}
+	}
+	switch {
+	case setting == "none":
+		return nil, nil
+	case setting == "memory":
+		return newMemoryBroker(), nil
+	case setting == "pubsub":
+		// A nil *pubsubBroker in a Broker isn't a nil Broker, so failures return a bare nil.
+		b, err := openPubsubBroker(c, projectID)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case strings.HasPrefix(setting, "redis://"):
+		b, err := openRedisBroker(setting)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown broker %q", setting)
+}
+
+func encodeRoomChange(m RoomChange) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// decodeRoomChange reads a published change. Instances from before RoomChange existed
+// send "roomkey|seq", which is still understood so they can be rolled over gradually.
+func decodeRoomChange(data []byte) (RoomChange, error) {
+	var m RoomChange
+	if err := json.Unmarshal(data, &m); err == nil {
+		return m, nil
+	}
+	pieces := strings.Split(string(data), "|")
+	if len(pieces) != 2 {
+		return m, fmt.Errorf("don't know what to do with this message: %q", data)
+	}
+	seq, err := strconv.ParseInt(pieces[1], 10, 64)
+	if err != nil {
+		return m, fmt.Errorf("problem converting message sequence number to int: %v", err)
+	}
+	return RoomChange{Room: pieces[0], Seq: seq}, nil
+}
+
+// applyRoomChange brings this instance up to date with a change made elsewhere.
+func applyRoomChange(c context.Context, m RoomChange) {
+	if m.Room == "" {
+		log.Printf("ignoring a room change without a room: %+v", m)
+		return
+	}
+	noteLatestSeq(m.Room, m.Seq)
+	roomEvents.caughtUp(c, m.Room, m.Seq)
+}
+
+// memoryBroker only carries changes within one process. It is what tests use, and
+// stands in for a real broker when a single instance runs on its own.
+type memoryBroker struct {
+	mu     sync.Mutex
+	subs   map[chan RoomChange]bool
+	closed chan struct{}
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{subs: map[chan RoomChange]bool{}, closed: make(chan struct{})}
+}
+
+func (b *memoryBroker) Publish(c context.Context, m RoomChange) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.closed:
+		return fmt.Errorf("broker is closed")
+	default:
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- m:
+		default:
+			log.Printf("memory broker subscriber is behind; dropping a change to %v", m.Room)
+		}
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(c context.Context, handle func(context.Context, RoomChange)) error {
+	ch := make(chan RoomChange, feedBuffer)
+	b.mu.Lock()
+	b.subs[ch] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}()
+	for {
+		select {
+		case m := <-ch:
+			handle(c, m)
+		case <-c.Done():
+			return c.Err()
+		case <-b.closed:
+			return nil
+		}
+	}
+}
+
+func (b *memoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	return nil
+}
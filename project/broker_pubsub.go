@@ -0,0 +1,79 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// pubsubBroker carries room changes over Cloud Pub/Sub, with one subscription per
+// App Engine instance.
+type pubsubBroker struct {
+	client *pubsub.Client
+	topic  *pubsub.Topic
+}
+
+func openPubsubBroker(c context.Context, projectID string) (*pubsubBroker, error) {
+	client, err := pubsub.NewClient(c, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("could not create pubsub client: %v", err)
+	}
+	return &pubsubBroker{client: client, topic: client.Topic(brokerChannel)}, nil
+}
+
+// Publish doesn't wait for Pub/Sub to take the message; a lost change only means other
+// instances notice the event on their next read of the store.
+func (b *pubsubBroker) Publish(c context.Context, m RoomChange) error {
+	data, err := encodeRoomChange(m)
+	if err != nil {
+		return err
+	}
+	b.topic.Publish(c, &pubsub.Message{Data: data})
+	return nil
+}
+
+func (b *pubsubBroker) Subscribe(c context.Context, handle func(context.Context, RoomChange)) error {
+	id := os.Getenv("GAE_SERVICE") + "-" + os.Getenv("GAE_VERSION") + "-" + os.Getenv("GAE_INSTANCE")
+	sub, err := b.client.CreateSubscription(c, id, pubsub.SubscriptionConfig{
+		Topic:            b.topic,
+		AckDeadline:      10 * time.Second,
+		ExpirationPolicy: 24 * time.Hour,
+	})
+	if err != nil {
+		return fmt.Errorf("could not create pubsub subscription: %v", err)
+	}
+	return sub.Receive(c, func(c context.Context, msg *pubsub.Message) {
+		defer msg.Ack()
+		m, err := decodeRoomChange(msg.Data)
+		if err != nil {
+			log.Printf("%v", err)
+			return
+		}
+		handle(c, m)
+	})
+}
+
+func (b *pubsubBroker) Close() error {
+	b.topic.Stop()
+	return b.client.Close()
+}
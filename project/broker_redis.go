@@ -0,0 +1,296 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Just enough of the Redis protocol (RESP) for PUBLISH and SUBSCRIBE, so any server
+// that speaks it can carry room changes.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+	// redisMaxRetry caps how long a lost subscription waits before trying again.
+	redisMaxRetry = 30 * time.Second
+)
+
+type redisBroker struct {
+	addr     string
+	password string
+	closed   chan struct{}
+
+	// mu guards conn, which is used for publishing.
+	mu   sync.Mutex
+	conn *redisConn
+
+	// subs has the connections subscriptions are listening on, so Close can end them.
+	subsMu sync.Mutex
+	subs   map[*redisConn]bool
+}
+
+type redisConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// openRedisBroker connects to the server at a URL like redis://:password@host:6379.
+func openRedisBroker(setting string) (*redisBroker, error) {
+	u, err := url.Parse(setting)
+	if err != nil {
+		return nil, fmt.Errorf("bad redis address %q: %v", setting, err)
+	}
+	b := &redisBroker{addr: u.Host, closed: make(chan struct{}), subs: map[*redisConn]bool{}}
+	if u.Port() == "" {
+		b.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		b.password, _ = u.User.Password()
+	}
+	// Find out about a wrong address or password now rather than on the first roll.
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.conn = conn
+	return b, nil
+}
+
+func (b *redisBroker) dial() (*redisConn, error) {
+	nc, err := net.DialTimeout("tcp", b.addr, redisDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach redis at %v: %v", b.addr, err)
+	}
+	conn := &redisConn{Conn: nc, rd: bufio.NewReader(nc)}
+	if b.password != "" {
+		if _, err := conn.do("AUTH", b.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (b *redisBroker) Publish(c context.Context, m RoomChange) error {
+	data, err := encodeRoomChange(m)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// A connection that broke since the last publish gets one more try on a new one.
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-b.closed:
+			return errors.New("broker is closed")
+		default:
+		}
+		if b.conn == nil {
+			if b.conn, err = b.dial(); err != nil {
+				return err
+			}
+		}
+		_ = b.conn.SetDeadline(time.Now().Add(redisDialTimeout))
+		_, err = b.conn.do("PUBLISH", brokerChannel, string(data))
+		if _, ok := err.(redisError); err == nil || ok || attempt > 0 {
+			return err
+		}
+		b.conn.Close()
+		b.conn = nil
+	}
+}
+
+// Subscribe keeps a subscription open, making a new one whenever it is lost.
+func (b *redisBroker) Subscribe(c context.Context, handle func(context.Context, RoomChange)) error {
+	wait := time.Second
+	for {
+		subscribed, err := b.listen(c, handle)
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-b.closed:
+			return nil
+		default:
+		}
+		if subscribed {
+			wait = time.Second
+		}
+		log.Printf("lost redis subscription, trying again in %v: %v", wait, err)
+		select {
+		case <-time.After(wait):
+		case <-c.Done():
+			return c.Err()
+		case <-b.closed:
+			return nil
+		}
+		if wait *= 2; wait > redisMaxRetry {
+			wait = redisMaxRetry
+		}
+	}
+}
+
+// listen subscribes on a new connection and hands on messages until it breaks. It says
+// whether the subscription got going at all.
+func (b *redisBroker) listen(c context.Context, handle func(context.Context, RoomChange)) (bool, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return false, err
+	}
+	b.subsMu.Lock()
+	b.subs[conn] = true
+	b.subsMu.Unlock()
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		b.subsMu.Lock()
+		delete(b.subs, conn)
+		b.subsMu.Unlock()
+		conn.Close()
+	}()
+	go func() {
+		select {
+		case <-c.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := conn.send("SUBSCRIBE", brokerChannel); err != nil {
+		return false, err
+	}
+	subscribed := false
+	for {
+		reply, err := conn.readReply()
+		if err != nil {
+			return subscribed, err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 {
+			return subscribed, fmt.Errorf("unexpected reply to SUBSCRIBE: %v", reply)
+		}
+		switch parts[0] {
+		case "subscribe":
+			subscribed = true
+		case "message":
+			data, _ := parts[2].(string)
+			m, err := decodeRoomChange([]byte(data))
+			if err != nil {
+				log.Printf("%v", err)
+				continue
+			}
+			handle(c, m)
+		}
+	}
+}
+
+func (b *redisBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.closed:
+		return nil
+	default:
+	}
+	close(b.closed)
+	b.subsMu.Lock()
+	for conn := range b.subs {
+		conn.Close()
+	}
+	b.subsMu.Unlock()
+	if b.conn != nil {
+		return b.conn.Close()
+	}
+	return nil
+}
+
+// do sends a command and reads its reply.
+func (conn *redisConn) do(args ...string) (interface{}, error) {
+	if err := conn.send(args...); err != nil {
+		return nil, err
+	}
+	return conn.readReply()
+}
+
+// send writes a command as an array of bulk strings.
+func (conn *redisConn) send(args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(a))+"\r\n"+a+"\r\n"...)
+	}
+	_, err := conn.Write(buf)
+	return err
+}
+
+// readReply reads one reply. Simple and bulk strings come back as strings, integers as
+// int64s, arrays as []interface{} and nil replies as nil. Error replies are returned as
+// redisErrors.
+func (conn *redisConn) readReply() (interface{}, error) {
+	line, err := conn.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			if out[i], err = conn.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown redis reply %q", line)
+}
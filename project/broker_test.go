@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// checkBroker makes sure a change published on one broker reaches a subscriber on
+// another, which may be the same one.
+func checkBroker(t *testing.T, pub, sub Broker) {
+	c, cancel := context.WithCancel(context.Background())
+	got := make(chan RoomChange, 10)
+	ended := make(chan error, 1)
+	go func() {
+		ended <- sub.Subscribe(c, func(c context.Context, m RoomChange) { got <- m })
+	}()
+	want := RoomChange{Room: "room-key", Seq: 42, Type: eventRoll}
+	// Subscribing takes a moment, and changes published before that aren't seen.
+	tick := time.NewTicker(20 * time.Millisecond)
+	defer tick.Stop()
+	timeout := time.After(5 * time.Second)
+	for received := false; !received; {
+		select {
+		case <-tick.C:
+			if err := pub.Publish(c, want); err != nil {
+				t.Fatalf("Publish() == %v", err)
+			}
+		case m := <-got:
+			if m != want {
+				t.Errorf("subscriber got %+v; want %+v", m, want)
+			}
+			received = true
+		case <-timeout:
+			t.Fatal("subscriber never got the change")
+		}
+	}
+	cancel()
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Error("Subscribe() kept going after its context was done")
+	}
+}
+
+func TestMemoryBroker(t *testing.T) {
+	b := newMemoryBroker()
+	checkBroker(t, b, b)
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(context.Background(), RoomChange{Room: "r"}); err == nil {
+		t.Error("Publish() on a closed broker == nil; want an error")
+	}
+}
+
+func TestDecodeRoomChange(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want RoomChange
+		ok   bool
+	}{
+		{`{"Room":"abc","Seq":7,"Type":"move"}`, RoomChange{Room: "abc", Seq: 7, Type: eventMove}, true},
+		{"abc|7", RoomChange{Room: "abc", Seq: 7}, true},
+		{"abc|soon", RoomChange{}, false},
+		{"abc", RoomChange{}, false},
+	} {
+		got, err := decodeRoomChange([]byte(tc.data))
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("decodeRoomChange(%q) == %+v, %v; want %+v", tc.data, got, err, tc.want)
+		}
+	}
+}
+
+func TestUpdateRoomPublishes(t *testing.T) {
+	defer withMemoryStore()()
+	b := newMemoryBroker()
+	broker = b
+	defer func() { broker = nil }()
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan RoomChange, 1)
+	go func() {
+		_ = b.Subscribe(c, func(c context.Context, m RoomChange) { got <- m })
+	}()
+	rk := datastore.IDKey("Room", 1, nil)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		b.mu.Lock()
+		n := len(b.subs)
+		b.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("never subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	updateRoom(c, rk.Encode(), Update{Updater: "bob", Type: eventReveal}, 0)
+	select {
+	case m := <-got:
+		if m.Room != rk.Encode() || m.Seq == 0 || m.Type != eventReveal {
+			t.Errorf("updateRoom() published %+v; want the room, its new seq and the reveal", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("updateRoom() published nothing")
+	}
+}
+
+// fakeRedis answers AUTH, PUBLISH and SUBSCRIBE the way a Redis server does.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+	mu       sync.Mutex
+	subs     map[net.Conn]bool
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, subs: map[net.Conn]bool{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(nc net.Conn) {
+	defer nc.Close()
+	conn := &redisConn{Conn: nc, rd: bufio.NewReader(nc)}
+	authed := f.password == ""
+	for {
+		req, err := conn.readReply()
+		if err != nil {
+			return
+		}
+		args, _ := req.([]interface{})
+		if len(args) == 0 {
+			return
+		}
+		reply := ""
+		switch cmd, _ := args[0].(string); {
+		case cmd == "AUTH":
+			if args[1] == f.password {
+				authed = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "SUBSCRIBE":
+			f.mu.Lock()
+			f.subs[nc] = true
+			f.mu.Unlock()
+			reply = "*3\r\n" + bulk("subscribe") + bulk(args[1].(string)) + ":1\r\n"
+		case cmd == "PUBLISH":
+			msg := bulkArray("message", args[1].(string), args[2].(string))
+			f.mu.Lock()
+			for sub := range f.subs {
+				_, _ = sub.Write([]byte(msg))
+			}
+			n := len(f.subs)
+			f.mu.Unlock()
+			reply = ":" + strconv.Itoa(n) + "\r\n"
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		if _, err := nc.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// dropSubscribers cuts off every subscription, as a restarting server would.
+func (f *fakeRedis) dropSubscribers() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.subs {
+		conn.Close()
+		delete(f.subs, conn)
+	}
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func bulkArray(items ...string) string {
+	out := "*" + strconv.Itoa(len(items)) + "\r\n"
+	for _, s := range items {
+		out += bulk(s)
+	}
+	return out
+}
+
+func TestRedisBroker(t *testing.T) {
+	f := newFakeRedis(t, "sesame")
+	defer f.ln.Close()
+	if b, err := openBroker(context.Background(), "redis://:wrong@"+f.ln.Addr().String(), ""); err == nil || b != nil {
+		t.Errorf("openBroker() with the wrong password == %#v, %v; want no broker and an error", b, err)
+	}
+	b, err := openBroker(context.Background(), "redis://:sesame@"+f.ln.Addr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	checkBroker(t, b, b)
+
+	// Subscriptions come back after the server drops them.
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan RoomChange, 10)
+	go func() {
+		_ = b.Subscribe(c, func(c context.Context, m RoomChange) { got <- m })
+	}()
+	waitForSubscriber := func() {
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			f.mu.Lock()
+			n := len(f.subs)
+			f.mu.Unlock()
+			if n > 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("broker never subscribed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForSubscriber()
+	f.dropSubscribers()
+	waitForSubscriber()
+	if err := b.Publish(c, RoomChange{Room: "again", Seq: 2}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-got:
+		if m.Room != "again" {
+			t.Errorf("got %+v after resubscribing; want the change to room again", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing arrived after resubscribing")
+	}
+}
+
+func TestFailedOpenGivesNoBroker(t *testing.T) {
+	// Nothing listens on port 1, so the dial fails straight away.
+	b, err := openBroker(context.Background(), "redis://127.0.0.1:1", "")
+	if err == nil || b != nil {
+		t.Errorf("openBroker() of an unreachable redis == %#v, %v; want a nil Broker and an error", b, err)
+	}
+}
+
+// TestRealRedisBroker runs against a real server when ROLLER_TEST_REDIS has its URL,
+// e.g. redis://localhost:6379.
+func TestRealRedisBroker(t *testing.T) {
+	addr := os.Getenv("ROLLER_TEST_REDIS")
+	if addr == "" {
+		t.Skip("ROLLER_TEST_REDIS is not set")
+	}
+	pub, err := openBroker(context.Background(), addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	sub, err := openBroker(context.Background(), addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	checkBroker(t, pub, sub)
+}
@@ -0,0 +1,183 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Deltas let the room page patch the table in place instead of reloading it, which
+// re-renders every die and is slow on phones at big tables.
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"log"
+)
+
+// Totals are the figures shown above the table.
+type Totals struct {
+	RoomTotal           int
+	RollTotal           int
+	ModifiedRollTotal   int
+	Modifier            int
+	Expression          string
+	Successes           int
+	IsPool              bool
+	TokenCount          int
+	CardsLeft           int
+	LastChangeTimestamp string
+}
+
+// dieChange is a die as the player sees it, with the markup the page shows for it.
+type dieChange struct {
+	Die  Die
+	HTML string
+}
+
+// roomDelta is how the table changed over some events, as seen by one player.
+type roomDelta struct {
+	Added   []dieChange
+	Changed []dieChange
+	// Removed has the keys of dice that are gone or that the player can no longer see.
+	Removed []string
+	// Order has the keys of everything on the table in the order the page shows them.
+	Order      []string
+	Totals     Totals
+	TotalsHTML string
+	// Reload is set when something changed that can't be patched in, like the
+	// background, and the page should load the table again.
+	Reload bool
+}
+
+// patchable says whether the page can apply events of type t as a delta. Anything
+// else, such as a new background, and events of types the page doesn't know about
+// load the table again.
+func patchable(t string) bool {
+	switch t {
+	case eventRoll, eventDraw, eventMove, eventHide, eventReveal, eventClear, eventDelete, eventShuffle, eventClock, eventAlert, eventPresence:
+		return true
+	}
+	return false
+}
+
+// roomDeltaFor works out how the table changed for player fp over events. sort is the
+// player's sort_dice setting.
+func roomDeltaFor(c context.Context, room, keyStr, fp, sort string, events []Update) (*roomDelta, error) {
+	out := &roomDelta{Added: []dieChange{}, Changed: []dieChange{}, Removed: []string{}, Order: []string{}}
+	added := map[string]bool{}
+	changed := map[string]bool{}
+	removed := map[string]bool{}
+	for _, u := range events {
+		if !patchable(u.Type) {
+			out.Reload = true
+		}
+		switch u.Type {
+		case eventDelete:
+			removed[u.DieKey] = true
+		case eventClear:
+			for _, k := range u.DieKeys {
+				removed[k] = true
+			}
+		default:
+			for _, k := range u.DieKeys {
+				added[k] = true
+			}
+			if u.DieKey != "" {
+				changed[u.DieKey] = true
+			}
+		}
+	}
+
+	dice, err := getRoomDice(c, keyStr, "Result", sort)
+	if err != nil {
+		return nil, err
+	}
+	p := roomPasser(c, room, keyStr, fp, dice)
+	out.Totals = p.totals()
+	tmpl, err := parseRoomTemplate()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "totals", p); err != nil {
+		return nil, err
+	}
+	out.TotalsHTML = buf.String()
+
+	shown := map[string]bool{}
+	for _, d := range p.Dice {
+		shown[d.KeyStr] = true
+		out.Order = append(out.Order, d.KeyStr)
+		if removed[d.KeyStr] || !added[d.KeyStr] && !changed[d.KeyStr] {
+			continue
+		}
+		dc, err := renderDie(tmpl, d, fp)
+		if err != nil {
+			return nil, err
+		}
+		if added[d.KeyStr] {
+			out.Added = append(out.Added, dc)
+		} else {
+			out.Changed = append(out.Changed, dc)
+		}
+	}
+	for _, m := range []map[string]bool{removed, added, changed} {
+		for k := range m {
+			if !shown[k] {
+				// Only list each key once.
+				shown[k] = true
+				out.Removed = append(out.Removed, k)
+			}
+		}
+	}
+	return out, nil
+}
+
+// renderDie draws d the way the room page does.
+func renderDie(tmpl *template.Template, d Die, fp string) (dieChange, error) {
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "die", d); err != nil {
+		return dieChange{}, err
+	}
+	return dieChange{Die: d.seenBy(fp), HTML: buf.String()}, nil
+}
+
+func (p Passer) totals() Totals {
+	return Totals{
+		RoomTotal:           p.RoomTotal,
+		RollTotal:           p.RollTotal,
+		ModifiedRollTotal:   p.ModifiedRollTotal,
+		Modifier:            p.Modifier,
+		Expression:          p.Expression,
+		Successes:           p.Successes,
+		IsPool:              p.IsPool,
+		TokenCount:          p.TokenCount,
+		CardsLeft:           p.CardsLeft,
+		LastChangeTimestamp: p.LastChangeTimestamp,
+	}
+}
+
+// addDelta fills in out.Delta when out has events to patch in.
+func addDelta(c context.Context, out *refreshResponse, room, keyStr, fp, sort string) {
+	if len(out.Events) == 0 || onlyPresence(out.Events) {
+		return
+	}
+	delta, err := roomDeltaFor(c, room, keyStr, fp, sort, out.Events)
+	if err != nil {
+		log.Printf("could not work out delta for %v: %v", room, err)
+		return
+	}
+	out.Delta = delta
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func refreshWithDelta(t *testing.T, room, fp string, seq int64) refreshResponse {
+	body := "id=" + room + "&fp=" + fp + "&delta=true&seq=" + strconv.FormatInt(seq, 10)
+	req := httptest.NewRequest("POST", "/refresh", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	Refresh(w, req)
+	var out refreshResponse
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestRefreshDelta(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: "PatchTable"}); err != nil {
+		t.Fatal(err)
+	}
+	put := func(id int64, d Die) string {
+		k := datastore.IDKey("Die", id, rk)
+		d.KeyStr = k.Encode()
+		if _, err := store.Put(c, k, &d); err != nil {
+			t.Fatal(err)
+		}
+		return d.KeyStr
+	}
+	moved := put(1, Die{Size: "6", Result: 3, ResultStr: "3", Image: "d6-3.png", Timestamp: 1})
+	card := put(2, Die{Size: "card", IsCard: true, ResultStr: "Q♥", Image: "queen.png", Timestamp: 1})
+	deleted := put(3, Die{Size: "6", Result: 1, ResultStr: "1", Image: "d6-1.png", Timestamp: 1})
+	updateRoom(c, rk.Encode(), Update{Updater: "bob", Type: eventRoll}, 0)
+	start, _, err := latestEvent(c, rk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := refreshWithDelta(t, "PatchTable", "alice", start.Seq); out.Delta != nil {
+		t.Errorf("refresh with nothing new has delta %+v; want none", out.Delta)
+	}
+
+	rolled := put(4, Die{Size: "20", Result: 17, ResultStr: "17", Image: "d20-17.png", New: true, Timestamp: 2})
+	updateRoom(c, rk.Encode(), Update{Updater: "bob", Type: eventRoll, DieKeys: []string{rolled}}, 0)
+	put(1, Die{Size: "6", Result: 3, ResultStr: "3", Image: "d6-3.png", Timestamp: 1, X: 50, Y: 60, Revision: 1})
+	updateRoom(c, rk.Encode(), Update{Updater: "bob", Type: eventMove, DieKey: moved}, 0)
+	put(2, Die{Size: "card", IsCard: true, ResultStr: "Q♥", Image: "queen.png", Timestamp: 1, IsHidden: true, HiddenBy: "bob", Revision: 1})
+	updateRoom(c, rk.Encode(), Update{Updater: "bob", UpdateAll: true, Type: eventHide, DieKey: card}, 0)
+	dk, _ := datastore.DecodeKey(deleted)
+	if err := store.Delete(c, dk); err != nil {
+		t.Fatal(err)
+	}
+	updateRoom(c, rk.Encode(), Update{Updater: "bob", UpdateAll: true, Type: eventDelete, DieKey: deleted}, 0)
+
+	out := refreshWithDelta(t, "PatchTable", "alice", start.Seq)
+	d := out.Delta
+	if d == nil || d.Reload {
+		t.Fatalf("delta == %+v; want one that can be patched in", d)
+	}
+	if len(d.Added) != 1 || d.Added[0].Die.KeyStr != rolled || !strings.Contains(d.Added[0].HTML, `id="`+rolled+`"`) {
+		t.Errorf("added == %+v; want the d20 and its markup", d.Added)
+	}
+	if len(d.Changed) != 2 {
+		t.Fatalf("changed == %+v; want the moved die and the hidden card", d.Changed)
+	}
+	for _, ch := range d.Changed {
+		if ch.Die.KeyStr == card && (ch.Die.ResultStr != "" || strings.Contains(ch.HTML, "queen.png")) {
+			t.Errorf("bob's hidden card is sent to alice as %+v", ch)
+		}
+		if ch.Die.KeyStr == moved && !strings.Contains(ch.HTML, "left: 50px") {
+			t.Errorf("moved die is drawn as %q; want it at its new place", ch.HTML)
+		}
+	}
+	if len(d.Removed) != 1 || d.Removed[0] != deleted {
+		t.Errorf("removed == %v; want the deleted die", d.Removed)
+	}
+	if len(d.Order) != 3 || d.Totals.RoomTotal != 20 || !strings.Contains(d.TotalsHTML, "Room Total: 20") {
+		t.Errorf("delta order %v, totals %+v, %q; want three things adding up to 20", d.Order, d.Totals, d.TotalsHTML)
+	}
+
+	updateRoom(c, rk.Encode(), Update{Updater: "bob", UpdateAll: true, Type: eventBackground}, 0)
+	if out := refreshWithDelta(t, "PatchTable", "alice", out.Seq); out.Delta == nil || !out.Delta.Reload {
+		t.Errorf("delta after a background change == %+v; want a reload", out.Delta)
+	}
+}
+
+func TestPatchable(t *testing.T) {
+	for _, tc := range []struct {
+		typ  string
+		want bool
+	}{
+		{eventRoll, true},
+		{eventDraw, true},
+		{eventClear, true},
+		{eventBackground, false},
+		{eventImport, false},
+		{"", false},
+		{"something-new", false},
+	} {
+		if got := patchable(tc.typ); got != tc.want {
+			t.Errorf("patchable(%q) == %v; want %v", tc.typ, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,858 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxExpressionDice caps how many physical dice a single expression can roll.
+// It matches the limit newRoll applies to the per-size form fields.
+const maxExpressionDice = 500
+
+// maxExplosions caps how long a single chain of exploding dice can get.
+const maxExplosions = 100
+
+// expressionError describes why a roll expression could not be parsed or evaluated.
+type expressionError struct {
+	Expr string
+	Pos  int
+	Msg  string
+}
+
+func (e *expressionError) Error() string {
+	return fmt.Sprintf("bad roll expression %q at position %d: %s", e.Expr, e.Pos+1, e.Msg)
+}
+
+// rolledDie is a single physical die produced while evaluating an expression.
+type rolledDie struct {
+	Size      string
+	Result    int
+	ResultStr string
+	Dropped   bool
+	// Parent is the index of the die this one exploded from, or -1.
+	Parent     int
+	Penetrated bool
+	Rule       string
+	// SuccessRule is set for dice in a success pool; Success and Failure say how the die scored.
+	SuccessRule string
+	Success     bool
+	Failure     bool
+	// History holds results a reroll rule threw away, oldest first.
+	History    []int
+	RerollRule string
+	// Draw counts the calls to roll made before the one that produced Result.
+	Draw int
+}
+
+// value is the amount the die contributes to an expression.
+func (rd rolledDie) value() int {
+	v := dieValue(rd.Size, rd.Result)
+	if rd.Penetrated {
+		v--
+	}
+	return v
+}
+
+// expressionResult is the outcome of evaluating a roll expression.
+type expressionResult struct {
+	Total int
+	Dice  []rolledDie
+}
+
+// rollNode is a node in a parsed roll expression.
+type rollNode interface {
+	eval(ev *expressionEvaluator) (int, error)
+}
+
+type numberNode struct {
+	value int
+}
+
+func (n *numberNode) eval(_ *expressionEvaluator) (int, error) {
+	return n.value, nil
+}
+
+type negateNode struct {
+	operand rollNode
+}
+
+func (n *negateNode) eval(ev *expressionEvaluator) (int, error) {
+	v, err := n.operand.eval(ev)
+	return -v, err
+}
+
+type binaryNode struct {
+	op          byte
+	pos         int
+	left, right rollNode
+}
+
+func (n *binaryNode) eval(ev *expressionEvaluator) (int, error) {
+	l, err := n.left.eval(ev)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.right.eval(ev)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	case '/':
+		if r == 0 {
+			return 0, ev.errorf(n.pos, "division by zero")
+		}
+		return l / r, nil
+	}
+	return 0, ev.errorf(n.pos, "unknown operator %q", n.op)
+}
+
+// diceNode rolls count dice of the given size (a number, "F" or "H") and sums them.
+type diceNode struct {
+	pos     int
+	count   int
+	size    string
+	keep    *keepRule
+	explode *explodeRule
+	success *successRule
+	reroll  *rerollRule
+}
+
+// rerollRule is an r or ro suffix: "r<2" rerolls until the result is 2 or more,
+// "ro1" rerolls a 1 once and keeps whatever comes up.
+type rerollRule struct {
+	once bool
+	on   comparePoint
+}
+
+func (rr *rerollRule) String() string {
+	if rr.once {
+		return "ro" + rr.on.String()
+	}
+	return "r" + rr.on.String()
+}
+
+// apply rerolls result as the rule asks and returns the final result along with
+// the results it replaced.
+func (rr *rerollRule) apply(size string, result int, rs string, roll func(string) (int, string)) (int, string, []int) {
+	history := []int{}
+	for rr.on.matches(dieValue(size, result)) && len(history) < maxExplosions {
+		history = append(history, result)
+		result, rs = roll(size)
+		if rr.once {
+			break
+		}
+	}
+	return result, rs, history
+}
+
+// rerollRuleFor rebuilds a stored rule (as written by rerollRule.String) for dice of the given size.
+func rerollRuleFor(size, rule string) (*rerollRule, error) {
+	n, err := parseRollExpression("1d" + size + rule)
+	if err != nil {
+		return nil, err
+	}
+	dn, ok := n.(*diceNode)
+	if !ok || dn.reroll == nil {
+		return nil, fmt.Errorf("%q is not a reroll rule", rule)
+	}
+	return dn.reroll, nil
+}
+
+// comparePoint is a threshold such as the ">5" in "d6!>5".
+type comparePoint struct {
+	op    string
+	value int
+}
+
+func (cp comparePoint) matches(v int) bool {
+	switch cp.op {
+	case ">":
+		return v > cp.value
+	case ">=":
+		return v >= cp.value
+	case "<":
+		return v < cp.value
+	case "<=":
+		return v <= cp.value
+	}
+	return v == cp.value
+}
+
+// coversAll says whether every result from lo to hi matches. It is worked out from the
+// bounds, so a d2000000000 is no slower to check than a d6.
+func (cp comparePoint) coversAll(lo, hi int) bool {
+	if lo > hi {
+		return true
+	}
+	switch cp.op {
+	case ">":
+		return cp.value < lo
+	case ">=":
+		return cp.value <= lo
+	case "<":
+		return cp.value > hi
+	case "<=":
+		return cp.value >= hi
+	}
+	return lo == hi && cp.value == lo
+}
+
+func (cp comparePoint) String() string {
+	return fmt.Sprintf("%s%d", cp.op, cp.value)
+}
+
+// successRule turns dice into a pool that counts hits instead of summing, as in "8d10>=8".
+// Results matching the optional failure point ("f1") take a success away.
+type successRule struct {
+	success comparePoint
+	failure *comparePoint
+}
+
+func (sr *successRule) String() string {
+	if sr.failure == nil {
+		return sr.success.String()
+	}
+	return sr.success.String() + "f" + sr.failure.String()
+}
+
+// score reports whether a die worth v is a success or a failure.
+func (sr *successRule) score(v int) (bool, bool) {
+	if sr.success.matches(v) {
+		return true, false
+	}
+	return false, sr.failure != nil && sr.failure.matches(v)
+}
+
+// successRuleFor rebuilds a stored rule (as written by successRule.String) for dice of the given size.
+func successRuleFor(size, rule string) (*successRule, error) {
+	n, err := parseRollExpression("1d" + size + rule)
+	if err != nil {
+		return nil, err
+	}
+	dn, ok := n.(*diceNode)
+	if !ok || dn.success == nil {
+		return nil, fmt.Errorf("%q is not a success rule", rule)
+	}
+	return dn.success, nil
+}
+
+// explodeRule is a !, !! or !p suffix. Every result matching on rolls another die:
+// exploded dice count on their own, compounded dice fold into the die that started
+// the chain, and penetrating dice count one less than they show.
+type explodeRule struct {
+	mode string // "!", "!!" or "!p"
+	on   comparePoint
+}
+
+func (e *explodeRule) String() string {
+	return e.mode + e.on.String()
+}
+
+// chain rolls the extra dice that result sets off, each one able to explode in turn.
+// Each extra die's Parent is the index in the chain of the die it exploded from,
+// with -1 standing for the die that started the chain.
+func (e *explodeRule) chain(size string, result, limit int, roll func(string) (int, string)) []rolledDie {
+	extra := []rolledDie{}
+	for e.on.matches(result) && len(extra) < limit {
+		r, rs := roll(size)
+		extra = append(extra, rolledDie{Size: size, Result: r, ResultStr: rs, Parent: len(extra) - 1, Penetrated: e.mode == "!p", Rule: e.String()})
+		result = r
+	}
+	return extra
+}
+
+// explodeRuleFor rebuilds a stored rule (as written by explodeRule.String) for dice of the given size.
+func explodeRuleFor(size, rule string) (*explodeRule, error) {
+	n, err := parseRollExpression("1d" + size + rule)
+	if err != nil {
+		return nil, err
+	}
+	dn, ok := n.(*diceNode)
+	if !ok || dn.explode == nil {
+		return nil, fmt.Errorf("%q is not an explode rule", rule)
+	}
+	return dn.explode, nil
+}
+
+// keepRule is a kh/kl/dh/dl suffix: keep or drop the n highest or lowest dice.
+type keepRule struct {
+	drop bool
+	high bool
+	n    int
+}
+
+// dropped reports which of the given results the rule throws away.
+func (k *keepRule) dropped(values []int) []bool {
+	out := make([]bool, len(values))
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	// Lowest first; ties keep roll order so the choice is stable.
+	sort.SliceStable(order, func(a, b int) bool { return values[order[a]] < values[order[b]] })
+	n := k.n
+	if n > len(values) {
+		n = len(values)
+	}
+	var toDrop []int
+	switch {
+	case k.drop && k.high:
+		toDrop = order[len(order)-n:]
+	case k.drop:
+		toDrop = order[:n]
+	case k.high:
+		toDrop = order[:len(order)-n]
+	default:
+		toDrop = order[n:]
+	}
+	for _, i := range toDrop {
+		out[i] = true
+	}
+	return out
+}
+
+func (n *diceNode) eval(ev *expressionEvaluator) (int, error) {
+	if ev.rolled+n.count > maxExpressionDice {
+		return 0, ev.errorf(n.pos, "too many dice (the limit is %d)", maxExpressionDice)
+	}
+	ev.rolled += n.count
+	// Each group is one die plus anything it exploded into.
+	groups := make([][]rolledDie, n.count)
+	for i := range groups {
+		r, rs := ev.roll(n.size)
+		groups[i] = []rolledDie{{Size: n.size, Result: r, ResultStr: rs, Parent: -1}}
+		if n.reroll != nil {
+			r, rs, groups[i][0].History = n.reroll.apply(n.size, r, rs, ev.roll)
+			groups[i][0].Result, groups[i][0].ResultStr = r, rs
+			groups[i][0].RerollRule = n.reroll.String()
+		}
+		groups[i][0].Draw = ev.draws - 1
+		if n.explode != nil {
+			groups[i][0].Rule = n.explode.String()
+			limit := maxExplosions
+			if left := maxExpressionDice - ev.rolled; left < limit {
+				limit = left
+			}
+			start := ev.draws
+			extra := n.explode.chain(n.size, r, limit, ev.roll)
+			for j := range extra {
+				extra[j].Draw = start + j
+			}
+			ev.rolled += len(extra)
+			groups[i] = append(groups[i], extra...)
+		}
+	}
+	// Keep and drop look at compounded chains as a single die, otherwise at every die.
+	var units [][]int
+	offset := 0
+	for _, g := range groups {
+		if n.explode != nil && n.explode.mode == "!!" {
+			unit := []int{}
+			for j := range g {
+				unit = append(unit, offset+j)
+			}
+			units = append(units, unit)
+		} else {
+			for j := range g {
+				units = append(units, []int{offset + j})
+			}
+		}
+		offset += len(g)
+	}
+	rolled := []rolledDie{}
+	for _, g := range groups {
+		// Point extra dice at their parent's position in the whole expression.
+		base := len(ev.dice) + len(rolled)
+		for j, rd := range g {
+			if j > 0 {
+				rd.Parent = base + rd.Parent + 1
+			}
+			rolled = append(rolled, rd)
+		}
+	}
+	values := make([]int, len(units))
+	for i, unit := range units {
+		for _, j := range unit {
+			values[i] += rolled[j].value()
+		}
+	}
+	if n.keep != nil {
+		for i, d := range n.keep.dropped(values) {
+			for _, j := range units[i] {
+				rolled[j].Dropped = d
+			}
+		}
+	}
+	total := 0
+	for i, unit := range units {
+		if n.success != nil {
+			for _, j := range unit {
+				rolled[j].SuccessRule = n.success.String()
+			}
+		}
+		if rolled[unit[0]].Dropped {
+			continue
+		}
+		if n.success == nil {
+			total += values[i]
+			continue
+		}
+		// A compounded chain scores once, on the die that started it.
+		hit, miss := n.success.score(values[i])
+		rolled[unit[0]].Success = hit
+		rolled[unit[0]].Failure = miss
+		if hit {
+			total++
+		} else if miss {
+			total--
+		}
+	}
+	ev.dice = append(ev.dice, rolled...)
+	return total, nil
+}
+
+// dieValue converts a stored die result into the amount it contributes to an expression.
+// Fate dice are stored as 1-3 and count as -1, 0 and +1.
+func dieValue(size string, result int) int {
+	if size == "F" {
+		return result - 2
+	}
+	return result
+}
+
+type expressionEvaluator struct {
+	expr   string
+	roll   func(string) (int, string)
+	rolled int
+	// draws is how many times roll has been called.
+	draws int
+	dice  []rolledDie
+}
+
+func (ev *expressionEvaluator) errorf(pos int, format string, args ...interface{}) error {
+	return &expressionError{Expr: ev.expr, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// expressionParser is a small recursive descent parser for roll expressions such as
+// "2d6+1d8+3" or "(1d4+1)*2".
+//
+//	expr    := term (('+' | '-') term)*
+//	term    := unary (('*' | '/') unary)*
+//	unary   := '-' unary | '+' unary | primary
+//	primary := number | dice | '(' expr ')'
+//	dice    := [number] 'd' (number | '%' | 'F' | 'H') [reroll] [explode] [keep] [success]
+//	reroll  := ('r' | 'ro') compare
+//	explode := ('!' | '!!' | '!p') [compare]
+//	keep    := ('kh' | 'kl' | 'dh' | 'dl') [number]
+//	success := compare ['f' compare]
+//	compare := ['>' | '>=' | '<' | '<=' | '='] number
+type expressionParser struct {
+	s   string
+	pos int
+}
+
+func parseRollExpression(s string) (rollNode, error) {
+	p := &expressionParser{s: s}
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos])
+	}
+	return n, nil
+}
+
+// evaluateRollExpression parses and evaluates s, using roll to produce each die result.
+func evaluateRollExpression(s string, roll func(string) (int, string)) (expressionResult, error) {
+	n, err := parseRollExpression(s)
+	if err != nil {
+		return expressionResult{}, err
+	}
+	ev := &expressionEvaluator{expr: s}
+	ev.roll = func(size string) (int, string) {
+		ev.draws++
+		return roll(size)
+	}
+	total, err := n.eval(ev)
+	if err != nil {
+		return expressionResult{}, err
+	}
+	return expressionResult{Total: total, Dice: ev.dice}, nil
+}
+
+func (p *expressionParser) errorf(format string, args ...interface{}) error {
+	return &expressionError{Expr: p.s, Pos: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *expressionParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space byte without consuming it, or 0 at the end.
+func (p *expressionParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *expressionParser) parseExpr() (rollNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		pos := p.pos
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, pos: pos, left: left, right: right}
+	}
+}
+
+func (p *expressionParser) parseTerm() (rollNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return left, nil
+		}
+		pos := p.pos
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, pos: pos, left: left, right: right}
+	}
+}
+
+func (p *expressionParser) parseUnary() (rollNode, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &negateNode{operand: n}, nil
+	case '+':
+		p.pos++
+		return p.parseUnary()
+	}
+	return p.parsePrimary()
+}
+
+func (p *expressionParser) parsePrimary() (rollNode, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, p.errorf("unexpected end of expression")
+	case c == '(':
+		p.pos++
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return n, nil
+	case isDigit(c) || c == 'd' || c == 'D':
+		start := p.pos
+		count := 1
+		if isDigit(c) {
+			var err error
+			count, err = p.parseNumber()
+			if err != nil {
+				return nil, err
+			}
+			if p.pos >= len(p.s) || (p.s[p.pos] != 'd' && p.s[p.pos] != 'D') {
+				return &numberNode{value: count}, nil
+			}
+		}
+		p.pos++ // the 'd'
+		size, err := p.parseSize()
+		if err != nil {
+			return nil, err
+		}
+		n := &diceNode{pos: start, count: count, size: size}
+		if err := p.parseModifiers(n); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	return nil, p.errorf("unexpected %q", c)
+}
+
+func (p *expressionParser) parseNumber() (int, error) {
+	start := p.pos
+	for p.pos < len(p.s) && isDigit(p.s[p.pos]) {
+		p.pos++
+	}
+	text := p.s[start:p.pos]
+	n, err := strconv.Atoi(text)
+	if err != nil {
+		p.pos = start
+		return 0, p.errorf("bad number %q", text)
+	}
+	return n, nil
+}
+
+func (p *expressionParser) parseSize() (string, error) {
+	if p.pos >= len(p.s) {
+		return "", p.errorf("missing die size")
+	}
+	switch c := p.s[p.pos]; {
+	case c == '%':
+		p.pos++
+		return "100", nil
+	case c == 'F' || c == 'f':
+		p.pos++
+		return "F", nil
+	case c == 'H' || c == 'h':
+		p.pos++
+		return "H", nil
+	case isDigit(c):
+		start := p.pos
+		n, err := p.parseNumber()
+		if err != nil {
+			return "", err
+		}
+		if n < 1 {
+			p.pos = start
+			return "", p.errorf("dice need at least one side")
+		}
+		return strconv.Itoa(n), nil
+	}
+	return "", p.errorf("missing die size")
+}
+
+// parseModifiers reads any suffixes that follow a die size, such as the "dl1" in "4d6dl1".
+func (p *expressionParser) parseModifiers(n *diceNode) error {
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case '!':
+			if err := p.parseExplode(n); err != nil {
+				return err
+			}
+			continue
+		case '>', '<', '=':
+			if err := p.parseSuccess(n); err != nil {
+				return err
+			}
+			continue
+		}
+		if lower(p.s[p.pos]) == 'r' {
+			if err := p.parseReroll(n); err != nil {
+				return err
+			}
+			continue
+		}
+		if p.pos+1 >= len(p.s) {
+			return nil
+		}
+		c, next := lower(p.s[p.pos]), lower(p.s[p.pos+1])
+		if (c != 'k' && c != 'd') || (next != 'h' && next != 'l') {
+			return nil
+		}
+		if n.keep != nil {
+			return p.errorf("only one keep or drop suffix is allowed")
+		}
+		p.pos += 2
+		k := &keepRule{drop: c == 'd', high: next == 'h', n: 1}
+		if p.pos < len(p.s) && isDigit(p.s[p.pos]) {
+			v, err := p.parseNumber()
+			if err != nil {
+				return err
+			}
+			k.n = v
+		}
+		n.keep = k
+	}
+	return nil
+}
+
+func (p *expressionParser) parseExplode(n *diceNode) error {
+	start := p.pos
+	if n.explode != nil {
+		return p.errorf("only one explode suffix is allowed")
+	}
+	sides, err := strconv.Atoi(n.size)
+	if err != nil {
+		return p.errorf("only numbered dice can explode")
+	}
+	p.pos++ // the '!'
+	e := &explodeRule{mode: "!", on: comparePoint{op: "=", value: sides}}
+	if p.pos < len(p.s) {
+		switch lower(p.s[p.pos]) {
+		case '!':
+			e.mode = "!!"
+			p.pos++
+		case 'p':
+			e.mode = "!p"
+			p.pos++
+		}
+	}
+	if cp, ok, err := p.parseComparePoint(); err != nil {
+		return err
+	} else if ok {
+		e.on = cp
+	}
+	if e.on.coversAll(1, sides) {
+		p.pos = start
+		return p.errorf("every result would explode")
+	}
+	n.explode = e
+	return nil
+}
+
+func (p *expressionParser) parseReroll(n *diceNode) error {
+	start := p.pos
+	if n.reroll != nil {
+		return p.errorf("only one reroll suffix is allowed")
+	}
+	p.pos++ // the 'r'
+	rr := &rerollRule{}
+	if p.pos < len(p.s) && lower(p.s[p.pos]) == 'o' {
+		rr.once = true
+		p.pos++
+	}
+	cp, ok, err := p.parseComparePoint()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return p.errorf("missing reroll target")
+	}
+	rr.on = cp
+	if !rr.once {
+		// Make sure at least one result would be kept.
+		lo, hi := 1, 2
+		switch n.size {
+		case "F":
+			lo, hi = -1, 1
+		case "H":
+			lo, hi = 0, 1
+		default:
+			hi, _ = strconv.Atoi(n.size)
+		}
+		if cp.coversAll(lo, hi) {
+			p.pos = start
+			return p.errorf("every result would be rerolled")
+		}
+	}
+	n.reroll = rr
+	return nil
+}
+
+func (p *expressionParser) parseSuccess(n *diceNode) error {
+	if n.success != nil {
+		return p.errorf("only one success target is allowed")
+	}
+	cp, _, err := p.parseComparePoint()
+	if err != nil {
+		return err
+	}
+	sr := &successRule{success: cp}
+	if p.pos < len(p.s) && lower(p.s[p.pos]) == 'f' {
+		p.pos++
+		fail, ok, err := p.parseComparePoint()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return p.errorf("missing failure target")
+		}
+		sr.failure = &fail
+	}
+	n.success = sr
+	return nil
+}
+
+// parseComparePoint reads an optional threshold such as ">=5" or a bare "6" (meaning "=6").
+func (p *expressionParser) parseComparePoint() (comparePoint, bool, error) {
+	cp := comparePoint{op: "="}
+	if p.pos >= len(p.s) {
+		return cp, false, nil
+	}
+	switch p.s[p.pos] {
+	case '>', '<':
+		cp.op = p.s[p.pos : p.pos+1]
+		p.pos++
+		if p.pos < len(p.s) && p.s[p.pos] == '=' {
+			cp.op += "="
+			p.pos++
+		}
+	case '=':
+		p.pos++
+	default:
+		if !isDigit(p.s[p.pos]) {
+			return cp, false, nil
+		}
+	}
+	if p.pos >= len(p.s) || !isDigit(p.s[p.pos]) {
+		return cp, false, p.errorf("missing number after %q", cp.op)
+	}
+	v, err := p.parseNumber()
+	if err != nil {
+		return cp, false, err
+	}
+	cp.value = v
+	return cp, true, nil
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// describeExpression normalizes an expression for display, e.g. "2D6 + 3" becomes "2d6+3".
+func describeExpression(s string) string {
+	return strings.Replace(noSpaces(s), "D", "d", -1)
+}
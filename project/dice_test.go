@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// fixedRolls returns a roll function that hands out results in order, then repeats the last one.
+func fixedRolls(results ...int) func(string) (int, string) {
+	i := 0
+	return func(string) (int, string) {
+		r := results[i]
+		if i < len(results)-1 {
+			i++
+		}
+		return r, strconv.Itoa(r)
+	}
+}
+
+func TestEvaluateRollExpression(t *testing.T) {
+	tests := []struct {
+		expr      string
+		rolls     []int
+		wantTotal int
+		wantDice  int
+	}{
+		{"3d6", []int{1, 2, 3}, 6, 3},
+		{"d20", []int{17}, 17, 1},
+		{"2d6+1d8+3", []int{4, 5, 7}, 19, 3},
+		{"2d6 - 1", []int{3, 3}, 5, 2},
+		{"(1d4+1)*2", []int{3}, 8, 1},
+		{"10/3", []int{1}, 3, 0},
+		{"-1d6+10", []int{6}, 4, 1},
+		{"4dF", []int{1, 2, 3, 3}, 1, 4},
+		{"1d%", []int{42}, 42, 1},
+		{"0d6+2", []int{1}, 2, 0},
+	}
+	for _, tc := range tests {
+		got, err := evaluateRollExpression(tc.expr, fixedRolls(tc.rolls...))
+		if err != nil {
+			t.Errorf("evaluateRollExpression(%q) == _, %v; want _, nil", tc.expr, err)
+			continue
+		}
+		if got.Total != tc.wantTotal || len(got.Dice) != tc.wantDice {
+			t.Errorf("evaluateRollExpression(%q) == total %v with %v dice; want total %v with %v dice", tc.expr, got.Total, len(got.Dice), tc.wantTotal, tc.wantDice)
+		}
+	}
+}
+
+func TestEvaluateRollExpressionSizes(t *testing.T) {
+	got, err := evaluateRollExpression("1d6+2dF+1dH+1d13", fixedRolls(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"6", "F", "F", "H", "13"}
+	if len(got.Dice) != len(want) {
+		t.Fatalf("got %v dice; want %v", len(got.Dice), len(want))
+	}
+	for i, d := range got.Dice {
+		if d.Size != want[i] {
+			t.Errorf("die %v has size %q; want %q", i, d.Size, want[i])
+		}
+	}
+}
+
+func TestEvaluateRollExpressionErrors(t *testing.T) {
+	for _, expr := range []string{"", "2d", "2d6+", "(1d6", "1d6)", "2x6", "1d0", "1/0", "501d6", "300d6+300d6"} {
+		if _, err := evaluateRollExpression(expr, fixedRolls(1)); err == nil {
+			t.Errorf("evaluateRollExpression(%q) == _, nil; want an error", expr)
+		} else if _, ok := err.(*expressionError); !ok {
+			t.Errorf("evaluateRollExpression(%q) returned %T; want *expressionError", expr, err)
+		}
+	}
+}
+
+func TestDescribeExpression(t *testing.T) {
+	got := describeExpression(" 2D6 + 3 ")
+	want := "2d6+3"
+	if got != want {
+		t.Fatalf("describeExpression(' 2D6 + 3 ') == %v; want %v", got, want)
+	}
+}
+
+func TestKeepAndDrop(t *testing.T) {
+	tests := []struct {
+		expr        string
+		rolls       []int
+		wantTotal   int
+		wantDropped []bool
+	}{
+		{"4d6dl1", []int{3, 1, 6, 4}, 13, []bool{false, true, false, false}},
+		{"4d6dl", []int{3, 1, 6, 4}, 13, []bool{false, true, false, false}},
+		{"2d20kh1", []int{7, 15}, 15, []bool{true, false}},
+		{"2d20kl1", []int{7, 15}, 7, []bool{false, true}},
+		{"3d6dh2", []int{2, 5, 6}, 2, []bool{false, true, true}},
+		{"2d20KH1+5", []int{12, 12}, 17, []bool{true, false}},
+		{"2d6kh5", []int{2, 3}, 5, []bool{false, false}},
+	}
+	for _, tc := range tests {
+		got, err := evaluateRollExpression(tc.expr, fixedRolls(tc.rolls...))
+		if err != nil {
+			t.Errorf("evaluateRollExpression(%q) == _, %v; want _, nil", tc.expr, err)
+			continue
+		}
+		if got.Total != tc.wantTotal {
+			t.Errorf("evaluateRollExpression(%q) total == %v; want %v", tc.expr, got.Total, tc.wantTotal)
+		}
+		for i, d := range got.Dice {
+			if d.Dropped != tc.wantDropped[i] {
+				t.Errorf("evaluateRollExpression(%q) die %v dropped == %v; want %v", tc.expr, i, d.Dropped, tc.wantDropped[i])
+			}
+		}
+	}
+	if _, err := evaluateRollExpression("4d6dl1kh2", fixedRolls(1)); err == nil {
+		t.Error("evaluateRollExpression(\"4d6dl1kh2\") == _, nil; want an error")
+	}
+}
+
+func TestExplodingDice(t *testing.T) {
+	tests := []struct {
+		expr        string
+		rolls       []int
+		wantTotal   int
+		wantParents []int
+	}{
+		{"1d6!", []int{6, 6, 2}, 14, []int{-1, 0, 1}},
+		{"2d6!", []int{6, 3, 4}, 13, []int{-1, 0, -1}},
+		{"1d6!>4", []int{5, 6, 1}, 12, []int{-1, 0, 1}},
+		{"1d6!!", []int{6, 6, 2}, 14, []int{-1, 0, 1}},
+		{"1d6!p", []int{6, 6, 2}, 12, []int{-1, 0, 1}},
+		{"1d6!=1", []int{1, 1, 4}, 6, []int{-1, 0, 1}},
+		{"2d6!!kh1", []int{6, 1, 5}, 7, []int{-1, 0, -1}},
+		{"3d6!kh1", []int{6, 1, 5, 2}, 6, []int{-1, 0, -1, -1}},
+	}
+	for _, tc := range tests {
+		got, err := evaluateRollExpression(tc.expr, fixedRolls(tc.rolls...))
+		if err != nil {
+			t.Errorf("evaluateRollExpression(%q) == _, %v; want _, nil", tc.expr, err)
+			continue
+		}
+		if got.Total != tc.wantTotal {
+			t.Errorf("evaluateRollExpression(%q) total == %v; want %v", tc.expr, got.Total, tc.wantTotal)
+		}
+		if len(got.Dice) != len(tc.wantParents) {
+			t.Errorf("evaluateRollExpression(%q) rolled %v dice; want %v", tc.expr, len(got.Dice), len(tc.wantParents))
+			continue
+		}
+		for i, d := range got.Dice {
+			if d.Parent != tc.wantParents[i] {
+				t.Errorf("evaluateRollExpression(%q) die %v parent == %v; want %v", tc.expr, i, d.Parent, tc.wantParents[i])
+			}
+		}
+	}
+}
+
+func TestExplodingDiceLimits(t *testing.T) {
+	got, err := evaluateRollExpression("1d6!", fixedRolls(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Dice) != maxExplosions+1 {
+		t.Errorf("an endless explosion rolled %v dice; want %v", len(got.Dice), maxExplosions+1)
+	}
+	for _, expr := range []string{"1d6!>0", "1dF!", "1d6!!!", "1d6!>", "1d1!", "1d6!<7", "1d6!>=1", "1d2000000000!>0", "1d2000000000!<=2000000000"} {
+		start := time.Now()
+		if _, err := evaluateRollExpression(expr, fixedRolls(1)); err == nil {
+			t.Errorf("evaluateRollExpression(%q) == _, nil; want an error", expr)
+		}
+		if d := time.Since(start); d > 100*time.Millisecond {
+			t.Errorf("evaluateRollExpression(%q) took %v; want it refused straight away", expr, d)
+		}
+	}
+}
+
+func TestCoversAll(t *testing.T) {
+	for _, tc := range []struct {
+		cp     comparePoint
+		lo, hi int
+		want   bool
+	}{
+		{comparePoint{">", 0}, 1, 6, true},
+		{comparePoint{">", 1}, 1, 6, false},
+		{comparePoint{">=", 1}, 1, 6, true},
+		{comparePoint{">=", 2}, 1, 6, false},
+		{comparePoint{"<", 7}, 1, 6, true},
+		{comparePoint{"<", 6}, 1, 6, false},
+		{comparePoint{"<=", 6}, 1, 6, true},
+		{comparePoint{"<=", 5}, 1, 6, false},
+		{comparePoint{"=", 1}, 1, 1, true},
+		{comparePoint{"=", 6}, 1, 6, false},
+		{comparePoint{"<=", 1}, -1, 1, true},
+	} {
+		if got := tc.cp.coversAll(tc.lo, tc.hi); got != tc.want {
+			t.Errorf("%v.coversAll(%v, %v) == %v; want %v", tc.cp, tc.lo, tc.hi, got, tc.want)
+		}
+	}
+}
+
+func TestExplodeRuleFor(t *testing.T) {
+	got, err := evaluateRollExpression("1d10!p>=9", fixedRolls(9, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, err := explodeRuleFor("10", got.Dice[0].Rule)
+	if err != nil {
+		t.Fatalf("explodeRuleFor(\"10\", %q) == _, %v; want _, nil", got.Dice[0].Rule, err)
+	}
+	if rule.mode != "!p" || rule.on != (comparePoint{op: ">=", value: 9}) {
+		t.Errorf("explodeRuleFor(\"10\", %q) == %v; want !p>=9", got.Dice[0].Rule, rule)
+	}
+}
+
+func TestSuccessPools(t *testing.T) {
+	tests := []struct {
+		expr      string
+		rolls     []int
+		wantTotal int
+		wantHits  []bool
+		wantMiss  []bool
+	}{
+		{"4d10>=8", []int{8, 3, 10, 7}, 2, []bool{true, false, true, false}, []bool{false, false, false, false}},
+		{"4d6>=5f1", []int{5, 1, 1, 6}, 0, []bool{true, false, false, true}, []bool{false, true, true, false}},
+		{"3d6=6", []int{6, 5, 6}, 2, []bool{true, false, true}, []bool{false, false, false}},
+		{"2d10!=10>=8", []int{10, 9, 2}, 2, []bool{true, true, false}, []bool{false, false, false}},
+		{"1d6!!=6>=8", []int{6, 3}, 1, []bool{true, false}, []bool{false, false}},
+		{"3d6kh2>4", []int{6, 5, 1}, 2, []bool{true, true, false}, []bool{false, false, false}},
+		{"2d6>5+1", []int{6, 6}, 3, []bool{true, true}, []bool{false, false}},
+	}
+	for _, tc := range tests {
+		got, err := evaluateRollExpression(tc.expr, fixedRolls(tc.rolls...))
+		if err != nil {
+			t.Errorf("evaluateRollExpression(%q) == _, %v; want _, nil", tc.expr, err)
+			continue
+		}
+		if got.Total != tc.wantTotal {
+			t.Errorf("evaluateRollExpression(%q) total == %v; want %v", tc.expr, got.Total, tc.wantTotal)
+		}
+		for i, d := range got.Dice {
+			if d.Success != tc.wantHits[i] || d.Failure != tc.wantMiss[i] {
+				t.Errorf("evaluateRollExpression(%q) die %v scored %v/%v; want %v/%v", tc.expr, i, d.Success, d.Failure, tc.wantHits[i], tc.wantMiss[i])
+			}
+			if d.SuccessRule == "" {
+				t.Errorf("evaluateRollExpression(%q) die %v has no success rule", tc.expr, i)
+			}
+		}
+	}
+	// A threshold straight after "!" belongs to the explosion, not the pool.
+	got, err := evaluateRollExpression("1d10!>=8", fixedRolls(9, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Total != 10 || got.Dice[0].SuccessRule != "" {
+		t.Errorf("evaluateRollExpression(\"1d10!>=8\") == %v; want a plain total of 10", got)
+	}
+	for _, expr := range []string{"4d6>=", "4d6>=5f", "4d6>=5>=4"} {
+		if _, err := evaluateRollExpression(expr, fixedRolls(1)); err == nil {
+			t.Errorf("evaluateRollExpression(%q) == _, nil; want an error", expr)
+		}
+	}
+}
+
+func TestSuccessRuleFor(t *testing.T) {
+	sr, err := successRuleFor("6", ">=5f=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hit, miss := sr.score(5); !hit || miss {
+		t.Errorf("score(5) == %v, %v; want true, false", hit, miss)
+	}
+	if hit, miss := sr.score(1); hit || !miss {
+		t.Errorf("score(1) == %v, %v; want false, true", hit, miss)
+	}
+}
+
+func TestRerollRules(t *testing.T) {
+	tests := []struct {
+		expr        string
+		rolls       []int
+		wantTotal   int
+		wantHistory [][]int
+	}{
+		{"2d6r<3", []int{1, 2, 5, 4}, 9, [][]int{{1, 2}, {}}},
+		{"1d20ro1", []int{1, 1}, 1, [][]int{{1}}},
+		{"2d20ro1", []int{1, 7, 12}, 19, [][]int{{1}, {}}},
+		{"1d6r1", []int{3}, 3, [][]int{{}}},
+		{"1d6r<=2!", []int{2, 6, 3}, 9, [][]int{{2}, nil}},
+		{"3d6r1>=5", []int{1, 5, 6, 4}, 2, [][]int{{1}, {}, {}}},
+	}
+	for _, tc := range tests {
+		got, err := evaluateRollExpression(tc.expr, fixedRolls(tc.rolls...))
+		if err != nil {
+			t.Errorf("evaluateRollExpression(%q) == _, %v; want _, nil", tc.expr, err)
+			continue
+		}
+		if got.Total != tc.wantTotal {
+			t.Errorf("evaluateRollExpression(%q) total == %v; want %v", tc.expr, got.Total, tc.wantTotal)
+		}
+		if len(got.Dice) != len(tc.wantHistory) {
+			t.Errorf("evaluateRollExpression(%q) rolled %v dice; want %v", tc.expr, len(got.Dice), len(tc.wantHistory))
+			continue
+		}
+		for i, d := range got.Dice {
+			if len(d.History) != len(tc.wantHistory[i]) {
+				t.Errorf("evaluateRollExpression(%q) die %v history == %v; want %v", tc.expr, i, d.History, tc.wantHistory[i])
+				continue
+			}
+			for j := range d.History {
+				if d.History[j] != tc.wantHistory[i][j] {
+					t.Errorf("evaluateRollExpression(%q) die %v history == %v; want %v", tc.expr, i, d.History, tc.wantHistory[i])
+				}
+			}
+		}
+	}
+	for _, expr := range []string{"1d6r", "1d6r<7", "1d6r1r2", "2dFr<=1", "1d2000000000r>0", "1d2000000000r<=2000000000"} {
+		start := time.Now()
+		if _, err := evaluateRollExpression(expr, fixedRolls(1)); err == nil {
+			t.Errorf("evaluateRollExpression(%q) == _, nil; want an error", expr)
+		}
+		if d := time.Since(start); d > 100*time.Millisecond {
+			t.Errorf("evaluateRollExpression(%q) took %v; want it refused straight away", expr, d)
+		}
+	}
+}
+
+// fixedSource hands out results (counted from 1, like dice) in order, then repeats the last one.
+type fixedSource struct {
+	results []int
+}
+
+func (fs *fixedSource) Intn(n int) int {
+	r := fs.results[0]
+	if len(fs.results) > 1 {
+		fs.results = fs.results[1:]
+	}
+	return r - 1
+}
+
+func TestRerollRescoresExplosions(t *testing.T) {
+	defer withMemoryStore()()
+	defer func(f func(string) RandomSource) { randomSourceFor = f }(randomSourceFor)
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: "ExplodingTable"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		explode, success string
+		// The reroll rule throws away the first 1, then the 6 explodes into a 4.
+		wantRoot, wantChain bool
+	}{
+		{"!!=6", ">=8", true, false},
+		{"!p=6", ">=4", true, false},
+		{"!=6", ">=4", true, true},
+	}
+	for i, tc := range tests {
+		randomSourceFor = func(string) RandomSource { return &fixedSource{[]int{1, 6, 4}} }
+		k := datastore.IDKey("Die", int64(i+1), rk)
+		d := Die{Size: "6", Result: 2, ResultStr: "2", KeyStr: k.Encode(), RerollRule: "r=1", ExplodeRule: tc.explode, SuccessRule: tc.success}
+		if _, err := store.Put(c, k, &d); err != nil {
+			t.Fatal(err)
+		}
+		got, err := rerollDieHelper(c, rk, k.Encode(), "ExplodingTable", "alice", false, anyRevision)
+		if err != nil {
+			t.Fatalf("rerollDieHelper() with %v == %v; want nil", tc.explode, err)
+		}
+		if got.Result != 6 || got.IsSuccess != tc.wantRoot {
+			t.Errorf("rerollDieHelper() with %v%v == %v scoring %v; want 6 scoring %v", tc.explode, tc.success, got.Result, got.IsSuccess, tc.wantRoot)
+		}
+		var chain []Die
+		if _, err := store.GetAll(c, NewQuery("Die").Ancestor(rk).Filter("ExplodedFrom =", k.Encode()), &chain); err != nil {
+			t.Fatal(err)
+		}
+		if len(chain) != 1 {
+			t.Errorf("rerollDieHelper() with %v exploded into %v dice; want 1", tc.explode, len(chain))
+			continue
+		}
+		if chain[0].Result != 4 || chain[0].SuccessRule != tc.success || chain[0].IsSuccess != tc.wantChain {
+			t.Errorf("chain after rerolling with %v%v == %v scoring %v under %q; want 4 scoring %v", tc.explode, tc.success, chain[0].Result, chain[0].IsSuccess, chain[0].SuccessRule, tc.wantChain)
+		}
+	}
+}
+
+func TestRerollRuleFor(t *testing.T) {
+	rr, err := rerollRuleFor("20", "ro=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, history := rr.apply("20", 1, "1", fixedRolls(1))
+	if r != 1 || len(history) != 1 {
+		t.Errorf("apply(1) == %v with history %v; want a single reroll", r, history)
+	}
+}
@@ -0,0 +1,331 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Room events are Update entities stored as children of their room, keyed by a
+// sequence number taken from the clock. Appending one touches nothing but the event
+// itself, so players acting at the same time don't fight over a single entity; clients
+// poll for the events after the last sequence number they saw. Events can commit out
+// of the order of their numbers, so reads stop short of any that may still be on their
+// way (see settledSeq).
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	// eventTTL is how long events are kept. Clients poll every second, so this only
+	// needs to cover a client that lost its connection for a while.
+	eventTTL = 10 * time.Minute
+	// pruneInterval limits how often one instance prunes a room's expired events.
+	pruneInterval = time.Minute
+	// roomTouchInterval limits how often events bump Room.Timestamp.
+	roomTouchInterval = time.Minute
+	// appendAttempts is how many times appendEvent tries when its number keeps being
+	// taken or it keeps taking too long to commit.
+	appendAttempts = 10
+	// eventSettle is how long an event may take to commit once numbered, when instances
+	// share the store. Reads leave newer events for later, and events that take longer
+	// are recorded again under a new number.
+	eventSettle = 250 * time.Millisecond
+)
+
+// Event types, as sent in Update.Type. Events recorded before types existed have none.
+const (
+	eventRoll       = "roll"
+	eventDraw       = "draw"
+	eventMove       = "move"
+	eventHide       = "hide"
+	eventReveal     = "reveal"
+	eventClear      = "clear"
+	eventAlert      = "alert"
+	eventBackground = "background"
+	eventCustomSet  = "customset"
+	eventDelete     = "delete"
+	eventShuffle    = "shuffle"
+	eventClock      = "clock"
+	eventImage      = "image"
+	eventFair       = "fair"
+	eventImport     = "import"
+	// eventPresence is someone arriving at the table, leaving or going idle.
+	eventPresence = "presence"
+)
+
+var (
+	seqMu   sync.Mutex
+	lastSeq int64
+	// pending has the numbers of the events this instance is recording in each room.
+	pending = map[string]map[int64]bool{}
+	// lastPrune has the last time each room's events were pruned by this instance.
+	lastPrune   = map[string]time.Time{}
+	lastPruneMu sync.Mutex
+	// errSeqTaken is an event numbered the same as one another instance recorded.
+	errSeqTaken = errors.New("sequence number already taken")
+)
+
+// seqNow is the sequence number the clock says an event happening now should get.
+// Microseconds keep sequence numbers exact in JavaScript.
+func seqNow() int64 {
+	return time.Now().UnixNano() / int64(time.Microsecond)
+}
+
+// nextSeq returns a sequence number for a new event. Numbers come from the clock, and
+// never repeat or go backwards on one instance.
+func nextSeq() int64 {
+	seqMu.Lock()
+	defer seqMu.Unlock()
+	return nextSeqLocked()
+}
+
+func nextSeqLocked() int64 {
+	seq := seqNow()
+	if seq <= lastSeq {
+		seq = lastSeq + 1
+	}
+	lastSeq = seq
+	return seq
+}
+
+// numberEvent numbers an event about to be recorded in room rk. Reads on this instance
+// stop short of it until doneEvent says it has committed or failed.
+func numberEvent(rk string) int64 {
+	seqMu.Lock()
+	defer seqMu.Unlock()
+	seq := nextSeqLocked()
+	if pending[rk] == nil {
+		pending[rk] = map[int64]bool{}
+	}
+	pending[rk][seq] = true
+	return seq
+}
+
+func doneEvent(rk string, seq int64) {
+	seqMu.Lock()
+	defer seqMu.Unlock()
+	delete(pending[rk], seq)
+	if len(pending[rk]) == 0 {
+		delete(pending, rk)
+	}
+}
+
+// settledSeq is how far reads of room rk can go: every event numbered up to it has
+// committed, or will be recorded again under a later number. That leaves out events
+// this instance is still recording, and on a shared store events from the last
+// eventSettle, which other instances may still be recording.
+func settledSeq(rk string) int64 {
+	seqMu.Lock()
+	// Events numbered from here on come after this.
+	settled := seqNow() - 1
+	if lastSeq > settled {
+		settled = lastSeq
+	}
+	for seq := range pending[rk] {
+		if seq <= settled {
+			settled = seq - 1
+		}
+	}
+	seqMu.Unlock()
+	if settle := storeSettle(); settle > 0 {
+		if s := seqNow() - int64(settle/time.Microsecond); s < settled {
+			settled = s
+		}
+	}
+	return settled
+}
+
+// storeSettle is how long reads wait for events to settle: eventSettle on Datastore,
+// which instances share, and nothing on stores only this instance writes to.
+func storeSettle() time.Duration {
+	if _, shared := store.(*datastoreStore); shared {
+		return eventSettle
+	}
+	return 0
+}
+
+// startSeq is where a client that has just loaded the room, whose newest event is
+// latest, starts reading events from.
+func startSeq(rk string, latest int64) int64 {
+	if settled := settledSeq(rk); settled < latest {
+		return settled
+	}
+	return latest
+}
+
+func eventKey(roomKey *datastore.Key, seq int64) *datastore.Key {
+	return datastore.IDKey("Update", seq, roomKey)
+}
+
+// appendEvent records u as the newest event in the room.
+func appendEvent(c context.Context, roomKey *datastore.Key, u Update) (Update, error) {
+	rk := roomKey.Encode()
+	u.ExpireAt = time.Now().Add(eventTTL).Unix()
+	// recorded is the number u is stored under, once it has been.
+	var recorded int64
+	for attempt := 1; ; attempt++ {
+		u.Seq = numberEvent(rk)
+		err := store.RunInTransaction(c, func(tx Transaction) error {
+			var taken Update
+			switch err := tx.Get(eventKey(roomKey, u.Seq), &taken); err {
+			case datastore.ErrNoSuchEntity:
+			case nil:
+				return errSeqTaken
+			default:
+				return err
+			}
+			if recorded != 0 {
+				if err := tx.Delete(eventKey(roomKey, recorded)); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Put(eventKey(roomKey, u.Seq), &u)
+			return err
+		})
+		doneEvent(rk, u.Seq)
+		switch {
+		case err == nil:
+			recorded = u.Seq
+			settle := storeSettle()
+			if settle == 0 || seqNow()-u.Seq <= int64(settle/time.Microsecond) {
+				return u, nil
+			}
+			if attempt >= appendAttempts {
+				log.Printf("event %v in %v kept taking too long to record", u.Seq, rk)
+				return u, nil
+			}
+			// Reads elsewhere may have gone past u while it committed; number it again.
+		case recorded != 0:
+			// u is still there under its old number, which will have to do.
+			log.Printf("could not record event %v in %v again: %v", recorded, rk, err)
+			u.Seq = recorded
+			return u, nil
+		case (err == errSeqTaken || err == datastore.ErrConcurrentTransaction) && attempt < appendAttempts:
+			// Another instance took the number; take a later one.
+		default:
+			return u, fmt.Errorf("could not record event for %v: %v", rk, err)
+		}
+	}
+}
+
+// eventsAfter returns the room's settled events with a sequence number above seq, oldest
+// first.
+func eventsAfter(c context.Context, roomKey *datastore.Key, seq int64) ([]Update, error) {
+	events := []Update{}
+	q := NewQuery("Update").Ancestor(roomKey).Filter("Seq >", seq).Filter("Seq <=", settledSeq(roomKey.Encode())).Order("Seq")
+	if _, err := store.GetAll(c, q, &events); err != nil {
+		return nil, fmt.Errorf("could not get events for %v: %v", roomKey.Encode(), err)
+	}
+	return events, nil
+}
+
+// latestEvent returns the room's newest event, if it has one.
+func latestEvent(c context.Context, roomKey *datastore.Key) (Update, bool, error) {
+	events := []Update{}
+	q := NewQuery("Update").Ancestor(roomKey).Order("-Seq").Limit(1)
+	if _, err := store.GetAll(c, q, &events); err != nil {
+		return Update{}, false, fmt.Errorf("could not get latest event for %v: %v", roomKey.Encode(), err)
+	}
+	if len(events) == 0 {
+		return Update{}, false, nil
+	}
+	return events[0], true, nil
+}
+
+// pruneEvents deletes the room's expired events, apart from the newest one, which
+// remembers the room's current modifier.
+func pruneEvents(c context.Context, roomKey *datastore.Key, now time.Time) (int, error) {
+	q := NewQuery("Update").Ancestor(roomKey).Filter("ExpireAt <", now.Unix()).Order("ExpireAt").KeysOnly()
+	expired, err := store.GetAll(c, q, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not find expired events for %v: %v", roomKey.Encode(), err)
+	}
+	latest, ok, err := latestEvent(c, roomKey)
+	if err != nil {
+		return 0, err
+	}
+	nuke := []*datastore.Key{}
+	for _, k := range expired {
+		if ok && k.ID == latest.Seq {
+			continue
+		}
+		nuke = append(nuke, k)
+	}
+	if len(nuke) == 0 {
+		return 0, nil
+	}
+	err = store.RunInTransaction(c, func(tx Transaction) error {
+		return tx.DeleteMulti(nuke)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not prune events for %v: %v", roomKey.Encode(), err)
+	}
+	return len(nuke), nil
+}
+
+// maybePruneEvents prunes the room's events unless this instance did so recently.
+func maybePruneEvents(c context.Context, roomKey *datastore.Key) {
+	now := time.Now()
+	rk := roomKey.Encode()
+	lastPruneMu.Lock()
+	due := now.Sub(lastPrune[rk]) >= pruneInterval
+	if due {
+		lastPrune[rk] = now
+	}
+	lastPruneMu.Unlock()
+	if !due {
+		return
+	}
+	if _, err := pruneEvents(c, roomKey, now); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// touchRoom keeps Room.Timestamp roughly current without writing the room on every
+// event, and creates the room if it has gone missing.
+func touchRoom(c context.Context, roomKey *datastore.Key, t int64) error {
+	var r Room
+	err := store.Get(c, roomKey, &r)
+	if err == nil && t-r.Timestamp < int64(roomTouchInterval/time.Second) {
+		return nil
+	}
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return fmt.Errorf("could not get room %v: %v", roomKey.Encode(), err)
+	}
+	return store.RunInTransaction(c, func(tx Transaction) error {
+		err := tx.Get(roomKey, &r)
+		if err == datastore.ErrNoSuchEntity {
+			// Couldn't find it, so create it
+			log.Printf("couldn't find room %v, so going to create it", roomKey.Encode())
+			r = newRoomEntity(roomKey, generateRoomName(3))
+		} else if err != nil {
+			return fmt.Errorf("issue updating room: %v", err)
+		} else if r.Timestamp >= t {
+			return nil
+		}
+		r.Timestamp = t
+		if _, err := tx.Put(roomKey, &r); err != nil {
+			return fmt.Errorf("could not update room %v: %v", roomKey.Encode(), err)
+		}
+		return nil
+	})
+}
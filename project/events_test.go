@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/karlseguin/ccache"
+)
+
+// withMemoryStore points the app at a fresh in-memory store until the returned func is called.
+func withMemoryStore() func() {
+	oldStore, oldCache := store, updateCache
+	store = newMemoryStore()
+	updateCache = ccache.New(ccache.Configure())
+	presenceMu.Lock()
+	presenceWrites = map[string]presenceWrite{}
+	presenceMu.Unlock()
+	webhookMu.Lock()
+	webhookCache = map[string]cachedWebhooks{}
+	webhookMu.Unlock()
+	return func() {
+		store, updateCache = oldStore, oldCache
+	}
+}
+
+func TestNextSeqIncreases(t *testing.T) {
+	last := nextSeq()
+	for i := 0; i < 1000; i++ {
+		seq := nextSeq()
+		if seq <= last {
+			t.Fatalf("nextSeq() == %v after %v; want it to increase", seq, last)
+		}
+		last = seq
+	}
+}
+
+func TestEventsAfter(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	seqs := []int64{}
+	for _, m := range []string{"one", "two", "three"} {
+		u, err := appendEvent(c, rk, Update{Message: m})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, u.Seq)
+	}
+	events, err := eventsAfter(c, rk, seqs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Message != "two" || events[1].Message != "three" {
+		t.Errorf("eventsAfter(first) == %+v; want events two and three in order", events)
+	}
+	latest, ok, err := latestEvent(c, rk)
+	if err != nil || !ok || latest.Seq != seqs[2] {
+		t.Errorf("latestEvent() == %+v, %v, %v; want event three", latest, ok, err)
+	}
+}
+
+func TestEventsAfterStopsShortOfPendingEvents(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := appendEvent(c, rk, Update{Message: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	// An event numbered before the next one, but still being recorded.
+	slow := numberEvent(rk.Encode())
+	if _, err := appendEvent(c, rk, Update{Message: "third"}); err != nil {
+		t.Fatal(err)
+	}
+	messages := func() []string {
+		events, err := eventsAfter(c, rk, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, u := range events {
+			got = append(got, u.Message)
+		}
+		return got
+	}
+	if got := messages(); !reflect.DeepEqual(got, []string{"first"}) {
+		t.Errorf("events while the second is recorded == %v; want just the first", got)
+	}
+	if _, err := store.Put(c, eventKey(rk, slow), &Update{Seq: slow, Message: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	doneEvent(rk.Encode(), slow)
+	if got := messages(); !reflect.DeepEqual(got, []string{"first", "second", "third"}) {
+		t.Errorf("events once the second is recorded == %v; want all three in order", got)
+	}
+}
+
+func TestConcurrentEventsArriveInOrder(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	const players, moves = 5, 30
+
+	feed, stop := roomEvents.subscribe(rk.Encode(), 0)
+	defer stop()
+	fed := make(chan []int64)
+	go func() {
+		var seqs []int64
+		for u := range feed {
+			if seqs = append(seqs, u.Seq); len(seqs) == players*moves {
+				break
+			}
+		}
+		fed <- seqs
+	}()
+
+	// A poller reads what's new as the players drag dice about.
+	done := make(chan struct{})
+	polled := make(chan []int64)
+	go func() {
+		var seqs []int64
+		var last int64
+		for {
+			select {
+			case <-done:
+				polled <- seqs
+				return
+			default:
+			}
+			events, err := eventsAfter(c, rk, last)
+			if err != nil {
+				t.Error(err)
+			}
+			for _, u := range events {
+				seqs = append(seqs, u.Seq)
+				last = u.Seq
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for p := 0; p < players; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < moves; i++ {
+				u, err := appendEvent(c, rk, Update{Type: eventMove})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				roomEvents.caughtUp(c, rk.Encode(), u.Seq)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	all, err := eventsAfter(c, rk, 0)
+	if err != nil || len(all) != players*moves {
+		t.Fatalf("recorded %v events, %v; want %v", len(all), err, players*moves)
+	}
+	// The poller may have stopped before the last few, but it must not have skipped any.
+	seen := <-polled
+	for i, seq := range seen {
+		if seq != all[i].Seq {
+			t.Fatalf("poller saw %v at %v; want %v, it skipped an event", seq, i, all[i].Seq)
+		}
+	}
+	select {
+	case seqs := <-fed:
+		for i, seq := range seqs {
+			if seq != all[i].Seq {
+				t.Fatalf("feed sent %v at %v; want %v", seq, i, all[i].Seq)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the feed never sent every event")
+	}
+}
+
+func TestPruneEventsKeepsNewest(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	for i := 0; i < 3; i++ {
+		if _, err := appendEvent(c, rk, Update{Modifier: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := pruneEvents(c, rk, time.Now().Add(2*eventTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("pruneEvents() removed %v events; want 2", n)
+	}
+	latest, ok, err := latestEvent(c, rk)
+	if err != nil || !ok || latest.Modifier != 2 {
+		t.Errorf("latestEvent() after pruning == %+v, %v, %v; want the newest event kept", latest, ok, err)
+	}
+}
+
+func TestRefreshRoomSkipsOwnEvents(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	updateRoom(c, rk.Encode(), Update{Updater: "me"}, 0)
+	updateRoom(c, rk.Encode(), Update{Updater: "me", UpdateAll: true, Message: "X card"}, 0)
+	updateRoom(c, rk.Encode(), Update{Updater: "them"}, 0)
+
+	got := refreshRoom(c, rk.Encode(), "me", 0)
+	if len(got.Events) != 2 || got.Events[0].Message != "X card" || got.Events[1].Updater != playerID(rk.Encode(), "them") {
+		t.Errorf("refreshRoom() events == %+v; want the X card and their event", got.Events)
+	}
+	for _, u := range got.Events {
+		if u.Updater == "me" || u.Updater == "them" {
+			t.Errorf("refreshRoom() sent updater %q; want fingerprints kept on the server", u.Updater)
+		}
+	}
+	again := refreshRoom(c, rk.Encode(), "me", got.Seq)
+	if again.Seq != got.Seq || len(again.Events) != 0 {
+		t.Errorf("refreshRoom() at the latest seq == %+v; want no events and the same seq", again)
+	}
+
+	var r Room
+	if err := store.Get(c, rk, &r); err != nil {
+		t.Fatalf("updateRoom did not create the missing room: %v", err)
+	}
+	if r.Timestamp == 0 {
+		t.Errorf("room Timestamp was not set by updateRoom")
+	}
+}
+
+// conflictingStore writes key again before the next conflicts transactions that read it
+// commit, as another instance changing it at the same time would.
+type conflictingStore struct {
+	Store
+	key       *datastore.Key
+	conflicts int
+}
+
+func (s *conflictingStore) RunInTransaction(c context.Context, f func(tx Transaction) error) error {
+	return s.Store.RunInTransaction(c, func(tx Transaction) error {
+		if err := f(tx); err != nil || s.conflicts == 0 {
+			return err
+		}
+		if _, ok := tx.(*localTransaction).reads[s.key.Encode()]; !ok {
+			return nil
+		}
+		s.conflicts--
+		var d Die
+		if err := s.Store.Get(c, s.key, &d); err != nil {
+			return err
+		}
+		_, err := s.Store.Put(c, s.key, &d)
+		return err
+	})
+}
+
+// eventCount counts the room's events of type typ.
+func eventCount(t *testing.T, rk *datastore.Key, typ string) int {
+	events, err := eventsAfter(context.Background(), rk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, u := range events {
+		if u.Type == typ {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDieEventsFollowCommits(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: "CommitTable"}); err != nil {
+		t.Fatal(err)
+	}
+	dk := datastore.IDKey("Die", 1, rk)
+	if _, err := store.Put(c, dk, &Die{Size: "card", ResultStr: "A♠", IsCard: true, IsHidden: true, HiddenBy: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rerollDieHelper(c, rk, dk.Encode(), "CommitTable", "alice", false, anyRevision); err == nil {
+		t.Error("rerollDieHelper() of bob's card by alice succeeded; want it refused")
+	}
+	if n := eventCount(t, rk, eventRoll); n != 0 {
+		t.Errorf("%v roll events after a refused reroll; want none", n)
+	}
+	if err := deleteDieHelper(c, rk, datastore.IDKey("Die", 2, rk).Encode()); err == nil {
+		t.Error("deleteDieHelper() of a missing die succeeded; want an error")
+	}
+	if n := eventCount(t, rk, eventDelete); n != 0 {
+		t.Errorf("%v delete events after a failed delete; want none", n)
+	}
+
+	// A reveal that has to retry is still one reveal.
+	store = &conflictingStore{Store: store, key: dk, conflicts: 1}
+	if _, err := revealDieHelper(c, rk, dk.Encode(), "bob", anyRevision); err != nil {
+		t.Fatal(err)
+	}
+	if n := eventCount(t, rk, eventReveal); n != 1 {
+		t.Errorf("%v reveal events after a retried reveal; want 1", n)
+	}
+
+	// A hide that never gets to commit didn't happen.
+	store.(*conflictingStore).conflicts = localTransactionAttempts
+	if _, err := hideDieHelper(c, rk, dk.Encode(), "bob", anyRevision); err != datastore.ErrConcurrentTransaction {
+		t.Fatalf("hideDieHelper() with every attempt conflicting == %v; want %v", err, datastore.ErrConcurrentTransaction)
+	}
+	if n := eventCount(t, rk, eventHide); n != 0 {
+		t.Errorf("%v hide events after a hide that never committed; want none", n)
+	}
+}
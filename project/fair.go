@@ -0,0 +1,281 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Provably fair rooms use commit-reveal: when a session starts the room publishes the
+// SHA-256 of a secret seed, every draw is derived from HMAC-SHA256(seed, nonce), and each
+// die records its nonce. Revealing the seed at the end lets anyone recompute the dice
+// with cmd/rollerverify.
+//
+// Card and custom set draws take nonces from the seed too, so they can't be steered
+// either, but they don't record them and aren't verifiable: a draw depends on the
+// whole shuffle of what was left, not on one nonce.
+
+import (
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// fairIntn derives a number in [0, n) from the seed and nonce. Any change here must be
+// mirrored in cmd/rollerverify or old sessions will stop verifying.
+func fairIntn(seed []byte, nonce int64, n int) int {
+	if n <= 0 {
+		panic("invalid argument to fairIntn")
+	}
+	// Reject values past the last whole multiple of n so every result is equally likely.
+	limit := math.MaxUint64 - math.MaxUint64%uint64(n)
+	for round := 0; ; round++ {
+		mac := hmac.New(sha256.New, seed)
+		_, _ = fmt.Fprintf(mac, "%d:%d", nonce, round)
+		v := binary.BigEndian.Uint64(mac.Sum(nil)[:8])
+		if v < limit {
+			return int(v % uint64(n))
+		}
+	}
+}
+
+// fairSource is the RandomSource for a provably fair room. It takes nonces from the
+// room's counter, so the room has to be put back in the transaction that used it.
+type fairSource struct {
+	room *Room
+	// last is the nonce behind the most recent draw.
+	last int64
+	// drawn lists the nonce of every draw, in order.
+	drawn []int64
+}
+
+func (fs *fairSource) Intn(n int) int {
+	fs.room.FairNonce++
+	fs.last = fs.room.FairNonce
+	fs.drawn = append(fs.drawn, fs.last)
+	return fairIntn(fs.room.FairSeed, fs.last, n)
+}
+
+// isFair reports whether rolls in the room are currently committed to a published seed.
+func (r *Room) isFair() bool {
+	return r.FairSeedHash != "" && !r.FairRevealed
+}
+
+// roomRandomness returns the RandomSource for rolls in the room r. For provably fair
+// rooms the caller must put r back in the same transaction so nonces are never reused.
+func roomRandomness(r *Room, roomKey *datastore.Key) RandomSource {
+	if r.isFair() {
+		return &fairSource{room: r}
+	}
+	return randomSourceFor(roomKey.Encode())
+}
+
+// drawCount is how many draws src has handed out, for fair sources.
+func drawCount(src RandomSource) int {
+	if fs, ok := src.(*fairSource); ok {
+		return len(fs.drawn)
+	}
+	return 0
+}
+
+// stampNonce records which draw produced d's result when src is a fair source.
+// draw is the index of that draw (see drawCount), or -1 for the most recent one.
+// Otherwise it clears them, so a die rerolled after its session ended isn't checked
+// against a draw that no longer made it.
+func stampNonce(src RandomSource, d *Die, draw int) {
+	fs, ok := src.(*fairSource)
+	if !ok {
+		d.Nonce, d.SeedHash = 0, ""
+		return
+	}
+	d.SeedHash = fs.room.FairSeedHash
+	if draw < 0 {
+		d.Nonce = fs.last
+	} else if draw < len(fs.drawn) {
+		d.Nonce = fs.drawn[draw]
+	}
+}
+
+// startFairSession commits the room to a fresh secret seed. If an earlier seed was
+// revealed it is kept so dice from that session can still be verified.
+func startFairSession(c context.Context, roomKey *datastore.Key) (string, error) {
+	seed := make([]byte, 32)
+	if _, err := crand.Read(seed); err != nil {
+		return "", fmt.Errorf("could not create seed: %v", err)
+	}
+	sum := sha256.Sum256(seed)
+	hash := hex.EncodeToString(sum[:])
+	err := store.RunInTransaction(c, func(tx Transaction) error {
+		var r Room
+		if err := tx.Get(roomKey, &r); err != nil {
+			return fmt.Errorf("could not find room for fair session: %v", err)
+		}
+		if r.isFair() {
+			return fmt.Errorf("a fair session is already running")
+		}
+		if r.FairRevealed {
+			r.RevealedSeeds = append(r.RevealedSeeds, hex.EncodeToString(r.FairSeed))
+		}
+		r.FairSeed = seed
+		r.FairSeedHash = hash
+		r.FairRevealed = false
+		r.FairNonce = 0
+		if _, err := tx.Put(roomKey, &r); err != nil {
+			return fmt.Errorf("could not start fair session: %v", err)
+		}
+		return nil
+	})
+	return hash, err
+}
+
+// revealFairSeed ends the room's fair session and publishes its seed.
+func revealFairSeed(c context.Context, roomKey *datastore.Key) (string, error) {
+	var seed string
+	err := store.RunInTransaction(c, func(tx Transaction) error {
+		var r Room
+		if err := tx.Get(roomKey, &r); err != nil {
+			return fmt.Errorf("could not find room to reveal seed: %v", err)
+		}
+		if !r.isFair() {
+			return fmt.Errorf("no fair session is running")
+		}
+		r.FairRevealed = true
+		seed = hex.EncodeToString(r.FairSeed)
+		if _, err := tx.Put(roomKey, &r); err != nil {
+			return fmt.Errorf("could not reveal seed: %v", err)
+		}
+		return nil
+	})
+	return seed, err
+}
+
+// fairnessRecord is everything needed to check a room's dice offline.
+type fairnessRecord struct {
+	Room string
+	// SeedHash is the commitment for the running or most recent session.
+	SeedHash string
+	Revealed bool
+	// Seeds maps each revealed seed's hash to the hex encoded seed.
+	Seeds map[string]string
+	Dice  []fairDie
+}
+
+type fairDie struct {
+	Key      string
+	Size     string
+	Result   int
+	Nonce    int64
+	SeedHash string
+}
+
+func getFairnessRecord(c context.Context, slug, keyStr string) (fairnessRecord, error) {
+	out := fairnessRecord{Room: slug, Seeds: map[string]string{}, Dice: []fairDie{}}
+	k, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		return out, fmt.Errorf("fairness: could not decode room key %v: %v", keyStr, err)
+	}
+	var r Room
+	if err := store.Get(c, k, &r); err != nil {
+		return out, fmt.Errorf("could not find room: %v", err)
+	}
+	out.SeedHash = r.FairSeedHash
+	out.Revealed = r.FairRevealed
+	seeds := r.RevealedSeeds
+	if r.FairRevealed {
+		seeds = append(seeds, hex.EncodeToString(r.FairSeed))
+	}
+	for _, s := range seeds {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(b)
+		out.Seeds[hex.EncodeToString(sum[:])] = s
+	}
+	dice, err := getRoomDice(c, keyStr, "Timestamp", "true")
+	if err != nil {
+		return out, err
+	}
+	for _, d := range dice {
+		if d.Nonce == 0 {
+			continue
+		}
+		out.Dice = append(out.Dice, fairDie{Key: d.KeyStr, Size: d.Size, Result: d.Result, Nonce: d.Nonce, SeedHash: d.SeedHash})
+	}
+	return out, nil
+}
+
+func StartFair(w http.ResponseWriter, r *http.Request) {
+	c := r.Context()
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
+	}
+	room, roomKey, keyStr := ref.Slug, ref.Key, ref.KeyStr
+	hash, err := startFairSession(c, roomKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	lastAction[room] = "startfair"
+	updateRoom(c, keyStr, Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true, Message: "Provably fair session started. Seed hash: " + hash, Type: eventFair}, 0)
+	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+}
+
+func RevealSeed(w http.ResponseWriter, r *http.Request) {
+	c := r.Context()
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
+	}
+	room, roomKey, keyStr := ref.Slug, ref.Key, ref.KeyStr
+	seed, err := revealFairSeed(c, roomKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	lastAction[room] = "revealseed"
+	updateRoom(c, keyStr, Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true, Message: "Provably fair session ended. Seed: " + seed, Type: eventFair}, 0)
+	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+}
+
+// Fairness serves /room/{slug}/fairness, the input for cmd/rollerverify. Only dice
+// are listed; cards and custom set draws are out of its scope.
+func Fairness(w http.ResponseWriter, r *http.Request, room string) {
+	c := r.Context()
+	keyStr, err := getEncodedRoomKeyFromName(c, room)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	rec, err := getFairnessRecord(c, room, keyStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rec); err != nil {
+		log.Printf("could not write fairness record: %v", err)
+	}
+}
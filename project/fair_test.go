@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+func TestFairIntnKnownValues(t *testing.T) {
+	// cmd/rollerverify derives results the same way; these pin the derivation so the
+	// two can't drift apart without a test failing.
+	want := []int{15, 9, 6, 1, 8}
+	for i, w := range want {
+		if got := fairIntn([]byte("roller"), int64(i+1), 20); got != w {
+			t.Errorf("fairIntn(roller, %v, 20) == %v; want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestFairIntnRange(t *testing.T) {
+	seen := map[int]bool{}
+	for nonce := int64(1); nonce <= 600; nonce++ {
+		v := fairIntn([]byte("seed"), nonce, 6)
+		if v < 0 || v >= 6 {
+			t.Fatalf("fairIntn(_, %v, 6) == %v; want [0, 6)", nonce, v)
+		}
+		seen[v] = true
+	}
+	if len(seen) != 6 {
+		t.Errorf("600 nonces only produced %v distinct values", len(seen))
+	}
+}
+
+func TestFairSourceTakesNonces(t *testing.T) {
+	r := &Room{FairSeedHash: "hash", FairSeed: []byte("seed"), FairNonce: 4}
+	src := roomRandomness(r, roomKey())
+	if _, ok := src.(*fairSource); !ok {
+		t.Fatalf("roomRandomness gave %T for a fair room; want *fairSource", src)
+	}
+	for i := 0; i < 3; i++ {
+		src.Intn(6)
+	}
+	if r.FairNonce != 7 {
+		t.Errorf("FairNonce == %v after three draws from 4; want 7", r.FairNonce)
+	}
+	var d Die
+	stampNonce(src, &d, -1)
+	if d.Nonce != 7 || d.SeedHash != "hash" {
+		t.Errorf("stampNonce gave nonce %v, hash %q; want 7, %q", d.Nonce, d.SeedHash, "hash")
+	}
+	r.FairRevealed = true
+	plain := roomRandomness(r, roomKey())
+	if _, ok := plain.(*fairSource); ok {
+		t.Error("roomRandomness gave a fair source after the seed was revealed")
+	}
+	// Rerolling the die once the session is over takes away its nonce.
+	stampNonce(plain, &d, -1)
+	if d.Nonce != 0 || d.SeedHash != "" {
+		t.Errorf("stampNonce from a plain source left nonce %v, hash %q; want them cleared", d.Nonce, d.SeedHash)
+	}
+}
+
+func TestFairExpressionNonces(t *testing.T) {
+	seed := []byte("exploding")
+	r := &Room{FairSeedHash: "hash", FairSeed: seed}
+	src := roomRandomness(r, roomKey())
+	// Burn a draw first, as a plain die rolled alongside the expression would.
+	getNewResult(src, "8")
+	base := drawCount(src)
+	res, err := evaluateRollExpression("6d6!r1", roller(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, rd := range res.Dice {
+		d := Die{Size: rd.Size, Result: rd.Result}
+		stampNonce(src, &d, base+rd.Draw)
+		if want := fairIntn(seed, d.Nonce, 6) + 1; want != d.Result {
+			t.Errorf("die %v: result %v but nonce %v gives %v", i, d.Result, d.Nonce, want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// The feed hands room events to clients connected to this instance as soon as they
+// are recorded, so they don't have to poll for them.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// feedBuffer is how many events a subscriber can fall behind before it is dropped.
+// Dropped subscribers reconnect and catch up from the store.
+const feedBuffer = 64
+
+type roomFeed struct {
+	mu   sync.Mutex
+	subs map[string]map[chan Update]bool
+	// last has the newest sequence number handed out for each followed room, so events
+	// read more than once only go out once.
+	last map[string]int64
+}
+
+var roomEvents = newRoomFeed()
+
+func newRoomFeed() *roomFeed {
+	return &roomFeed{subs: map[string]map[chan Update]bool{}, last: map[string]int64{}}
+}
+
+// subscribe returns a channel of the room's events after seq and a func to stop them.
+// The channel is closed if the subscriber falls too far behind.
+func (f *roomFeed) subscribe(rk string, seq int64) (<-chan Update, func()) {
+	ch := make(chan Update, feedBuffer)
+	f.mu.Lock()
+	if len(f.subs[rk]) == 0 {
+		f.subs[rk] = map[chan Update]bool{}
+		f.last[rk] = seq
+	}
+	// Later subscribers read what they missed from the store themselves, so the feed
+	// carries on from where the others are and nobody misses what's in between.
+	f.subs[rk][ch] = true
+	f.mu.Unlock()
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.subs[rk][ch] {
+			delete(f.subs[rk], ch)
+			close(ch)
+		}
+		if len(f.subs[rk]) == 0 {
+			delete(f.subs, rk)
+			delete(f.last, rk)
+		}
+	}
+}
+
+// publish hands u to everyone following the room. Events must come in order; anything
+// at or before the last one handed out is dropped.
+func (f *roomFeed) publish(rk string, u Update) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.subs[rk]) == 0 || u.Seq <= f.last[rk] {
+		return
+	}
+	f.last[rk] = u.Seq
+	for ch := range f.subs[rk] {
+		select {
+		case ch <- u:
+		default:
+			log.Printf("dropping a feed subscriber in %v that fell behind", rk)
+			delete(f.subs[rk], ch)
+			close(ch)
+		}
+	}
+	if len(f.subs[rk]) == 0 {
+		delete(f.subs, rk)
+		delete(f.last, rk)
+	}
+}
+
+// following says whether anyone on this instance follows the room, and the newest
+// sequence number they have been sent.
+func (f *roomFeed) following(rk string) (int64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.last[rk], len(f.subs[rk]) > 0
+}
+
+// caughtUp is told when an event numbered seq is recorded in the room, here or on
+// another instance. If anyone here is following the room, the events they haven't had
+// are read from the store and handed out in order. Reads stop short of events that may
+// still be on their way, so events that aren't settled yet are looked for again once
+// they are.
+func (f *roomFeed) caughtUp(c context.Context, rk string, seq int64) {
+	last, ok := f.following(rk)
+	if !ok || seq <= last {
+		return
+	}
+	roomKey, err := datastore.DecodeKey(rk)
+	if err != nil {
+		log.Printf("feed: could not decode room key %v: %v", rk, err)
+		return
+	}
+	events, err := eventsAfter(c, roomKey, last)
+	if err != nil {
+		log.Printf("feed: %v", err)
+		return
+	}
+	for _, u := range events {
+		f.publish(rk, u)
+	}
+	// On this instance, whoever records the events in the way calls again.
+	if settle := storeSettle(); settle > 0 {
+		if last, ok := f.following(rk); ok && last < seq {
+			// The request is likely over by then, so this can't use its context.
+			time.AfterFunc(settle, func() { f.caughtUp(context.Background(), rk, seq) })
+		}
+	}
+}
+
+// errFellBehind ends a follow whose client didn't keep up. The client reconnects and
+// catches up from the store.
+var errFellBehind = errors.New("fell behind the room's events")
+
+// follow hands send the room's events after seq: first the ones already recorded, then
+// each one as it happens. keepalive is called every interval. It returns when send or
+// keepalive fail, when done is closed, or with errFellBehind.
+func follow(c context.Context, roomKey *datastore.Key, seq int64, interval time.Duration, send func(Update) error, keepalive func() error, done <-chan struct{}) error {
+	rk := roomKey.Encode()
+	events, stop := roomEvents.subscribe(rk, seq)
+	defer stop()
+	deliver := func(u Update) error {
+		if u.Seq <= seq {
+			return nil
+		}
+		seq = u.Seq
+		return send(u)
+	}
+	missed, err := eventsAfter(c, roomKey, seq)
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	for _, u := range missed {
+		if err := deliver(u); err != nil {
+			return err
+		}
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case u, ok := <-events:
+			if !ok {
+				return errFellBehind
+			}
+			if err := deliver(u); err != nil {
+				return err
+			}
+		case <-tick.C:
+			if err := keepalive(); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// visibleTo says whether the player with fingerprint fp needs to hear about u; players
+// already know about their own changes unless everyone is meant to reload.
+func (u Update) visibleTo(fp string) bool {
+	return u.Updater != fp || u.UpdateAll
+}
+
+// forPlayers is u as sent out of room rk, with the updater's fingerprint swapped for
+// their playerID.
+func (u Update) forPlayers(rk string) Update {
+	u.Updater = playerID(rk, u.Updater)
+	return u
+}
@@ -0,0 +1,280 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Rooms get made for every cookieless visit and every unknown slug, and most are
+// never used again. The sweeper deletes rooms whose Timestamp is older than the
+// room TTL, along with everything stored under them.
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	// sweepInterval is how often the background sweeper runs.
+	sweepInterval = time.Hour
+	// sweepLimit caps the rooms looked at by one sweep; the next sweep picks up the rest.
+	sweepLimit = 200
+	// maxBatch is the most entities Datastore will write in one call.
+	maxBatch = 500
+)
+
+// roomChildKinds are the kinds stored under a room that go when the room does.
+// EventCounter is only left in rooms whose events were once numbered by a counter.
+var roomChildKinds = []string{"Die", "Update", "Presence", "EventCounter", "Webhook", "WebhookDelivery"}
+
+type sweptRoom struct {
+	Slug      string
+	Key       string
+	Timestamp int64
+	Dice      int
+	Events    int
+}
+
+// sweepReport says what a sweep deleted, or would have deleted on a dry run.
+type sweepReport struct {
+	DryRun bool
+	Cutoff int64
+	Rooms  []sweptRoom
+	// More is set when there were more idle rooms than one sweep looks at.
+	More bool
+}
+
+// parseRoomTTL reads a TTL like "720h". Sweeping deletes data, so it is off unless
+// asked for: an empty setting or zero keeps rooms forever.
+func parseRoomTTL(setting string) (time.Duration, error) {
+	if setting == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(setting)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("bad room TTL %q: want a duration like 720h", setting)
+	}
+	return ttl, nil
+}
+
+// sweepRooms deletes rooms that have been idle since before now-ttl. With dryRun
+// it only reports what it would delete.
+func sweepRooms(c context.Context, now time.Time, ttl time.Duration, dryRun bool) (sweepReport, error) {
+	report := sweepReport{DryRun: dryRun, Cutoff: now.Add(-ttl).Unix(), Rooms: []sweptRoom{}}
+	rooms := []Room{}
+	q := NewQuery("Room").Filter("Timestamp <", report.Cutoff).Order("Timestamp").Limit(sweepLimit + 1)
+	keys, err := store.GetAll(c, q, &rooms)
+	if err != nil {
+		return report, fmt.Errorf("could not find idle rooms: %v", err)
+	}
+	if len(keys) > sweepLimit {
+		keys, report.More = keys[:sweepLimit], true
+	}
+	for i, k := range keys {
+		swept := sweptRoom{Slug: rooms[i].Slug, Key: k.Encode(), Timestamp: rooms[i].Timestamp}
+		if dryRun {
+			if swept.Dice, err = countChildren(c, k, "Die"); err != nil {
+				return report, err
+			}
+			if swept.Events, err = countChildren(c, k, "Update"); err != nil {
+				return report, err
+			}
+			report.Rooms = append(report.Rooms, swept)
+			continue
+		}
+		deleted, err := deleteRoom(c, k, report.Cutoff)
+		if err != nil {
+			return report, err
+		}
+		if deleted == nil {
+			// Someone came back to it since we looked.
+			continue
+		}
+		swept.Dice, swept.Events = deleted["Die"], deleted["Update"]
+		report.Rooms = append(report.Rooms, swept)
+	}
+	return report, nil
+}
+
+func countChildren(c context.Context, roomKey *datastore.Key, kind string) (int, error) {
+	keys, err := store.GetAll(c, NewQuery(kind).Ancestor(roomKey).KeysOnly(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not count %v in room %v: %v", kind, roomKey.Encode(), err)
+	}
+	return len(keys), nil
+}
+
+// deleteRoom deletes the room and everything under it, provided it is still idle
+// since before cutoff. It returns how many of each child kind went, or nil if the
+// room was in use again.
+func deleteRoom(c context.Context, roomKey *datastore.Key, cutoff int64) (map[string]int, error) {
+	var r Room
+	idle := false
+	// The room goes first, in the same transaction as the check that it is still
+	// idle, so a room someone came back to never loses its dice.
+	err := store.RunInTransaction(c, func(tx Transaction) error {
+		idle = false
+		if err := tx.Get(roomKey, &r); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if r.Timestamp >= cutoff {
+			return nil
+		}
+		idle = true
+		return tx.Delete(roomKey)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not delete room %v: %v", roomKey.Encode(), err)
+	}
+	if !idle {
+		return nil, nil
+	}
+	rk := roomKey.Encode()
+	updateCache.Delete(rk)
+	lastPruneMu.Lock()
+	delete(lastPrune, rk)
+	lastPruneMu.Unlock()
+	forgetWebhooks(roomKey)
+
+	// Nothing finds the room by its name now, so what was under it can go outside
+	// the transaction.
+	deleted := map[string]int{}
+	for _, kind := range roomChildKinds {
+		keys, err := store.GetAll(c, NewQuery(kind).Ancestor(roomKey).KeysOnly(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not find %v in deleted room %v: %v", kind, rk, err)
+		}
+		if err := deleteInBatches(c, keys); err != nil {
+			return nil, fmt.Errorf("could not delete %v in deleted room %v: %v", kind, rk, err)
+		}
+		deleted[kind] = len(keys)
+	}
+	log.Printf("deleted idle room %v (%v), last used %v", r.Slug, rk, time.Unix(r.Timestamp, 0))
+	return deleted, nil
+}
+
+// deleteInBatches deletes keys maxBatch at a time, since that is all Datastore
+// takes in one transaction.
+func deleteInBatches(c context.Context, keys []*datastore.Key) error {
+	for start := 0; start < len(keys); start += maxBatch {
+		end := start + maxBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+		err := store.RunInTransaction(c, func(tx Transaction) error {
+			return tx.DeleteMulti(batch)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putInBatches puts dice under keys maxBatch at a time.
+func putInBatches(c context.Context, keys []*datastore.Key, dice []*Die) error {
+	for start := 0; start < len(keys); start += maxBatch {
+		end := start + maxBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err := store.RunInTransaction(c, func(tx Transaction) error {
+			_, err := tx.PutMulti(keys[start:end], dice[start:end])
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("put %v of %v: %v", start, len(keys), err)
+		}
+	}
+	return nil
+}
+
+// sweepForever runs the sweeper every sweepInterval until c is done.
+func sweepForever(c context.Context, ttl time.Duration) {
+	t := time.NewTicker(sweepInterval)
+	defer t.Stop()
+	for {
+		report, err := sweepRooms(c, time.Now(), ttl, false)
+		if err != nil {
+			log.Printf("room sweep: %v", err)
+		} else if len(report.Rooms) > 0 {
+			log.Printf("room sweep deleted %v idle rooms", len(report.Rooms))
+		}
+		select {
+		case <-c.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// adminAllowed checks the request carries ROLLER_ADMIN_TOKEN, either as a bearer
+// token or a token form value. Without a token configured nobody is allowed.
+func adminAllowed(r *http.Request) bool {
+	want := os.Getenv("ROLLER_ADMIN_TOKEN")
+	if want == "" {
+		return false
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if got == "" {
+		got = r.Form.Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// SweepRooms lets an admin run the sweeper. GET requests and dryrun=true only report
+// what would go; a POST deletes it. ttl overrides the configured room TTL.
+func SweepRooms(w http.ResponseWriter, r *http.Request) {
+	c := r.Context()
+	_ = r.ParseForm()
+	if !adminAllowed(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	ttl := roomTTL
+	if s := r.Form.Get("ttl"); s != "" {
+		var err error
+		if ttl, err = parseRoomTTL(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if ttl <= 0 {
+		http.Error(w, "room expiry is turned off; pass a ttl", http.StatusBadRequest)
+		return
+	}
+	dryRun := r.Method != http.MethodPost || r.Form.Get("dryrun") == "true"
+	report, err := sweepRooms(c, time.Now(), ttl, dryRun)
+	if err != nil {
+		log.Printf("room sweep: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("could not write sweep report: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// idleRoom stores a room last used at ts with n dice and an event under it.
+func idleRoom(t *testing.T, id int64, slug string, ts int64, n int) *datastore.Key {
+	c := context.Background()
+	rk := datastore.IDKey("Room", id, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: slug, Timestamp: ts}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := store.Put(c, datastore.IDKey("Die", int64(i+1), rk), &Die{Size: "6", Result: 3}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := appendEvent(c, rk, Update{Updater: "fp"}); err != nil {
+		t.Fatal(err)
+	}
+	return rk
+}
+
+func TestSweepRooms(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	now := time.Now()
+	old := idleRoom(t, 1, "DustyOldRoom", now.Add(-48*time.Hour).Unix(), 3)
+	fresh := idleRoom(t, 2, "BusyRoom", now.Unix(), 2)
+
+	report, err := sweepRooms(c, now, 24*time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rooms) != 1 || report.Rooms[0].Slug != "DustyOldRoom" || report.Rooms[0].Dice != 3 || report.Rooms[0].Events != 1 {
+		t.Errorf("dry run report == %+v; want only DustyOldRoom with 3 dice and 1 event", report.Rooms)
+	}
+	var r Room
+	if err := store.Get(c, old, &r); err != nil {
+		t.Errorf("dry run deleted the idle room: %v", err)
+	}
+
+	report, err = sweepRooms(c, now, 24*time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rooms) != 1 || report.Rooms[0].Dice != 3 {
+		t.Errorf("sweep report == %+v; want DustyOldRoom and its 3 dice", report.Rooms)
+	}
+	if err := store.Get(c, old, &r); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Get of the swept room == %v; want ErrNoSuchEntity", err)
+	}
+	for kind, want := range map[string]int{"Die": 2, "Update": 1} {
+		keys, err := store.GetAll(c, NewQuery(kind).KeysOnly(), nil)
+		if err != nil || len(keys) != want {
+			t.Errorf("%v left after the sweep == %v (%v); want %v, all in the busy room", kind, len(keys), err, want)
+		}
+	}
+	if err := store.Get(c, fresh, &r); err != nil {
+		t.Errorf("sweep deleted the busy room: %v", err)
+	}
+}
+
+func TestDeleteRoomLeavesRoomsInUse(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	now := time.Now()
+	// The room was idle when the sweep listed it, but someone came back before it
+	// got to deleting it.
+	rk := idleRoom(t, 1, "ComebackRoom", now.Unix(), 2)
+	deleted, err := deleteRoom(c, rk, now.Add(-time.Hour).Unix())
+	if err != nil || deleted != nil {
+		t.Errorf("deleteRoom() of a room in use == %v, %v; want nothing deleted", deleted, err)
+	}
+	var r Room
+	if err := store.Get(c, rk, &r); err != nil {
+		t.Errorf("deleteRoom() took the room in use: %v", err)
+	}
+	if n, err := countChildren(c, rk, "Die"); err != nil || n != 2 {
+		t.Errorf("dice left in the room in use == %v (%v); want 2", n, err)
+	}
+}
+
+func TestParseRoomTTL(t *testing.T) {
+	for _, tc := range []struct {
+		setting string
+		want    time.Duration
+		ok      bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"720h", 720 * time.Hour, true},
+		{"-1h", 0, false},
+		{"a month", 0, false},
+	} {
+		got, err := parseRoomTTL(tc.setting)
+		if got != tc.want || (err == nil) != tc.ok {
+			t.Errorf("parseRoomTTL(%q) == %v, %v; want %v", tc.setting, got, err, tc.want)
+		}
+	}
+}
+
+func TestSweepRoomsEndpoint(t *testing.T) {
+	defer withMemoryStore()()
+	defer os.Setenv("ROLLER_ADMIN_TOKEN", os.Getenv("ROLLER_ADMIN_TOKEN"))
+	os.Setenv("ROLLER_ADMIN_TOKEN", "sekrit")
+	roomTTL = 24 * time.Hour
+	defer func() { roomTTL = 0 }()
+	old := idleRoom(t, 1, "DustyOldRoom", time.Now().Add(-48*time.Hour).Unix(), 1)
+
+	for _, tc := range []struct {
+		method, auth string
+		code         int
+		gone         bool
+	}{
+		{"POST", "", http.StatusForbidden, false},
+		{"POST", "Bearer nope", http.StatusForbidden, false},
+		{"GET", "Bearer sekrit", http.StatusOK, false},
+		{"POST", "Bearer sekrit", http.StatusOK, true},
+	} {
+		req := httptest.NewRequest(tc.method, "/admin/sweep", strings.NewReader(""))
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		SweepRooms(w, req)
+		if w.Code != tc.code {
+			t.Errorf("%v with %q == %v; want %v", tc.method, tc.auth, w.Code, tc.code)
+		}
+		var r Room
+		gone := store.Get(context.Background(), old, &r) == datastore.ErrNoSuchEntity
+		if gone != tc.gone {
+			t.Errorf("after %v with %q room gone == %v; want %v", tc.method, tc.auth, gone, tc.gone)
+		}
+	}
+}
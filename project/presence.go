@@ -0,0 +1,223 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Presence tracks who is at a table. Every poll, socket and stream checks in with the
+// player's fingerprint; check-ins are kept under the room so all instances see them.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	// presenceWriteInterval limits how often one instance records that a player who
+	// keeps checking in is still there.
+	presenceWriteInterval = 30 * time.Second
+	// presenceConnected is how recently a player must have checked in to count as
+	// connected. Sockets check in every wsPingInterval.
+	presenceConnected = 75 * time.Second
+	// presenceTTL is how long players who left are still listed.
+	presenceTTL = time.Hour
+)
+
+// Player statuses.
+const (
+	playerConnected = "connected"
+	// playerIdle players had their page pause itself after a long quiet spell.
+	playerIdle = "idle"
+	// playerDropped players stopped checking in without pausing.
+	playerDropped = "dropped"
+)
+
+// Presence is a player's last check-in with a room, keyed by their fingerprint.
+type Presence struct {
+	Fingerprint string
+	LastSeen    int64
+	Paused      bool
+}
+
+// Player is how someone at the table is shown to everyone else.
+type Player struct {
+	// ID is the player's playerID, as in the Updater of their events.
+	ID string
+	// Label is short enough to show next to the table.
+	Label      string
+	Status     string
+	LastSeen   int64
+	SecondsAgo int64
+}
+
+type presenceWrite struct {
+	at     time.Time
+	paused bool
+}
+
+var (
+	presenceMu sync.Mutex
+	// presenceWrites has the last check-in this instance recorded for each room and player.
+	presenceWrites = map[string]presenceWrite{}
+)
+
+// notePresence records that player fp checked in with the room; paused says their
+// page has stopped updating. Players showing up, coming back or pausing are announced
+// with a presence event so everyone's list changes right away.
+func notePresence(c context.Context, roomKey *datastore.Key, fp string, paused bool, now time.Time) {
+	if fp == "" || roomKey == nil {
+		return
+	}
+	id := roomKey.Encode() + "|" + fp
+	presenceMu.Lock()
+	if last, ok := presenceWrites[id]; ok && last.paused == paused && now.Sub(last.at) < presenceWriteInterval {
+		presenceMu.Unlock()
+		return
+	}
+	presenceWrites[id] = presenceWrite{at: now, paused: paused}
+	presenceMu.Unlock()
+
+	k := datastore.NameKey("Presence", fp, roomKey)
+	announce := false
+	err := store.RunInTransaction(c, func(tx Transaction) error {
+		var old Presence
+		err := tx.Get(k, &old)
+		switch {
+		case err == datastore.ErrNoSuchEntity:
+			announce = true
+		case err != nil:
+			return err
+		default:
+			announce = old.Paused != paused || now.Unix()-old.LastSeen > int64(presenceConnected/time.Second)
+		}
+		_, err = tx.Put(k, &Presence{Fingerprint: fp, LastSeen: now.Unix(), Paused: paused})
+		return err
+	})
+	if err != nil {
+		log.Printf("could not record %v in room %v: %v", fp, roomKey.Encode(), err)
+		presenceMu.Lock()
+		delete(presenceWrites, id)
+		presenceMu.Unlock()
+		return
+	}
+	if announce {
+		// Presence isn't a change to the table, so it keeps the room's modifier.
+		latest, _, err := latestEvent(c, roomKey)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+		updateRoom(c, roomKey.Encode(), Update{Updater: fp, Timestamp: now.Unix(), UpdateAll: true, Type: eventPresence}, latest.Modifier)
+	}
+}
+
+// roomPlayers lists who has been at the table lately: connected players first, then
+// idle and dropped ones, most recently seen first. Players gone longer than
+// presenceTTL are forgotten.
+func roomPlayers(c context.Context, roomKey *datastore.Key, now time.Time) ([]Player, error) {
+	var seen []Presence
+	keys, err := store.GetAll(c, NewQuery("Presence").Ancestor(roomKey), &seen)
+	if err != nil {
+		return nil, err
+	}
+	players := []Player{}
+	stale := []*datastore.Key{}
+	for i, p := range seen {
+		ago := now.Unix() - p.LastSeen
+		if ago > int64(presenceTTL/time.Second) {
+			stale = append(stale, keys[i])
+			continue
+		}
+		pl := Player{ID: playerID(roomKey.Encode(), p.Fingerprint), Label: playerLabel(p.Fingerprint), LastSeen: p.LastSeen, SecondsAgo: ago}
+		switch {
+		case p.Paused:
+			pl.Status = playerIdle
+		case ago <= int64(presenceConnected/time.Second):
+			pl.Status = playerConnected
+		default:
+			pl.Status = playerDropped
+		}
+		players = append(players, pl)
+	}
+	if len(stale) > 0 {
+		if err := deleteInBatches(c, stale); err != nil {
+			log.Printf("could not forget players who left room %v: %v", roomKey.Encode(), err)
+		}
+	}
+	rank := map[string]int{playerConnected: 0, playerIdle: 1, playerDropped: 2}
+	sort.SliceStable(players, func(i, j int) bool {
+		if rank[players[i].Status] != rank[players[j].Status] {
+			return rank[players[i].Status] < rank[players[j].Status]
+		}
+		return players[i].LastSeen > players[j].LastSeen
+	})
+	return players, nil
+}
+
+// playerLabel shortens a fingerprint to something that fits next to the table.
+func playerLabel(fp string) string {
+	if len(fp) > 6 {
+		return fp[:6]
+	}
+	return fp
+}
+
+// everyoneUpdater is the updater given to changes every page should reload for,
+// whoever made them.
+const everyoneUpdater = "safari y u no work"
+
+// playerID is what other players see in place of fingerprint fp in room rk. A
+// fingerprint is all it takes to see someone's hidden dice, so it never leaves the
+// server; the ID is the same for one player throughout a room without giving it away.
+func playerID(rk, fp string) string {
+	if fp == "" || fp == everyoneUpdater {
+		return fp
+	}
+	sum := sha256.Sum256([]byte(rk + "|" + fp))
+	return hex.EncodeToString(sum[:8])
+}
+
+// onlyPresence says whether events are all presence events, which leave the table as
+// it was.
+func onlyPresence(events []Update) bool {
+	for _, u := range events {
+		if u.Type != eventPresence {
+			return false
+		}
+	}
+	return true
+}
+
+// addPlayers fills in out.Players when someone arrived, left or went idle.
+func addPlayers(c context.Context, roomKey *datastore.Key, out *refreshResponse) {
+	for _, u := range out.Events {
+		if u.Type != eventPresence {
+			continue
+		}
+		players, err := roomPlayers(c, roomKey, time.Now())
+		if err != nil {
+			log.Printf("could not see who is in %v: %v", roomKey.Encode(), err)
+			return
+		}
+		out.Players = players
+		return
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestRoomPlayers(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: "FullTable"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	notePresence(c, rk, "alice-fingerprint", false, now.Add(-10*time.Second))
+	notePresence(c, rk, "bob", false, now.Add(-2*time.Minute))
+	notePresence(c, rk, "carol", true, now.Add(-20*time.Minute))
+	notePresence(c, rk, "dave", false, now.Add(-2*time.Hour))
+
+	players, err := roomPlayers(c, rk, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, p := range players {
+		got = append(got, p.Label+":"+p.Status)
+	}
+	if want := "alice-:connected carol:idle bob:dropped"; strings.Join(got, " ") != want {
+		t.Errorf("roomPlayers() == %v; want %v", got, want)
+	}
+	var dave Presence
+	if err := store.Get(c, datastore.NameKey("Presence", "dave", rk), &dave); err != datastore.ErrNoSuchEntity {
+		t.Errorf("dave, gone for two hours, is still kept: %+v, %v", dave, err)
+	}
+}
+
+func TestPresenceAnnouncements(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: "FullTable"}); err != nil {
+		t.Fatal(err)
+	}
+	updateRoom(c, rk.Encode(), Update{Updater: "gm", Type: eventRoll}, 3)
+	start, _, err := latestEvent(c, rk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	notePresence(c, rk, "alice", false, now)
+	notePresence(c, rk, "alice", false, now.Add(time.Second))
+	notePresence(c, rk, "alice", false, now.Add(presenceWriteInterval+time.Second))
+	notePresence(c, rk, "alice", true, now.Add(presenceWriteInterval+2*time.Second))
+
+	events, err := eventsAfter(c, rk, start.Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("presence events == %+v; want one for arriving and one for pausing", events)
+	}
+	for _, u := range events {
+		if u.Type != eventPresence || u.Updater != "alice" || u.Modifier != 3 {
+			t.Errorf("presence event == %+v; want alice's, keeping the modifier", u)
+		}
+	}
+}
+
+func TestRefreshListsPlayers(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: "FullTable"}); err != nil {
+		t.Fatal(err)
+	}
+	notePresence(c, rk, "bob", false, time.Now())
+	start, _, err := latestEvent(c, rk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/refresh", strings.NewReader("id=FullTable&fp=alice&delta=true&seq="+strconv.FormatInt(start.Seq, 10)))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	Refresh(w, req)
+	var out refreshResponse
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Players) != 2 || out.Delta != nil {
+		t.Errorf("refresh as alice arrives == %+v; want bob and alice listed and no delta", out)
+	}
+
+	w = httptest.NewRecorder()
+	Paused(w, httptest.NewRequest("GET", "/paused?id=FullTable&fp=alice", nil))
+	players, err := roomPlayers(c, rk, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range players {
+		if p.ID == playerID(rk.Encode(), "alice") && p.Status != playerIdle {
+			t.Errorf("alice is %v after pausing; want idle", p.Status)
+		}
+	}
+}
+
+func TestPlayerID(t *testing.T) {
+	a, b := datastore.IDKey("Room", 1, nil).Encode(), datastore.IDKey("Room", 2, nil).Encode()
+	if id := playerID(a, "alice"); id == "alice" || id != playerID(a, "alice") || id == playerID(b, "alice") || id == playerID(a, "bob") {
+		t.Errorf("playerID(%q, alice) == %q; want a stable ID that differs by room and player", a, id)
+	}
+	for _, fp := range []string{"", everyoneUpdater} {
+		if id := playerID(a, fp); id != fp {
+			t.Errorf("playerID(%q, %q) == %q; want it kept", a, fp, id)
+		}
+	}
+}
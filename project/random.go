@@ -0,0 +1,157 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/big"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamclerk/deck"
+	"github.com/karlseguin/ccache"
+)
+
+// RandomSource produces the random numbers behind every roll, draw and shuffle.
+type RandomSource interface {
+	// Intn returns a uniformly chosen number in [0, n). It panics if n <= 0.
+	Intn(n int) int
+}
+
+// cryptoSource reads from crypto/rand, so results can't be predicted from earlier ones.
+type cryptoSource struct{}
+
+func (cryptoSource) Intn(n int) int {
+	if n <= 0 {
+		panic("invalid argument to Intn")
+	}
+	v, err := crand.Int(crand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		// crypto/rand only fails if the OS can't supply entropy, and then nothing is safe.
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return int(v.Int64())
+}
+
+// seededSource is a deterministic stream, mostly useful for tests and replaying a session.
+type seededSource struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newSeededSource(seed int64) *seededSource {
+	return &seededSource{r: rand.New(rand.NewSource(seed))}
+}
+
+func (s *seededSource) Intn(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.Intn(n)
+}
+
+// cryptoSeed draws a seed for a new stream from crypto/rand.
+func cryptoSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// roomSources hands each room its own stream, seeded from crypto/rand the first time
+// the room rolls on this instance.
+type roomSources struct {
+	mu    sync.Mutex
+	cache *ccache.Cache
+}
+
+func newRoomSources() *roomSources {
+	return &roomSources{cache: ccache.New(ccache.Configure())}
+}
+
+func (rs *roomSources) get(roomKey string) RandomSource {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if item := rs.cache.Get(roomKey); item != nil {
+		return item.Value().(RandomSource)
+	}
+	src := newSeededSource(cryptoSeed())
+	rs.cache.Set(roomKey, src, 5*time.Hour)
+	return src
+}
+
+// randomSourceFor returns the source used for everything random in the room with
+// the given encoded key. configureRandomness swaps it out at startup.
+var randomSourceFor = func(roomKey string) RandomSource {
+	return cryptoSource{}
+}
+
+// configureRandomness picks how randomness is produced from a ROLLER_RNG style setting:
+// "crypto" (the default), "room" for a separate stream per room, or "seeded:<n>" for a
+// single deterministic stream.
+func configureRandomness(mode string) error {
+	switch {
+	case mode == "" || mode == "crypto":
+		randomSourceFor = func(string) RandomSource { return cryptoSource{} }
+	case mode == "room":
+		sources := newRoomSources()
+		randomSourceFor = sources.get
+	case strings.HasPrefix(mode, "seeded:"):
+		seed, err := strconv.ParseInt(strings.TrimPrefix(mode, "seeded:"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad seed in %q: %v", mode, err)
+		}
+		log.Printf("using a seeded random source; rolls are predictable")
+		src := newSeededSource(seed)
+		randomSourceFor = func(string) RandomSource { return src }
+	default:
+		return fmt.Errorf("unknown random source %q", mode)
+	}
+	return nil
+}
+
+// perm returns a random permutation of [0, n) using src.
+func perm(src RandomSource, n int) []int {
+	out := make([]int, n)
+	for i := range out {
+		j := src.Intn(i + 1)
+		out[i] = out[j]
+		out[j] = i
+	}
+	return out
+}
+
+// shuffleDeck shuffles d in place using src instead of the deck package's global source.
+func shuffleDeck(src RandomSource, d *deck.Deck) {
+	for i := len(d.Cards) - 1; i > 0; i-- {
+		j := src.Intn(i + 1)
+		d.Cards[i], d.Cards[j] = d.Cards[j], d.Cards[i]
+	}
+}
+
+// roller adapts src to the roll function evaluateRollExpression expects.
+func roller(src RandomSource) func(string) (int, string) {
+	return func(kind string) (int, string) {
+		return getNewResult(src, kind)
+	}
+}
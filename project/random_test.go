@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/adamclerk/deck"
+)
+
+func TestSeededSourceIsDeterministic(t *testing.T) {
+	a, b := newSeededSource(42), newSeededSource(42)
+	for i := 0; i < 100; i++ {
+		if x, y := a.Intn(20), b.Intn(20); x != y {
+			t.Fatalf("roll %v: seeded sources disagree (%v != %v)", i, x, y)
+		}
+	}
+}
+
+func TestCryptoSourceRange(t *testing.T) {
+	seen := map[int]bool{}
+	for i := 0; i < 1000; i++ {
+		v := cryptoSource{}.Intn(6)
+		if v < 0 || v >= 6 {
+			t.Fatalf("cryptoSource{}.Intn(6) == %v; want [0, 6)", v)
+		}
+		seen[v] = true
+	}
+	if len(seen) != 6 {
+		t.Errorf("1000 rolls of cryptoSource{}.Intn(6) only produced %v distinct values", len(seen))
+	}
+}
+
+func TestPerm(t *testing.T) {
+	got := perm(newSeededSource(1), 52)
+	seen := map[int]bool{}
+	for _, v := range got {
+		if v < 0 || v >= 52 || seen[v] {
+			t.Fatalf("perm(_, 52) == %v; want a permutation of [0, 52)", got)
+		}
+		seen[v] = true
+	}
+}
+
+func TestShuffleDeck(t *testing.T) {
+	a, err := deck.New(deck.Unshuffled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := deck.New(deck.Unshuffled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shuffleDeck(newSeededSource(7), a)
+	shuffleDeck(newSeededSource(7), b)
+	if a.GetSignature() != b.GetSignature() {
+		t.Errorf("shuffling with the same seed gave %v and %v", a.GetSignature(), b.GetSignature())
+	}
+	if a.NumberOfCards() != 52 {
+		t.Errorf("shuffled deck has %v cards; want 52", a.NumberOfCards())
+	}
+}
+
+func TestCustomSetDrawUsesSource(t *testing.T) {
+	draw := func() map[string]string {
+		cs, err := newCustomSetFromNewlineSeparatedString("a\nb\nc\nd\ne\nf", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := cs.Draw(newSeededSource(3), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cs.Instance) != 4 {
+			t.Errorf("%v items left after drawing 2 of 6; want 4", len(cs.Instance))
+		}
+		return got
+	}
+	first, second := draw(), draw()
+	if len(first) != 2 {
+		t.Fatalf("Draw(_, 2) returned %v items; want 2", len(first))
+	}
+	for k, v := range first {
+		if second[k] != v {
+			t.Errorf("draws with the same seed differ: %v and %v", first, second)
+		}
+	}
+}
+
+func TestConfigureRandomness(t *testing.T) {
+	defer func() {
+		if err := configureRandomness(""); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	for _, mode := range []string{"", "crypto", "room", "seeded:12"} {
+		if err := configureRandomness(mode); err != nil {
+			t.Errorf("configureRandomness(%q) == %v; want nil", mode, err)
+		}
+	}
+	if err := configureRandomness("room"); err != nil {
+		t.Fatal(err)
+	}
+	if randomSourceFor("a") != randomSourceFor("a") || randomSourceFor("a") == randomSourceFor("b") {
+		t.Error("room mode should give each room a single stream of its own")
+	}
+	for _, mode := range []string{"dice", "seeded:x"} {
+		if err := configureRandomness(mode); err == nil {
+			t.Errorf("configureRandomness(%q) == nil; want an error", mode)
+		}
+	}
+}
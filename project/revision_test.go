@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestStaleRevisionConflicts(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: "BusyTable"}); err != nil {
+		t.Fatal(err)
+	}
+	k := datastore.IDKey("Die", 1, rk)
+	if _, err := store.Put(c, k, &Die{IsCard: true, Size: "card", ResultStr: "Q♥", KeyStr: k.Encode()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both players saw revision 0; the hide lands first.
+	d, err := hideDieHelper(c, rk, k.Encode(), "alice", 0)
+	if err != nil || d.Revision != 1 {
+		t.Fatalf("hideDieHelper() == %+v, %v; want revision 1", d, err)
+	}
+	_, err = updateDieLocation(c, rk, k.Encode(), "bob", 30, 40, 0)
+	conflict, ok := err.(*revisionConflict)
+	if !ok {
+		t.Fatalf("updateDieLocation() with a stale revision == %v; want a revisionConflict", err)
+	}
+	if conflict.Current.Revision != 1 || !conflict.Current.IsHidden {
+		t.Errorf("conflict has %+v; want the hidden card at revision 1", conflict.Current)
+	}
+	var stored Die
+	if err := store.Get(c, k, &stored); err != nil || !stored.IsHidden || stored.X != 0 {
+		t.Errorf("stored die == %+v, %v; want the hide kept and the move dropped", stored, err)
+	}
+
+	// Clients that don't send a revision still win as before.
+	if d, err := updateDieLocation(c, rk, k.Encode(), "bob", 30, 40, anyRevision); err != nil || d.Revision != 2 || !d.IsHidden {
+		t.Errorf("updateDieLocation() without a revision == %+v, %v; want the move at revision 2 with the card still hidden", d, err)
+	}
+}
+
+func TestMoveConflictResponse(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: "BusyTable"}); err != nil {
+		t.Fatal(err)
+	}
+	k := datastore.IDKey("Die", 1, rk)
+	if _, err := store.Put(c, k, &Die{IsCard: true, Size: "card", ResultStr: "Q♥", IsHidden: true, HiddenBy: "alice", Revision: 3, KeyStr: k.Encode()}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		rev  string
+		code int
+		want int64
+	}{
+		{"2", http.StatusConflict, 3},
+		{"3", http.StatusOK, 4},
+	} {
+		body := "room=BusyTable&id=" + k.Encode() + "&x=1&y=2&fp=bob&rev=" + tc.rev
+		req := httptest.NewRequest("POST", "/move", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		Move(w, req)
+		if w.Code != tc.code {
+			t.Errorf("Move() at revision %v == %v; want %v", tc.rev, w.Code, tc.code)
+		}
+		var d Die
+		if err := json.NewDecoder(w.Body).Decode(&d); err != nil {
+			t.Fatal(err)
+		}
+		if d.Revision != tc.want || d.ResultStr != "" {
+			t.Errorf("Move() at revision %v sent %+v; want revision %v with alice's card face down", tc.rev, d, tc.want)
+		}
+	}
+}
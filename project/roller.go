@@ -19,23 +19,22 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
 
 	"cloud.google.com/go/datastore"
-	"cloud.google.com/go/pubsub"
 	"github.com/adamclerk/deck"
 	"github.com/beevik/etree"
 	"github.com/dustinkirkland/golang-petname"
@@ -46,14 +45,12 @@ import (
 
 // If you have forked this and are running it yourself you might need to change this.
 const bucket = "dice-roller-174222.appspot.com"
-const pubsubTopicName = "room-updates"
 
 var (
 	// As we create urls for the die images, store them here so we don't keep making them
-	diceURLs     = map[string]string{}
-	refreshDelta = int64(2)
-	lastRoll     = map[string]int{}
-	lastAction   = map[string]string{}
+	diceURLs   = map[string]string{}
+	lastRoll   = map[string]int{}
+	lastAction = map[string]string{}
 	// Keep track of attempts to hit non-existent rooms and only create a new room once
 	repeatOffenders = map[string]bool{}
 	cardToPNG       = map[string]string{
@@ -64,28 +61,50 @@ var (
 	faceMap      = map[string]int{"A": 0, "2": 1, "3": 2, "4": 3, "5": 4, "6": 5, "7": 6, "8": 7, "9": 8, "T": 9, "J": 10, "Q": 11, "K": 12}
 	suitMap      = map[string]int{"♣": 0, "♦": 1, "♥": 2, "♠": 3}
 	previousSVGs = map[string][]byte{}
-	dsClient     *datastore.Client
 	updateCache  *ccache.Cache
 	//	roomCache    *ccache.Cache
-	pubsubTopic        *pubsub.Topic
-	pubsubSubscription *pubsub.Subscription
+	// roomTTL is how long a room can sit unused before it is swept; zero keeps rooms forever.
+	roomTTL time.Duration
 )
 
+// Update is an event in a room, stored as a child of the room keyed by Seq (see events.go).
 type Update struct {
+	Seq       int64
 	Timestamp int64
 	Updater   string
 	UpdateAll bool
 	Message   string
+	// Type says what happened (see the event types in events.go), and DieKey which die
+	// it happened to, when it was just one. DieKeys has the dice a roll or draw added,
+	// or a clear removed.
+	Type    string
+	DieKey  string
+	DieKeys []string `datastore:",noindex"`
+	// Modifier is the room's roll modifier as of this event.
+	Modifier int `datastore:",noindex"`
+	// ExpireAt is when the event can be pruned, in Unix seconds.
+	ExpireAt int64
 }
 
 type Room struct {
-	Updates    []byte // hooray having to use json
+	Updates    []byte // Deprecated: events are Update entities now; kept so older rooms still load.
 	Timestamp  int64
 	Slug       string
 	Deck       string
 	BgURL      string
 	CustomSets []byte // yup, having to use json again...
 	Modifier   int
+	// FairSeedHash commits a provably fair session to FairSeed, which stays secret until
+	// FairRevealed. FairNonce counts the draws taken from it; RevealedSeeds holds the hex
+	// encoded seeds of earlier sessions.
+	FairSeedHash  string
+	FairSeed      []byte `datastore:",noindex"`
+	FairRevealed  bool
+	FairNonce     int64
+	RevealedSeeds []string `datastore:",noindex"`
+	// OwnerHash is the hex SHA-256 of the token that lets its holder manage the room's
+	// webhooks. Rooms made from the page have none.
+	OwnerHash string `datastore:",noindex"`
 }
 
 func (r *Room) GetCustomSets() (CustomSets, error) {
@@ -119,7 +138,7 @@ type CustomSet struct {
 	MaxWidth  string
 }
 
-func (cs *CustomSet) Draw(c int) (map[string]string, error) {
+func (cs *CustomSet) Draw(src RandomSource, c int) (map[string]string, error) {
 	left := len(cs.Instance)
 	out := map[string]string{}
 	if left == 0 {
@@ -133,9 +152,10 @@ func (cs *CustomSet) Draw(c int) (map[string]string, error) {
 	for k := range cs.Instance {
 		keys = append(keys, k)
 	}
+	// Map order is random on its own; sort so the draw only depends on src.
+	sort.Strings(keys)
 	dest := make([]string, len(keys))
-	perm := rand.Perm(len(keys))
-	for i, v := range perm {
+	for i, v := range perm(src, len(keys)) {
 		dest[v] = keys[i]
 	}
 	for i := 0; i < c; i++ {
@@ -200,6 +220,25 @@ func newCustomSetFromNewlineSeparatedString(u, height, width string) (CustomSet,
 	return cs, nil
 }
 
+// svgColors are the colors dice come in, as the fill each puts in a die's SVG.
+var svgColors = map[string]string{
+	"clear":     "rgb(228, 242, 247)", // #e4f2f7
+	"green":     "rgb(131, 245, 108)", // #83f56c
+	"red":       "rgb(228, 79, 79)",   // #e44f4f
+	"blue":      "rgb(88, 181, 243)",  // #58b5f3
+	"orange":    "rgb(255, 158, 12)",  // #ff9e0c
+	"purple":    "rgb(142, 119, 218)", // #8e77da
+	"violet":    "rgb(142, 119, 218)", // #8e77da
+	"pink":      "rgb(255, 105, 180)", //#ff69b4
+	"magenta":   "rgb(255, 0, 255)",   // #ff00ff
+	"turquoise": "rgb(64, 224, 208)",  // #40e0d0
+	"silver":    "rgb(192, 192, 192)", // #c0c0c0
+	"lavender":  "rgb(230, 230, 250)", // #e6e6fa
+	"khaki":     "rgb(240, 230, 140)", // #f0e68c
+	"gold":      "rgb(254, 248, 78)",  // #fef84e
+	"white":     "rgb(255, 255, 255)",
+}
+
 func createSVG(die, result, color string) ([]byte, error) {
 	key := fmt.Sprintf("%s-%s-%s", die, result, color)
 	if found, ok := previousSVGs[key]; ok {
@@ -231,26 +270,9 @@ func createSVG(die, result, color string) ([]byte, error) {
 		log.Printf("issue reading svg: %v", err)
 		return nil, err
 	}
-	colors := map[string]string{
-		"clear":     "rgb(228, 242, 247)", // #e4f2f7
-		"green":     "rgb(131, 245, 108)", // #83f56c
-		"red":       "rgb(228, 79, 79)",   // #e44f4f
-		"blue":      "rgb(88, 181, 243)",  // #58b5f3
-		"orange":    "rgb(255, 158, 12)",  // #ff9e0c
-		"purple":    "rgb(142, 119, 218)", // #8e77da
-		"violet":    "rgb(142, 119, 218)", // #8e77da
-		"pink":      "rgb(255, 105, 180)", //#ff69b4
-		"magenta":   "rgb(255, 0, 255)",   // #ff00ff
-		"turquoise": "rgb(64, 224, 208)",  // #40e0d0
-		"silver":    "rgb(192, 192, 192)", // #c0c0c0
-		"lavender":  "rgb(230, 230, 250)", // #e6e6fa
-		"khaki":     "rgb(240, 230, 140)", // #f0e68c
-		"gold":      "rgb(254, 248, 78)",  // #fef84e
-		"white":     "rgb(255, 255, 255)",
-	}
-	clr, ok := colors[color]
+	clr, ok := svgColors[color]
 	if !ok {
-		clr = colors["clear"]
+		clr = svgColors["clear"]
 	}
 	doc := etree.NewDocument()
 	if err := doc.ReadFromBytes(slurp); err != nil {
@@ -333,6 +355,45 @@ type Die struct {
 	SVG           template.HTML `datastore:",noindex"`
 	IsToken       bool
 	SVGBytes      []byte `datastore:",noindex"`
+	// Expression and ExpressionTotal are set on every die rolled from the same xdy expression.
+	Expression      string
+	ExpressionTotal int
+	// IsDropped marks dice thrown away by a keep or drop suffix; they don't count toward totals.
+	IsDropped bool
+	// Dice in an exploding chain carry the rule that made them and the KeyStr of the die they exploded from.
+	ExplodeRule  string
+	ExplodedFrom string
+	IsPenetrated bool
+	// Dice in a success pool carry its target and whether they hit it or counted as a failure.
+	SuccessRule string
+	IsSuccess   bool
+	IsFailure   bool
+	// History keeps results that were rerolled away, oldest first; RerollRule is any r/ro suffix it was rolled with.
+	History    []int
+	RerollRule string
+	// Dice rolled in a provably fair session record the seed commitment and nonce behind Result.
+	Nonce    int64
+	SeedHash string
+	// Revision goes up every time the die is changed, so clients can say which version
+	// they acted on; see checkRevision.
+	Revision int64
+}
+
+// PreviousResults lists the results this die had before it was rerolled.
+func (d Die) PreviousResults() string {
+	out := []string{}
+	for _, h := range d.History {
+		out = append(out, strconv.Itoa(h))
+	}
+	return strings.Join(out, ", ")
+}
+
+// value is what the die adds to a total; penetrating dice count one less than they show.
+func (d *Die) value() int {
+	if d.IsPenetrated {
+		return d.Result - 1
+	}
+	return d.Result
 }
 
 func (d *Die) updatePosition(x, y float64) {
@@ -345,7 +406,76 @@ func (d *Die) getPosition() (float64, float64) {
 	return d.X, d.Y
 }
 
+// anyRevision is what clients that don't track revisions act on.
+const anyRevision = -1
+
+// revisionConflict is returned when a client acted on a die that has changed since it
+// last saw it. Current is the die as it is now.
+type revisionConflict struct {
+	Current Die
+}
+
+func (e *revisionConflict) Error() string {
+	return fmt.Sprintf("die %v is at revision %v", e.Current.KeyStr, e.Current.Revision)
+}
+
+// refusal is returned when a player asks for something the table doesn't allow, as
+// opposed to something going wrong. Code is the HTTP status that best describes why.
+type refusal struct {
+	Code int
+	Msg  string
+}
+
+func (e *refusal) Error() string {
+	return e.Msg
+}
+
+func refuse(code int, format string, args ...interface{}) error {
+	return &refusal{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// checkRevision makes sure d is still at the revision the client saw.
+func (d *Die) checkRevision(rev int64) error {
+	if rev != anyRevision && rev != d.Revision {
+		return &revisionConflict{Current: *d}
+	}
+	return nil
+}
+
+// seenBy is d as the player with fingerprint fp may see it, without the SVG the page
+// already has a copy of.
+func (d Die) seenBy(fp string) Die {
+	if d.IsHidden && d.HiddenBy != fp {
+		d.Result = 0
+		d.ResultStr = ""
+		d.History = nil
+		d.Image = ""
+		if d.IsCard {
+			d.Image = fmt.Sprintf("https://storage.googleapis.com/%v/playing_cards/back.png", bucket)
+		}
+	}
+	d.SVG = ""
+	d.SVGBytes = nil
+	return d
+}
+
+// shownTo is how d appears on player fp's table, if at all. Cards hidden by someone
+// else show their back and nothing of their face; other hidden things aren't shown.
+func (d Die) shownTo(fp string) (Die, bool) {
+	if d.HiddenBy == fp || !d.IsHidden {
+		return d, true
+	}
+	if d.IsCard {
+		d = d.seenBy(fp)
+		d.IsHidden = false
+		return d, true
+	}
+	return d, false
+}
+
 type Passer struct {
+	// Room is the room's slug, which the page sends with every action.
+	Room                string
 	Dice                []Die
 	RoomTotal           int
 	RoomAvg             float64
@@ -360,6 +490,15 @@ type Passer struct {
 	ModifiedRollTotal   int
 	TokenCount          int
 	LastChangeTimestamp string
+	Expression          string
+	Successes           int
+	IsPool              bool
+	FairSeedHash        string
+	IsFair              bool
+	// Seq is the room's newest event when the page was rendered; polling picks up from there.
+	Seq int64
+	// Players is who has been at the table lately.
+	Players []Player
 }
 
 func noSpaces(str string) string {
@@ -380,8 +519,8 @@ func generateRoomName(wc int) string {
 }
 
 func getEncodedRoomKeyFromName(c context.Context, name string) (string, error) {
-	q := datastore.NewQuery("Room").Filter("Slug =", name).Limit(1).KeysOnly()
-	k, err := dsClient.GetAll(c, q, nil)
+	q := NewQuery("Room").Filter("Slug =", name).Limit(1).KeysOnly()
+	k, err := store.GetAll(c, q, nil)
 	if err != nil {
 		return name, fmt.Errorf("problem executing room (by Slug) query: %v", err)
 	}
@@ -391,83 +530,112 @@ func getEncodedRoomKeyFromName(c context.Context, name string) (string, error) {
 	return name, fmt.Errorf("couldn't find a room key for %v", name)
 }
 
+// roomRef is a room by name, along with its key.
+type roomRef struct {
+	Slug   string
+	Key    *datastore.Key
+	KeyStr string
+}
+
+// findRoom looks up the room called slug.
+func findRoom(c context.Context, slug string) (roomRef, error) {
+	keyStr, err := getEncodedRoomKeyFromName(c, slug)
+	if err != nil {
+		return roomRef{}, err
+	}
+	k, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		return roomRef{}, fmt.Errorf("could not decode room key %v: %v", keyStr, err)
+	}
+	return roomRef{Slug: slug, Key: k, KeyStr: keyStr}, nil
+}
+
+// postedRoom is the room a post from the room page acts on, as named by its "room"
+// value. Rooms aren't taken from the Referer: strict referrer policies strip it, and it
+// would let any page that posts to an action aim it at the room its visitor came from.
+// If there is no such room the request is answered and ok is false.
+func postedRoom(w http.ResponseWriter, r *http.Request) (ref roomRef, ok bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "actions must be POSTed", http.StatusMethodNotAllowed)
+		return ref, false
+	}
+	_ = r.ParseForm()
+	slug := r.Form.Get("room")
+	if slug == "" {
+		http.Error(w, "no room given", http.StatusBadRequest)
+		return ref, false
+	}
+	ref, err := findRoom(r.Context(), slug)
+	if err != nil {
+		log.Printf("no room for %v: %v", r.URL.Path, err)
+		http.NotFound(w, r)
+		return ref, false
+	}
+	return ref, true
+}
+
+// dieKeyIn decodes the key of a die in the room with key roomKey. Dice in other rooms
+// are refused, so a die key from one room can't be used through another.
+func dieKeyIn(roomKey *datastore.Key, encodedDieKey string) (*datastore.Key, error) {
+	k, err := datastore.DecodeKey(encodedDieKey)
+	if err != nil {
+		return nil, refuse(http.StatusBadRequest, "could not decode die key %v: %v", encodedDieKey, err)
+	}
+	if k.Kind != "Die" || !k.Parent.Equal(roomKey) {
+		return nil, refuse(http.StatusNotFound, "die %v is not in room %v", encodedDieKey, roomKey.Encode())
+	}
+	return k, nil
+}
+
+// updateRoom records an event in the room so everyone else in it knows to refresh.
 func updateRoom(c context.Context, rk string, u Update, modifier int) {
 	roomKey, err := datastore.DecodeKey(rk)
 	if err != nil {
 		log.Printf("updateRoom: could not decode room key %v: %v", rk, err)
 		return
 	}
-	var r Room
-	t := time.Now().Unix()
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
-		err = tx.Get(roomKey, &r)
-		if err == datastore.ErrNoSuchEntity {
-			// Couldn't find it, so create it
-			log.Printf("couldn't find room %v, so going to create it", rk)
-			up, err := json.Marshal([]Update{})
-			if err != nil {
-				return fmt.Errorf("could not marshal update: %v", err)
-			}
-
-			deck.Seed()
-			d, err := deck.New(deck.Unshuffled)
-			if err != nil {
-				log.Printf("could not create deck: %v", err)
-			} else {
-				d.Shuffle()
-			}
-			r = Room{Updates: up, Timestamp: t, Slug: generateRoomName(3), Deck: d.GetSignature()}
-			_, err = tx.Put(roomKey, &r)
-			if err != nil {
-				return fmt.Errorf("could not create updated room %v: %v", rk, err)
-			}
-		}
-		if err != nil {
-			return fmt.Errorf("issue updating room: %v", err)
-		}
-		var umUpdates []Update
-		err = json.Unmarshal(r.Updates, &umUpdates)
-		if err != nil {
-			return fmt.Errorf("could not unmarshal updates in updateRoom: %v", err)
-		}
-		umUpdates = append(umUpdates, u)
-		r.Updates, err = json.Marshal(umUpdates)
-		if err != nil {
-			return fmt.Errorf("could not marshal updates in updateRoom: %v", err)
-		}
-		r.Timestamp = t
-		r.Modifier = modifier
-		_, err = tx.Put(roomKey, &r)
-		if err != nil {
-			return fmt.Errorf("could not update room %v: %v", rk, err)
-		}
-		return nil
-	})
+	u.Modifier = modifier
+	if err := touchRoom(c, roomKey, time.Now().Unix()); err != nil {
+		log.Printf("issue updating room: %v", err)
+	}
+	u, err = appendEvent(c, roomKey, u)
 	if err != nil {
 		log.Printf("issue updating room: %v", err)
 		return
 	}
-	// Publish to the pubsub topic the room and the timestamp
-	if pubsubTopic != nil {
-		pubsubTopic.Publish(c, &pubsub.Message{Data: []byte(rk + "|" + strconv.Itoa(int(t)))})
-	} else {
-		log.Printf("PUBSUB TOPIC IS NIL!!")
+	noteLatestSeq(rk, u.Seq)
+	roomEvents.caughtUp(c, rk, u.Seq)
+	maybePruneEvents(c, roomKey)
+	// Let other instances know, so their caches and feeds catch up.
+	if broker != nil {
+		if err := broker.Publish(c, RoomChange{Room: rk, Seq: u.Seq, Type: u.Type}); err != nil {
+			log.Printf("could not publish change to %v: %v", rk, err)
+		}
+	}
+	notifyWebhooks(c, roomKey, u)
+}
+
+// noteLatestSeq remembers the newest event sequence number seen for a room, so polls
+// with nothing new to see can skip the store.
+func noteLatestSeq(rk string, seq int64) {
+	if got := updateCache.Get(rk); got != nil && got.Value().(int64) >= seq {
+		return
 	}
+	updateCache.Set(rk, seq, 5*time.Hour)
 }
 
-func setBackground(c context.Context, rk, url string) {
+func setBackground(c context.Context, rk, url string) error {
 	keyStr, err := getEncodedRoomKeyFromName(c, rk)
 	if err != nil {
-		log.Printf("roomname wonkiness in setBackground: %v", err)
-		return
+		return fmt.Errorf("roomname wonkiness in setBackground: %v", err)
 	}
 	roomKey, err := datastore.DecodeKey(keyStr)
 	if err != nil {
-		log.Printf("setBackground: could not decode room key %v: %v", rk, err)
-		return
+		return fmt.Errorf("setBackground: could not decode room key %v: %v", rk, err)
 	}
 	var r Room
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
+	err = store.RunInTransaction(c, func(tx Transaction) error {
 		if err = tx.Get(roomKey, &r); err != nil {
 			return fmt.Errorf("could not find room %v for setting background: %v", rk, err)
 		}
@@ -487,24 +655,23 @@ func setBackground(c context.Context, rk, url string) {
 		return nil
 	})
 	if err != nil {
-		log.Printf("%v", err)
+		return err
 	}
-	updateRoom(c, roomKey.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
+	updateRoom(c, roomKey.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventBackground}, 0)
+	return nil
 }
 
-func addCustomSet(c context.Context, rk, name, lines, height, width string) {
+func addCustomSet(c context.Context, rk, name, lines, height, width string) error {
 	keyStr, err := getEncodedRoomKeyFromName(c, rk)
 	if err != nil {
-		log.Printf("roomname wonkiness in addCustomSet: %v", err)
-		return
+		return fmt.Errorf("roomname wonkiness in addCustomSet: %v", err)
 	}
 	roomKey, err := datastore.DecodeKey(keyStr)
 	if err != nil {
-		log.Printf("addCustomSet: could not decode room key %v: %v", rk, err)
-		return
+		return fmt.Errorf("addCustomSet: could not decode room key %v: %v", rk, err)
 	}
 	var r Room
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
+	err = store.RunInTransaction(c, func(tx Transaction) error {
 		if err = tx.Get(roomKey, &r); err != nil {
 			return fmt.Errorf("could not find room %v for adding custom set: %v", rk, err)
 		}
@@ -533,22 +700,24 @@ func addCustomSet(c context.Context, rk, name, lines, height, width string) {
 		}
 		return nil
 	})
-	updateRoom(c, roomKey.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
+	if err != nil {
+		return err
+	}
+	updateRoom(c, roomKey.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventCustomSet}, 0)
+	return nil
 }
 
-func removeCustomSet(c context.Context, rk, name string) {
+func removeCustomSet(c context.Context, rk, name string) error {
 	keyStr, err := getEncodedRoomKeyFromName(c, rk)
 	if err != nil {
-		log.Printf("roomname wonkiness in addCustomSet: %v", err)
-		return
+		return fmt.Errorf("roomname wonkiness in removeCustomSet: %v", err)
 	}
 	roomKey, err := datastore.DecodeKey(keyStr)
 	if err != nil {
-		log.Printf("addCustomSet: could not decode room key %v: %v", rk, err)
-		return
+		return fmt.Errorf("removeCustomSet: could not decode room key %v: %v", rk, err)
 	}
 	var r Room
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
+	err = store.RunInTransaction(c, func(tx Transaction) error {
 		if err = tx.Get(roomKey, &r); err != nil {
 			return fmt.Errorf("could not find room %v for removing custom set: %v", rk, err)
 		}
@@ -572,90 +741,46 @@ func removeCustomSet(c context.Context, rk, name string) {
 		}
 		return nil
 	})
-	updateRoom(c, roomKey.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
+	if err != nil {
+		return err
+	}
+	updateRoom(c, roomKey.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventCustomSet}, 0)
+	return nil
 }
 
-func refreshRoom(c context.Context, rk, fp, ts string) string {
-	// TODO(shanel): For the stuff below - it should  instead store the Passer object in a second cache
-	var clientLastUpdate, serverLastUpdate int64
-	if ts != "" {
-		lu, err := strconv.Atoi(ts)
-		if err == nil {
-			clientLastUpdate = int64(lu)
-		}
-	}
-	cacheItem := updateCache.Get(rk)
-	if cacheItem != nil {
-		serverLastUpdate = cacheItem.Value().(int64)
-	}
-	if clientLastUpdate > serverLastUpdate {
-		return ""
-	}
+// refreshResponse is what /refresh sends back: the room's newest sequence number and
+// the events after the one the client asked about that it should act on.
+type refreshResponse struct {
+	Seq    int64
+	Events []Update
+	// Delta is how the table changed with Events, for clients that asked for it.
+	Delta *roomDelta `json:",omitempty"`
+	// Players is who is at the table, sent when someone arrived, left or went idle.
+	Players []Player `json:",omitempty"`
+}
 
+func refreshRoom(c context.Context, rk, fp string, seq int64) refreshResponse {
+	out := refreshResponse{Seq: seq, Events: []Update{}}
+	if cacheItem := updateCache.Get(rk); cacheItem != nil && seq >= cacheItem.Value().(int64) {
+		return out
+	}
 	roomKey, err := datastore.DecodeKey(rk)
-	out := ""
 	if err != nil {
 		log.Printf("refreshRoom: could not decode room key %v: %v", rk, err)
 		return out
 	}
-	var r Room
-	var send []Update
-	now := time.Now().Unix()
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
-		if err = tx.Get(roomKey, &r); err != nil {
-			return fmt.Errorf("could not find room %v for refresh: %v", rk, err)
-		}
-		keep := []Update{}
-		var umUpdates []Update
-		err = json.Unmarshal(r.Updates, &umUpdates)
-		if err != nil {
-			return fmt.Errorf("could not unmarshal updates in refreshRoom: %v", err)
-		}
-		for _, u := range umUpdates {
-			q := now - u.Timestamp
-			if q > refreshDelta {
-				continue
-			}
-			keep = append(keep, u)
-			if u.Updater != fp || u.UpdateAll {
-				send = append(send, u)
-			}
-		}
-		// Don't perform another insert if nothing has changed.
-		if len(keep) == 0 {
-			return nil
-		}
-		r.Updates, err = json.Marshal(keep)
-		if err != nil {
-			out = ""
-			return fmt.Errorf("could not marshal updates in refreshRoom: %v", err)
-		}
-		_, err = tx.Put(roomKey, &r)
-		if err != nil {
-			return fmt.Errorf("could not create updated room %v: %v", rk, err)
-		}
-		return nil
-	})
+	events, err := eventsAfter(c, roomKey, seq)
 	if err != nil {
 		log.Printf("%v", err)
 		return out
 	}
-	if len(send) > 0 {
-		toHash, err := json.Marshal(send)
-		if err != nil {
-			log.Printf("could not marshal updates to send in refreshRoom: %v", err)
-			return ""
-		}
-		for _, u := range send {
-			if u.Message != "" {
-				out = fmt.Sprintf("%x||%s", md5.Sum(toHash), u.Message)
-				break
-			}
-		}
-		if out == "" {
-			out = fmt.Sprintf("%x", md5.Sum(toHash))
+	for _, u := range events {
+		out.Seq = u.Seq
+		if u.visibleTo(fp) {
+			out.Events = append(out.Events, u.forPlayers(rk))
 		}
 	}
+	noteLatestSeq(rk, out.Seq)
 	return out
 }
 
@@ -669,20 +794,25 @@ func dieKey(roomKey *datastore.Key, i int64) *datastore.Key {
 	return datastore.IDKey("Die", time.Now().UnixNano()+i, roomKey)
 }
 
-func newRoom(c context.Context) (string, error) {
-	up, err := json.Marshal([]Update{})
-	if err != nil {
-		return "", fmt.Errorf("could not marshal update: %v", err)
-	}
-	roomName := generateRoomName(3)
-	deck.Seed()
+// newRoomEntity builds a fresh room with a shuffled deck.
+func newRoomEntity(rk *datastore.Key, slug string) Room {
+	r := Room{Timestamp: time.Now().Unix(), Slug: slug}
 	d, err := deck.New(deck.Unshuffled)
 	if err != nil {
 		log.Printf("could not create deck: %v", err)
+		return r
 	}
-	d.Shuffle()
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
-		_, err = tx.Put(roomKey(), &Room{Updates: up, Timestamp: time.Now().Unix(), Slug: roomName, Deck: d.GetSignature()})
+	shuffleDeck(randomSourceFor(rk.Encode()), d)
+	r.Deck = d.GetSignature()
+	return r
+}
+
+func newRoom(c context.Context) (string, error) {
+	roomName := generateRoomName(3)
+	rk := roomKey()
+	r := newRoomEntity(rk, roomName)
+	err := store.RunInTransaction(c, func(tx Transaction) error {
+		_, err := tx.Put(rk, &r)
 		if err != nil {
 			return fmt.Errorf("could not create new room: %v", err)
 		}
@@ -698,22 +828,24 @@ func drawCards(c context.Context, count int, roomKey *datastore.Key, deckName, h
 	dice := []*Die{}
 	keys := []*datastore.Key{}
 	var room Room
-	_, err := dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
+	err := store.RunInTransaction(c, func(tx Transaction) error {
+		dice, keys = []*Die{}, []*datastore.Key{}
 		if err := tx.Get(roomKey, &room); err != nil {
 			return fmt.Errorf("issue getting room in drawCards: %v", err)
 		}
+		// Draws take fair nonces too, but only dice record theirs.
+		src := roomRandomness(&room, roomKey)
 		ts := time.Now().Unix()
 		if deckName == "" {
 			hand, err := deck.New(deck.Empty)
 			if err != nil {
 				return fmt.Errorf("problem creating hand: %v", err)
 			}
-			deck.Seed()
 			roomDeck, err := deck.New(deck.FromSignature(room.Deck))
 			if err != nil {
 				return fmt.Errorf("problem with deck signature: %v", err)
 			}
-			roomDeck.Shuffle()
+			shuffleDeck(src, roomDeck)
 			deckSize := roomDeck.NumberOfCards()
 			// TODO(shanel): We *might* want to surface the need to shuffle the deck once there are no cards left.
 			if deckSize == 0 || room.Deck == "" {
@@ -775,7 +907,7 @@ func drawCards(c context.Context, count int, roomKey *datastore.Key, deckName, h
 			if !ok {
 				return fmt.Errorf("no custom set with name %v", deckName)
 			}
-			drawn, err := cs.Draw(count)
+			drawn, err := cs.Draw(src, count)
 			if err != nil {
 				log.Printf("problem with custom draw: %v", err)
 			}
@@ -814,7 +946,7 @@ func drawCards(c context.Context, count int, roomKey *datastore.Key, deckName, h
 			if err != nil {
 				return fmt.Errorf("issue setting custom sets in drawCards: %v", err)
 			}
-			_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
+			err = store.RunInTransaction(c, func(tx Transaction) error {
 				if _, err := tx.Put(roomKey, &room); err != nil {
 					return fmt.Errorf("issue updating room in drawCards: %v", err)
 				}
@@ -858,7 +990,66 @@ func isFunky(d string) bool {
 	return !ok && (d != "tokens")
 }
 
-func newRoll(c context.Context, sizes map[string]string, roomKey *datastore.Key, color, hidden, fp string) (int, error) {
+// newDie builds a freshly rolled die (or token) with its SVG, ready to be stored under dk.
+func newDie(dk *datastore.Key, size string, r int, rs, color string, ts int64) (*Die, error) {
+	var svg []byte
+	var err error
+	if !isFunky(size) {
+		if size == "tokens" {
+			svg, err = createSVG("token", rs, color)
+		} else {
+			svg, err = createSVG(fmt.Sprintf("d%s", size), rs, color)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("svg creating issue: %v", err)
+		}
+	}
+	d := Die{
+		Size:      size,
+		Result:    r,
+		ResultStr: rs,
+		Key:       dk,
+		KeyStr:    dk.Encode(),
+		Timestamp: ts,
+		New:       true,
+		Color:     color,
+		SVGBytes:  svg,
+	}
+	if color == "clear" {
+		d.Color = "lightblue"
+	}
+	if isFunky(size) {
+		d.ResultStr = fmt.Sprintf("%s (d%s)", d.ResultStr, size)
+		d.IsLabel = true
+		d.IsFunky = true
+	} else {
+		svgPath, err := getSVGPath(rs, size)
+		if err != nil {
+			return nil, fmt.Errorf("could not get SVGPath: %v", err)
+		}
+		d.SVGPath = svgPath
+		d.Version = 1
+	}
+	return &d, nil
+}
+
+// dieSizes are the dice the roll form has a box for; the form names them "d" + size.
+var dieSizes = []string{"3", "4", "5", "6", "6p", "7", "8", "10", "12", "14", "16", "20", "24", "30", "100", "F", "H"}
+
+// clockSizes are the clocks there are, by segment count; "ct" is the tug of war.
+var clockSizes = []string{"c4", "c6", "c8", "ct"}
+
+// clockSegments is how many results each clock has, counting the empty one.
+var clockSegments = map[string]int{
+	"c4": 5,
+	"c6": 7,
+	"c8": 9,
+	"ct": 7,
+}
+
+// newRoll rolls sizes into the room and returns the roll's total and the keys of the
+// dice it added.
+func newRoll(c context.Context, sizes map[string]string, roomKey *datastore.Key, color, hidden, fp string) (int, []string, error) {
 	dice := []*Die{}
 	keys := []*datastore.Key{}
 	var totalCount int
@@ -872,19 +1063,62 @@ func newRoll(c context.Context, sizes map[string]string, roomKey *datastore.Key,
 		"c8":    true,
 		"ct":    true,
 	}
-	for size, v := range sizes {
-		if _, ok := unusual[size]; !ok {
+	// Dice are rolled inside a transaction so a provably fair room never hands out a nonce twice.
+	err := store.RunInTransaction(c, func(tx Transaction) error {
+		dice, keys, totalCount, total = []*Die{}, []*datastore.Key{}, 0, 0
+		var room Room
+		if err := tx.Get(roomKey, &room); err != nil {
+			return fmt.Errorf("could not find room for roll: %v", err)
+		}
+		src := roomRandomness(&room, roomKey)
+		for size, v := range sizes {
+			if _, ok := unusual[size]; ok {
+				continue
+			}
 			if size == "xdy" {
-				chunks := strings.Split(v, "d")
-				if len(chunks) != 2 {
+				if strings.TrimSpace(v) == "" {
+					continue
+				}
+				base := drawCount(src)
+				res, err := evaluateRollExpression(v, roller(src))
+				if err != nil {
+					return err
+				}
+				totalCount += len(res.Dice)
+				if totalCount > 500 {
 					continue
 				}
-				size = chunks[1]
-				v = chunks[0]
+				expr := describeExpression(v)
+				created := make([]*Die, len(res.Dice))
+				for i, rd := range res.Dice {
+					dk := dieKey(roomKey, int64(len(dice)))
+					d, err := newDie(dk, rd.Size, rd.Result, rd.ResultStr, color, ts)
+					if err != nil {
+						log.Printf("could not create die for %v: %v", expr, err)
+						continue
+					}
+					d.Expression = expr
+					d.ExpressionTotal = res.Total
+					d.IsDropped = rd.Dropped
+					d.ExplodeRule = rd.Rule
+					d.IsPenetrated = rd.Penetrated
+					d.SuccessRule = rd.SuccessRule
+					d.IsSuccess = rd.Success
+					d.IsFailure = rd.Failure
+					d.History = rd.History
+					d.RerollRule = rd.RerollRule
+					stampNonce(src, d, base+rd.Draw)
+					if rd.Parent >= 0 && created[rd.Parent] != nil {
+						d.ExplodedFrom = created[rd.Parent].KeyStr
+					}
+					created[i] = d
+					dice = append(dice, d)
+					keys = append(keys, dk)
+				}
+				total += res.Total
+				continue
 			}
-			var count int
-			var err error
-			count, err = strconv.Atoi(v)
+			count, err := strconv.Atoi(v)
 			if err != nil {
 				continue
 			}
@@ -899,71 +1133,37 @@ func newRoll(c context.Context, sizes map[string]string, roomKey *datastore.Key,
 					r = 0
 					rs = "0"
 				} else {
-					r, rs = getNewResult(size)
+					r, rs = getNewResult(src, size)
 				}
 				if size != "F" && size != "H" {
 					total += r
 				}
-
-				// SVG here
-				var svg []byte
-				var err error
-				if !isFunky(size) {
-					if size == "tokens" {
-						svg, err = createSVG("token", rs, color)
-					} else {
-						svg, err = createSVG(fmt.Sprintf("d%s", size), rs, color)
-					}
-					if err != nil {
-						log.Printf("svg creating issue: %v", err)
-						continue
-					}
-				}
-
-				var diu string
 				dk := dieKey(roomKey, int64(i))
-				d := Die{
-					Size:      size,
-					Result:    r,
-					ResultStr: rs,
-					Key:       dk,
-					KeyStr:    dk.Encode(),
-					Timestamp: ts,
-					Image:     diu,
-					New:       true,
-					Color:     color,
-					SVGBytes:  svg,
-				}
-				if color == "clear" {
-					d.Color = "lightblue"
+				d, err := newDie(dk, size, r, rs, color, ts)
+				if err != nil {
+					log.Printf("%v", err)
+					continue
 				}
-				if isFunky(size) {
-					d.ResultStr = fmt.Sprintf("%s (d%s)", d.ResultStr, size)
-					d.IsLabel = true
-					d.IsFunky = true
-				} else {
-					svgPath, err := getSVGPath(rs, size)
-					if err != nil {
-						log.Printf("could not get SVGPath: %v", err)
-						continue
-					}
-					d.SVGPath = svgPath
-					d.Version = 1
+				if size != "tokens" {
+					stampNonce(src, d, -1)
 				}
-				dice = append(dice, &d)
+				dice = append(dice, d)
 				keys = append(keys, dk)
 			}
 		}
+		if room.isFair() {
+			if _, err := tx.Put(roomKey, &room); err != nil {
+				return fmt.Errorf("could not save fair nonce: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
 	}
 
 	// Do clocks
-	clocks := []string{
-		"c4",
-		"c6",
-		"c8",
-		"ct",
-	}
-	for _, size := range clocks {
+	for _, size := range clockSizes {
 		if sizes[size] != "" {
 			var p string
 			lk := dieKey(roomKey, int64(len(dice)))
@@ -1020,14 +1220,14 @@ func newRoll(c context.Context, sizes map[string]string, roomKey *datastore.Key,
 	for _, k := range keys {
 		keyStrings = append(keyStrings, k.Encode())
 	}
-	_, err := dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
+	err = store.RunInTransaction(c, func(tx Transaction) error {
 		_, err := tx.PutMulti(keys, dice)
 		if err != nil {
 			return fmt.Errorf("could not create new dice: %v", err)
 		}
 		return nil
 	})
-	return total, err
+	return total, keyStrings, err
 }
 
 func getRoomCards(c context.Context, encodedRoomKey string) ([]Die, error) {
@@ -1035,10 +1235,10 @@ func getRoomCards(c context.Context, encodedRoomKey string) ([]Die, error) {
 	if err != nil {
 		return nil, fmt.Errorf("getRoomCards: could not decode room key %v: %v", encodedRoomKey, err)
 	}
-	q := datastore.NewQuery("Die").Ancestor(k).Filter("Size =", "card") //.Limit(10)
+	q := NewQuery("Die").Ancestor(k).Filter("Size =", "card") //.Limit(10)
 	dice := []Die{}
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
-		if _, err = dsClient.GetAll(c, q, &dice); err != nil {
+	err = store.RunInTransaction(c, func(tx Transaction) error {
+		if _, err = store.GetAll(c, q, &dice); err != nil {
 			return fmt.Errorf("problem executing card query: %v", err)
 		}
 		return nil
@@ -1051,10 +1251,10 @@ func getRoomCustomCards(c context.Context, encodedRoomKey string) ([]Die, error)
 	if err != nil {
 		return nil, fmt.Errorf("getRoomCustomCards: could not decode room key %v: %v", encodedRoomKey, err)
 	}
-	q := datastore.NewQuery("Die").Ancestor(k).Filter("IsCustomItem =", true) //.Limit(10)
+	q := NewQuery("Die").Ancestor(k).Filter("IsCustomItem =", true) //.Limit(10)
 	dice := []Die{}
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
-		if _, err = dsClient.GetAll(c, q, &dice); err != nil {
+	err = store.RunInTransaction(c, func(tx Transaction) error {
+		if _, err = store.GetAll(c, q, &dice); err != nil {
 			return fmt.Errorf("problem executing custom card query: %v", err)
 		}
 		return nil
@@ -1067,20 +1267,20 @@ func getRoomDice(c context.Context, encodedRoomKey, order, sort string) ([]Die,
 	if err != nil {
 		return nil, fmt.Errorf("getRoomDice: could not decode room key %v: %v", encodedRoomKey, err)
 	}
-	var q *datastore.Query
+	var q *Query
 	var bSort bool
 	bSort, err = strconv.ParseBool(sort)
 	if err != nil {
 		bSort = true
 	}
 	if bSort {
-		q = datastore.NewQuery("Die").Ancestor(k).Order(order) //.Limit(10)
+		q = NewQuery("Die").Ancestor(k).Order(order) //.Limit(10)
 	} else {
-		q = datastore.NewQuery("Die").Ancestor(k)
+		q = NewQuery("Die").Ancestor(k)
 	}
 	dice := []Die{}
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
-		if _, err = dsClient.GetAll(c, q, &dice); err != nil {
+	err = store.RunInTransaction(c, func(tx Transaction) error {
+		if _, err = store.GetAll(c, q, &dice); err != nil {
 			return fmt.Errorf("problem executing dice query: %v", err)
 		}
 		return nil
@@ -1091,32 +1291,53 @@ func getRoomDice(c context.Context, encodedRoomKey, order, sort string) ([]Die,
 	return dice, err
 }
 
-// TODO(shanel): If more than 500 things are altered RPC will fail. Need to batch in that case.
-func clearRoomDice(c context.Context, encodedRoomKey string) error {
+// clearRoomDice deletes everything on the table maxBatch at a time, since Datastore
+// won't commit more than that at once. It returns how many things it removed. Each
+// batch gets its own clear event, which keeps events small however big the table is.
+// If a batch fails the rest stay on the table, and clearing again picks up from there.
+func clearRoomDice(c context.Context, encodedRoomKey string) (int, error) {
 	k, err := datastore.DecodeKey(encodedRoomKey)
 	if err != nil {
-		return fmt.Errorf("clearRoomDice: could not decode room key %v: %v", encodedRoomKey, err)
+		return 0, fmt.Errorf("clearRoomDice: could not decode room key %v: %v", encodedRoomKey, err)
 	}
-	q := datastore.NewQuery("Die").Ancestor(k).KeysOnly()
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
-		out := dsClient.Run(c, q)
-		nuke := []*datastore.Key{}
-		for {
-			d, err := out.Next(nil)
-			if err != nil {
-				break
+	q := NewQuery("Die").Ancestor(k).Limit(maxBatch).KeysOnly()
+	removed := 0
+	for {
+		var nuke []*datastore.Key
+		nuke, err = store.GetAll(c, q, nil)
+		if err != nil {
+			err = fmt.Errorf("problem finding room dice in room %v: %v", encodedRoomKey, err)
+			break
+		}
+		if len(nuke) == 0 {
+			if removed == 0 {
+				// The table was already clear, but whoever cleared it still expects to see that.
+				updateRoom(c, k.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventClear}, 0)
 			}
-			nuke = append(nuke, d)
+			break
 		}
-		err = tx.DeleteMulti(nuke)
+		err = store.RunInTransaction(c, func(tx Transaction) error {
+			return tx.DeleteMulti(nuke)
+		})
 		if err != nil {
-			return fmt.Errorf("problem deleting room dice from room %v: %v", encodedRoomKey, err)
+			err = fmt.Errorf("problem deleting room dice from room %v: %v", encodedRoomKey, err)
+			break
 		}
-		return nil
-	})
-	// Fake updater so Safari will work?
-	updateRoom(c, k.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
-	return err
+		removed += len(nuke)
+		gone := []string{}
+		for _, dk := range nuke {
+			gone = append(gone, dk.Encode())
+		}
+		// Fake updater so Safari will work?
+		updateRoom(c, k.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventClear, DieKeys: gone}, 0)
+		if len(nuke) < maxBatch {
+			break
+		}
+	}
+	if err != nil {
+		return removed, fmt.Errorf("cleared %v things before stopping: %v", removed, err)
+	}
+	return removed, nil
 }
 
 func getDieImageURL(size, result, color string) (string, error) {
@@ -1163,34 +1384,41 @@ func getSVGPath(result, size string) (string, error) {
 	return p, nil
 }
 
-func updateDieLocation(c context.Context, encodedDieKey, fp string, x, y float64) error {
-	k, err := datastore.DecodeKey(encodedDieKey)
+func updateDieLocation(c context.Context, roomKey *datastore.Key, encodedDieKey, fp string, x, y float64, rev int64) (Die, error) {
+	var d Die
+	k, err := dieKeyIn(roomKey, encodedDieKey)
 	if err != nil {
-		return fmt.Errorf("could not decode die key %v: %v", encodedDieKey, err)
+		return d, err
 	}
-	var d Die
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
+	err = store.RunInTransaction(c, func(tx Transaction) error {
 		if err = tx.Get(k, &d); err != nil {
 			return fmt.Errorf("could not find die with key %v: %v", encodedDieKey, err)
 		}
+		if err := d.checkRevision(rev); err != nil {
+			return err
+		}
 		d.updatePosition(x, y)
+		d.Revision++
 		_, err = tx.Put(k, &d)
 		if err != nil {
 			return fmt.Errorf("could not update die %v with new position: %v", encodedDieKey, err)
 		}
 		return nil
 	})
-	updateRoom(c, k.Parent.Encode(), Update{Updater: fp, Timestamp: time.Now().Unix()}, 0)
-	return err
+	if err != nil {
+		return d, err
+	}
+	updateRoom(c, k.Parent.Encode(), Update{Updater: fp, Timestamp: time.Now().Unix(), Type: eventMove, DieKey: encodedDieKey}, 0)
+	return d, nil
 }
 
-func deleteDieHelper(c context.Context, encodedDieKey string) error {
-	k, err := datastore.DecodeKey(encodedDieKey)
+func deleteDieHelper(c context.Context, roomKey *datastore.Key, encodedDieKey string) error {
+	k, err := dieKeyIn(roomKey, encodedDieKey)
 	if err != nil {
-		return fmt.Errorf("could not decode die key %v: %v", encodedDieKey, err)
+		return err
 	}
 	var d Die
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
+	err = store.RunInTransaction(c, func(tx Transaction) error {
 		if err = tx.Get(k, &d); err != nil {
 			return fmt.Errorf("could not find die with key %v: %v", encodedDieKey, err)
 		}
@@ -1200,9 +1428,12 @@ func deleteDieHelper(c context.Context, encodedDieKey string) error {
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 	// Fake updater so Safari will work?
-	updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
-	return err
+	updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventDelete, DieKey: encodedDieKey}, 0)
+	return nil
 }
 
 func fateReplace(in string) string {
@@ -1214,69 +1445,92 @@ func fateReplace(in string) string {
 }
 
 // TODO(shanel): This will need to handle new cards
-func revealDieHelper(c context.Context, encodedDieKey, fp string) error {
-	k, err := datastore.DecodeKey(encodedDieKey)
+func revealDieHelper(c context.Context, roomKey *datastore.Key, encodedDieKey, fp string, rev int64) (Die, error) {
+	var d Die
+	k, err := dieKeyIn(roomKey, encodedDieKey)
 	if err != nil {
-		return fmt.Errorf("could not decode die key %v: %v", encodedDieKey, err)
+		return d, err
 	}
-	var d Die
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
+	err = store.RunInTransaction(c, func(tx Transaction) error {
 		if err = tx.Get(k, &d); err != nil {
 			return fmt.Errorf("could not find die with key %v: %v", encodedDieKey, err)
 		}
+		if err := d.checkRevision(rev); err != nil {
+			return err
+		}
 		if d.HiddenBy != fp && d.HiddenBy != "" {
-			return fmt.Errorf("item with key %v was not hidden by %v", encodedDieKey, fp)
+			return refuse(http.StatusForbidden, "item with key %v was not hidden by %v", encodedDieKey, fp)
 		}
 		if d.IsCard || d.IsCustomItem || d.IsImage || d.IsClock || d.Size == "tokens" {
 			d.IsHidden = false
 			d.HiddenBy = ""
+			d.Revision++
 			_, err = tx.Put(k, &d)
 			if err != nil {
 				return fmt.Errorf("problem revealing room die %v: %v", encodedDieKey, err)
 			}
-			// Fake updater so Safari will work?
-			updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
 			return nil
 		}
-		return fmt.Errorf("only cards and custom items can be revealed.")
+		return refuse(http.StatusUnprocessableEntity, "only cards and custom items can be revealed")
 	})
-	return err
+	if err != nil {
+		return d, err
+	}
+	// Fake updater so Safari will work?
+	updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventReveal, DieKey: encodedDieKey}, 0)
+	return d, nil
 }
 
-func hideDieHelper(c context.Context, encodedDieKey, hiddenBy string) error {
-	k, err := datastore.DecodeKey(encodedDieKey)
+func hideDieHelper(c context.Context, roomKey *datastore.Key, encodedDieKey, hiddenBy string, rev int64) (Die, error) {
+	var d Die
+	k, err := dieKeyIn(roomKey, encodedDieKey)
 	if err != nil {
-		return fmt.Errorf("could not decode die key %v: %v", encodedDieKey, err)
+		return d, err
 	}
-	var d Die
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
+	err = store.RunInTransaction(c, func(tx Transaction) error {
 		if err = tx.Get(k, &d); err != nil {
 			return fmt.Errorf("could not find die with key %v: %v", encodedDieKey, err)
 		}
+		if err := d.checkRevision(rev); err != nil {
+			return err
+		}
 		if d.IsHidden && d.HiddenBy != "" {
-			return fmt.Errorf("item is already hidden")
+			return refuse(http.StatusConflict, "item is already hidden")
 		}
 		if d.IsCard || d.IsCustomItem || d.IsClock || d.IsImage || d.Size == "tokens" {
 			d.IsHidden = true
 			d.HiddenBy = hiddenBy
+			d.Revision++
 			_, err = tx.Put(k, &d)
 			if err != nil {
 				return fmt.Errorf("problem hiding room die %v: %v", encodedDieKey, err)
 			}
-			// Fake updater so Safari will work?
-			updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
 			return nil
 		}
-		return fmt.Errorf("Only cards and custom items can be hidden.")
+		return refuse(http.StatusUnprocessableEntity, "only cards and custom items can be hidden")
 	})
-	return err
+	if err != nil {
+		return d, err
+	}
+	// Fake updater so Safari will work?
+	updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventHide, DieKey: encodedDieKey}, 0)
+	return d, nil
 }
 
+// getOldColor reads the color out of the image URL of a die from before dice had
+// colors. Dice with no such URL, like ones rolled through the API, have none.
 func getOldColor(u string) string {
-	chunk := strings.Split(u, "/")[5]
+	parts := strings.Split(u, "/")
+	if len(parts) < 6 {
+		return ""
+	}
+	chunk := parts[5]
 	var c string
 	if chunk == "tokens" {
-		c = strings.Split(strings.Split(u, "/")[6], "_")[0]
+		if len(parts) < 7 {
+			return ""
+		}
+		c = strings.Split(parts[6], "_")[0]
 		if c == "clear" {
 			return "lightblue"
 		}
@@ -1290,57 +1544,67 @@ func getOldColor(u string) string {
 	}
 }
 
-func rerollDieHelper(c context.Context, encodedDieKey, room, fp string, white bool) error {
-	k, err := datastore.DecodeKey(encodedDieKey)
+func rerollDieHelper(c context.Context, roomKey *datastore.Key, encodedDieKey, room, fp string, white bool, rev int64) (Die, error) {
+	var d Die
+	k, err := dieKeyIn(roomKey, encodedDieKey)
 	if err != nil {
-		return fmt.Errorf("could not decode die key %v: %v", encodedDieKey, err)
+		return d, err
 	}
-	var d Die
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
+	// chain is the dice the rerolled die exploded into, if it explodes.
+	var chainKeys []*datastore.Key
+	var chain []*Die
+	err = store.RunInTransaction(c, func(tx Transaction) error {
+		chainKeys, chain = nil, nil
 		if err = tx.Get(k, &d); err != nil {
 			return fmt.Errorf("could not find die with key %v: %v", encodedDieKey, err)
 		}
+		if err := d.checkRevision(rev); err != nil {
+			return err
+		}
+		// Cards are drawn by drawCards in its own transaction, so only read the room for dice.
+		var rm Room
+		src := randomSourceFor(k.Parent.Encode())
+		if !d.IsCard {
+			if err = tx.Get(k.Parent, &rm); err != nil {
+				return fmt.Errorf("could not find room for die %v: %v", encodedDieKey, err)
+			}
+			src = roomRandomness(&rm, k.Parent)
+		}
+		nonce := rm.FairNonce
 		if d.IsHidden && d.HiddenBy != fp {
-			return fmt.Errorf("wont reroll die with key %v - not hidden by %v", encodedDieKey, fp)
+			return refuse(http.StatusForbidden, "wont reroll die with key %v - not hidden by %v", encodedDieKey, fp)
 		}
 		if (d.IsLabel || d.IsImage) && !d.IsFunky {
-			return fmt.Errorf("label")
+			return refuse(http.StatusUnprocessableEntity, "labels and images can't be rerolled")
 		}
 
 		if d.IsFunky {
-			d.Result, d.ResultStr = getNewResult(d.Size)
+			d.Result, d.ResultStr = getNewResult(src, d.Size)
 			d.ResultStr = fmt.Sprintf("%s (d%s)", d.ResultStr, d.Size)
 			d.Timestamp = time.Now().Unix()
+			stampNonce(src, &d, -1)
 		} else if d.IsCustomItem {
 			// Do a single draw.
 			dice, keys := drawCards(c, 1, k.Parent, d.CustomSetName, strconv.FormatBool(d.IsHidden), d.HiddenBy)
 			// Set the location to the same as the passed in die.
 			d.ResultStr = dice[0].ResultStr
 			d.Image = dice[0].Image
-			// Delete the old die.
-			err := deleteDieHelper(c, keys[0].Encode())
-			if err != nil {
-				log.Printf("error in deleteDieHelper: %v", err)
+			// The drawn die only carries the new item over, and nobody was told about it.
+			if err := store.Delete(c, keys[0]); err != nil {
+				log.Printf("could not delete drawn die %v: %v", keys[0].Encode(), err)
 			}
 		} else if d.IsCard {
 			dice, keys := drawCards(c, 1, k.Parent, "", strconv.FormatBool(d.IsHidden), d.HiddenBy)
 			// Set the location to the same as the passed in die.
 			d.ResultStr = dice[0].ResultStr
 			d.Image = dice[0].Image
-			// Delete the old die.
-			err := deleteDieHelper(c, keys[0].Encode())
-			if err != nil {
-				log.Printf("error in deleteDieHelper: %v", err)
+			// The drawn die only carries the new item over, and nobody was told about it.
+			if err := store.Delete(c, keys[0]); err != nil {
+				log.Printf("could not delete drawn die %v: %v", keys[0].Encode(), err)
 			}
 		} else if d.IsClock {
-			sep := map[string]int{
-				"c4": 5,
-				"c6": 7,
-				"c8": 9,
-				"ct": 7,
-			}
 			oldResult := d.Result
-			d.Result = (d.Result + 1) % sep[d.Size]
+			d.Result = (d.Result + 1) % clockSegments[d.Size]
 			d.Image = strings.Replace(d.Image, fmt.Sprintf("%d.png", oldResult), fmt.Sprintf("%d.png", d.Result), 1)
 		} else {
 			if d.SVGPath == "" {
@@ -1376,7 +1640,22 @@ func rerollDieHelper(c context.Context, encodedDieKey, room, fp string, white bo
 					}
 				}
 			} else {
-				d.Result, d.ResultStr = getNewResult(d.Size)
+				d.History = append(d.History, d.Result)
+				d.Result, d.ResultStr = getNewResult(src, d.Size)
+				if d.RerollRule != "" {
+					rr, err := rerollRuleFor(d.Size, d.RerollRule)
+					if err != nil {
+						return fmt.Errorf("could not apply reroll rule to %v: %v", encodedDieKey, err)
+					}
+					var history []int
+					d.Result, d.ResultStr, history = rr.apply(d.Size, d.Result, d.ResultStr, roller(src))
+					d.History = append(d.History, history...)
+				}
+				stampNonce(src, &d, -1)
+				// A rerolled die no longer belongs to the expression it came from.
+				d.Expression = ""
+				d.ExpressionTotal = 0
+				d.IsDropped = false
 			}
 			// SVG here
 			var svg []byte
@@ -1398,60 +1677,156 @@ func rerollDieHelper(c context.Context, encodedDieKey, room, fp string, white bo
 				d.Image = strings.Replace(d.Image, fmt.Sprintf("%s.png", oldResultStr), fmt.Sprintf("%s.png", fateReplace(d.ResultStr)), 1)
 			}
 		}
+		d.Revision++
 		_, err = tx.Put(k, &d)
 		if err != nil {
 			return fmt.Errorf("problem rerolling room die %v: %v", encodedDieKey, err)
 		}
-		if lastRoll[room] == 0 || lastAction[room] == "reroll" {
-			if d.Size != "F" && d.Size != "H" && !d.IsCard {
-				lastRoll[room] += d.Result
+		if d.ExplodeRule != "" {
+			if chainKeys, chain, err = rerollExplosions(c, tx, src, k, &d); err != nil {
+				return err
+			}
+		}
+		if rm.FairNonce != nonce {
+			if _, err := tx.Put(k.Parent, &rm); err != nil {
+				return fmt.Errorf("could not save fair nonce: %v", err)
+			}
+		}
+		if d.SuccessRule != "" && !d.IsCard {
+			sr, err := successRuleFor(d.Size, d.SuccessRule)
+			if err != nil {
+				return fmt.Errorf("could not rescore die %v: %v", encodedDieKey, err)
+			}
+			// A compounded chain scores once, on the die that started it; otherwise every die scores.
+			compound := strings.HasPrefix(d.ExplodeRule, "!!")
+			v := dieValue(d.Size, d.value())
+			for _, nd := range chain {
+				nd.SuccessRule = d.SuccessRule
+				if compound {
+					v += dieValue(nd.Size, nd.value())
+				} else {
+					nd.IsSuccess, nd.IsFailure = sr.score(dieValue(nd.Size, nd.value()))
+				}
+			}
+			d.IsSuccess, d.IsFailure = sr.score(v)
+			if _, err = tx.Put(k, &d); err != nil {
+				return fmt.Errorf("problem rescoring room die %v: %v", encodedDieKey, err)
+			}
+			if _, err = tx.PutMulti(chainKeys, chain); err != nil {
+				return fmt.Errorf("problem rescoring exploded dice: %v", err)
 			}
 		}
 		return nil
 	})
+	if err != nil {
+		return d, err
+	}
+	if lastRoll[room] == 0 || lastAction[room] == "reroll" {
+		if d.Size != "F" && d.Size != "H" && !d.IsCard {
+			lastRoll[room] += d.value()
+			for _, nd := range chain {
+				lastRoll[room] += nd.value()
+			}
+		}
+	}
 	// Fake updater so Safari will work?
-	updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
-	updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
-	updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
-	return err
+	updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventRoll, DieKey: encodedDieKey}, 0)
+	return d, nil
+}
+
+// explodedDescendants finds every die that exploded, directly or not, from the die at k.
+func explodedDescendants(c context.Context, k *datastore.Key) ([]*datastore.Key, error) {
+	out := []*datastore.Key{}
+	parents := []string{k.Encode()}
+	for len(parents) > 0 {
+		q := NewQuery("Die").Ancestor(k.Parent).Filter("ExplodedFrom =", parents[0]).KeysOnly()
+		parents = parents[1:]
+		children, err := store.GetAll(c, q, nil)
+		if err != nil {
+			return nil, fmt.Errorf("problem finding exploded dice: %v", err)
+		}
+		for _, ck := range children {
+			out = append(out, ck)
+			parents = append(parents, ck.Encode())
+		}
+	}
+	return out, nil
 }
 
-func decrementClock(c context.Context, encodedDieKey string) error {
-	k, err := datastore.DecodeKey(encodedDieKey)
+// rerollExplosions throws away the chain that exploded from d and rolls a new one from its current result.
+// It returns the keys and dice of the new chain.
+func rerollExplosions(c context.Context, tx Transaction, src RandomSource, k *datastore.Key, d *Die) ([]*datastore.Key, []*Die, error) {
+	rule, err := explodeRuleFor(d.Size, d.ExplodeRule)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not reroll explosions for %v: %v", k.Encode(), err)
+	}
+	old, err := explodedDescendants(c, k)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tx.DeleteMulti(old); err != nil {
+		return nil, nil, fmt.Errorf("problem deleting exploded dice: %v", err)
+	}
+	base := drawCount(src)
+	extra := rule.chain(d.Size, d.Result, maxExplosions, roller(src))
+	keys := []*datastore.Key{}
+	dice := []*Die{}
+	parent := k.Encode()
+	for i, rd := range extra {
+		dk := dieKey(k.Parent, int64(i))
+		nd, err := newDie(dk, rd.Size, rd.Result, rd.ResultStr, d.Color, d.Timestamp)
+		if err != nil {
+			return nil, nil, err
+		}
+		nd.ExplodeRule = d.ExplodeRule
+		nd.ExplodedFrom = parent
+		nd.IsPenetrated = rd.Penetrated
+		stampNonce(src, nd, base+i)
+		parent = nd.KeyStr
+		keys = append(keys, dk)
+		dice = append(dice, nd)
+	}
+	if _, err := tx.PutMulti(keys, dice); err != nil {
+		return nil, nil, fmt.Errorf("could not create exploded dice: %v", err)
+	}
+	return keys, dice, nil
+}
+
+func decrementClock(c context.Context, roomKey *datastore.Key, encodedDieKey string) error {
+	k, err := dieKeyIn(roomKey, encodedDieKey)
 	if err != nil {
-		return fmt.Errorf("could not decode die key %v: %v", encodedDieKey, err)
+		return err
 	}
 	var d Die
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
+	err = store.RunInTransaction(c, func(tx Transaction) error {
 		if err = tx.Get(k, &d); err != nil {
 			return fmt.Errorf("could not find die with key %v: %v", encodedDieKey, err)
 		}
-		sep := map[string]int{
-			"c4": 5,
-			"c6": 7,
-			"c8": 9,
-			"ct": 7,
+		if !d.IsClock {
+			return refuse(http.StatusUnprocessableEntity, "only clocks can be wound back")
 		}
 		if d.Result == 0 { // No need to wrap around.
 			return nil
 		}
 		oldResult := d.Result
-		d.Result = (d.Result - 1) % sep[d.Size]
+		d.Result = (d.Result - 1) % clockSegments[d.Size]
 		d.Image = strings.Replace(d.Image, fmt.Sprintf("%d.png", oldResult), fmt.Sprintf("%d.png", d.Result), 1)
+		d.Revision++
 		_, err = tx.Put(k, &d)
 		if err != nil {
 			return fmt.Errorf("problem decrementing clock %v: %v", encodedDieKey, err)
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 	// Fake updater so Safari will work?
-	updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
-	updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
-	updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
-	return err
+	updateRoom(c, k.Parent.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventClock, DieKey: encodedDieKey}, 0)
+	return nil
 }
 
-func getNewResult(kind string) (int, string) {
+func getNewResult(src RandomSource, kind string) (int, string) {
 	var s int
 	var err error
 	if kind == "10p" { // TODO(shanel): this can probably go away due to d100
@@ -1462,146 +1837,99 @@ func getNewResult(kind string) (int, string) {
 		s, err = strconv.Atoi(kind)
 		if err != nil {
 			if kind == "F" {
-				r := rand.Intn(3)
+				r := src.Intn(3)
 				return r + 1, fmt.Sprintf("%d", r+1)
 			} else {
-				r := rand.Intn(2)
+				r := src.Intn(2)
 				return r, fmt.Sprintf("%d", r)
 			}
 		}
 	}
-	r := rand.Intn(s) + 1
+	r := src.Intn(s) + 1
 	return r, strconv.Itoa(r)
 }
 
-func onlyLetters(s string) bool {
-	for _, r := range s {
-		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
-			return false
-		}
-	}
-	return true
-}
-
 func main() {
 	//	func init() {
 	http.HandleFunc("/", Root)
 	http.HandleFunc("/about", About)
+	http.HandleFunc("/admin/sweep", SweepRooms)
 	http.HandleFunc("/addcustomset", HandleAddingCustomSet)
 	http.HandleFunc("/alert", Alert)
+	http.HandleFunc("/api/v1/rooms", APIRooms)
+	http.HandleFunc("/api/v1/rooms/", APIRooms)
 	http.HandleFunc("/background", Background)
 	http.HandleFunc("/clear", Clear)
+	http.HandleFunc("/clone", Clone)
 	http.HandleFunc("/delete", DeleteDie)
 	http.HandleFunc("/decrementclock", HandleDecrementClock)
 	http.HandleFunc("/draw", Draw)
 	http.HandleFunc("/hide", HideDie)
 	http.HandleFunc("/image", AddImage)
+	http.HandleFunc("/import", Import)
 	http.HandleFunc("/move", Move)
 	http.HandleFunc("/paused", Paused)
 	http.HandleFunc("/refresh", Refresh)
 	http.HandleFunc("/removecustomset", HandleRemovingCustomSet)
 	http.HandleFunc("/reroll", RerollDie)
 	http.HandleFunc("/reveal", RevealDie)
+	http.HandleFunc("/revealseed", RevealSeed)
 	http.HandleFunc("/roll", Roll)
 	http.HandleFunc("/room", GetRoom)
-	http.HandleFunc("/room/", GetRoom)
-	http.HandleFunc("/room/*", GetRoom)
+	http.HandleFunc("/room/", RoomRouter)
+	http.HandleFunc("/room/*", RoomRouter)
 	http.HandleFunc("/safety", SafetyRoom)
 	http.HandleFunc("/safety/", SafetyRoom)
 	http.HandleFunc("/safety/*", SafetyRoom)
 	http.HandleFunc("/shuffle", Shuffle)
+	http.HandleFunc("/startfair", StartFair)
+	http.HandleFunc("/template/", FromTemplate)
 
-	// Seed random number generator.
-	rand.Seed(int64(time.Now().Unix()))
+	// Pick where randomness comes from.
+	if err := configureRandomness(os.Getenv("ROLLER_RNG")); err != nil {
+		log.Fatal(err)
+	}
+
+	storeSetting := flag.String("store", os.Getenv("ROLLER_STORE"), `where to keep rooms: "datastore", "memory" or "bolt:<file>"`)
+	brokerSetting := flag.String("broker", os.Getenv("ROLLER_BROKER"), `how instances tell each other about changes: "pubsub", "redis://<host>:<port>", "memory" or "none"`)
+	ttlSetting := flag.String("room-ttl", os.Getenv("ROLLER_ROOM_TTL"), "how long an unused room is kept, e.g. 720h; unset or 0 keeps rooms forever")
+	flag.Parse()
 
-	ctx := context.Background()
 	var err error
-	//projectID := "just-another-dice-roller"
-	projectID := "dice-roller-174222"
-	dsClient, err = datastore.NewClient(ctx, projectID)
+	roomTTL, err = parseRoomTTL(*ttlSetting)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// pubsub client
-	pubsubClient, err := pubsub.NewClient(ctx, projectID)
+	ctx := context.Background()
+	//projectID := "just-another-dice-roller"
+	projectID := "dice-roller-174222"
+	store, err = openStore(ctx, *storeSetting, projectID)
 	if err != nil {
-		log.Printf("issue creating pubsub client, caching will not be working well: %v", err)
-	} else {
-		defer func() {
-			_ = pubsubClient.Close()
-		}()
+		log.Fatal(err)
 	}
+	defer func() {
+		_ = store.Close()
+	}()
 
 	updateCache = ccache.New(ccache.Configure())
 
-	// pubsub topic
-	pubsubTopic = pubsubClient.Topic(pubsubTopicName)
-	defer pubsubTopic.Stop()
-
-	id := os.Getenv("GAE_SERVICE") + "-" + os.Getenv("GAE_VERSION") + "-" + os.Getenv("GAE_INSTANCE")
+	if roomTTL > 0 {
+		go sweepForever(ctx, roomTTL)
+	}
 
-	pubsubSubscription, err = pubsubClient.CreateSubscription(ctx, id, pubsub.SubscriptionConfig{
-		Topic:            pubsubTopic,
-		AckDeadline:      10 * time.Second,
-		ExpirationPolicy: 24 * time.Hour,
-	})
+	// The broker keeps the caches of instances sharing a store in sync; a single box
+	// using a local store has nothing to sync with.
+	broker, err = openBroker(ctx, *brokerSetting, projectID)
 	if err != nil {
-		log.Printf("issue creating pubsub subscriber, caching will not be working well: %v", err)
-	} else {
-
-		// TODO(shanel): Add a simple pubsub setup - topic messages will be rooms and their update timestamps.
-		// One subscriber per instance. A single topic. Subscriber will just dump the info into the local ccache instance.
-		// Messages will be published by any method that isn't just reading from the datastore (so datastore.Put()s or UpdateRoom calls).
-		// Ideally use ordered subscriber? Though might just make sense to - if get unordered - only use the newest (ie compare
-		// what has already been put in the cache before updating the cache - doing that would minimize the reads)
-		// Make sure to defer unsubscribing or shutting down the subscriber - don't want messages being saved if the instance dies off.
-
-		// roomCache will have the most up to date Passer objects so we can generate rooms without making remote reads more than once
-		//	roomCache = ccache.New(ccache.Configure())
-
+		log.Printf("issue setting up the broker, caching will not be working well: %v", err)
+	} else if broker != nil {
+		defer func() {
+			_ = broker.Close()
+		}()
 		go func() {
-			err = pubsubSubscription.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
-				// TODO: Handle message.
-				// NOTE: May be called concurrently; synchronize access to shared memory.
-
-				// Get the room and timestamp out of the message
-				messageData := string(m.Data)
-				// assumed structure is "MyRoomName|123456789"
-				messagePieces := strings.Split(messageData, "|")
-				switch count := len(messagePieces); count {
-				case 1:
-					// Check if it is a room name. If it is just insert with current timestamp;
-					if onlyLetters(messagePieces[0]) {
-						updateCache.Set(messagePieces[0], time.Now().Unix(), 5*time.Hour)
-					}
-				case 2:
-					var cacheTimestamp, messageTimestamp int64
-
-					// Do a Get of the room name, if it exists convert the value and the message timestamp to int64 and compare
-					// If message timestamp is newer, replace the current entry
-					got := updateCache.Get(messagePieces[0])
-					if got != nil {
-						cacheTimestamp = got.Value().(int64)
-					}
-					tempTS, err := strconv.Atoi(messagePieces[1])
-					if err == nil {
-						messageTimestamp = int64(tempTS)
-					} else {
-						log.Printf("problem converting message timestamp to int: %v", err)
-						messageTimestamp = time.Now().Unix()
-					}
-					if messageTimestamp > cacheTimestamp {
-						updateCache.Set(messagePieces[0], messageTimestamp, 5*time.Hour)
-					}
-				default:
-					// log an error
-					log.Printf("don't know what to do with this message: %v", messageData)
-				}
-				m.Ack()
-			})
-			if err != context.Canceled {
-				log.Printf("got unexpected error via Pubsub.Receive: %v", err)
+			if err := broker.Subscribe(ctx, applyRoomChange); err != nil && err != context.Canceled {
+				log.Printf("got unexpected error from the broker: %v", err)
 			}
 		}()
 	}
@@ -1642,9 +1970,16 @@ func Paused(w http.ResponseWriter, r *http.Request) {
 	out := "<html><center>To save on bandwidth we have stopped updating you since you have been idle for half an hour. To get back to your room, click <a href=\"/room/%v\">here</a>.</center></html>"
 	room := r.Form.Get("id")
 	lastAction[room] = "paused"
+	if keyStr, err := getEncodedRoomKeyFromName(r.Context(), room); err == nil {
+		if roomKey, err := datastore.DecodeKey(keyStr); err == nil {
+			notePresence(r.Context(), roomKey, r.Form.Get("fp"), true, time.Now())
+		}
+	}
 	_, _ = fmt.Fprintf(w, out, room)
 }
 
+// Refresh sends the events in room id after seq that player fp hasn't seen. With
+// delta=true it also says how the table changed, so the page can patch it in place.
 func Refresh(w http.ResponseWriter, r *http.Request) {
 	c := r.Context()
 	_ = r.ParseForm()
@@ -1657,9 +1992,29 @@ func Refresh(w http.ResponseWriter, r *http.Request) {
 		log.Printf("roomname wonkiness in refresh: %v", err)
 	}
 	fp := r.Form.Get("fp")
-	ts := r.Form.Get("ts")
-	ref := refreshRoom(c, keyStr, fp, ts)
-	_, _ = fmt.Fprintf(w, "%v", ref)
+	seq, err := strconv.ParseInt(r.Form.Get("seq"), 10, 64)
+	if err != nil {
+		seq = 0
+	}
+	roomKey, err := datastore.DecodeKey(keyStr)
+	if err == nil {
+		notePresence(c, roomKey, fp, false, time.Now())
+	}
+	out := refreshRoom(c, keyStr, fp, seq)
+	if err == nil {
+		addPlayers(c, roomKey, &out)
+	}
+	if wantDelta, _ := strconv.ParseBool(r.Form.Get("delta")); wantDelta {
+		sort := "true"
+		if cook, err := r.Cookie("sort_dice"); err == nil {
+			sort = cook.Value
+		}
+		addDelta(c, &out, r.Form.Get("id"), keyStr, fp, sort)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("could not write refresh: %v", err)
+	}
 }
 
 func getXY(keyStr string, r *http.Request) (float64, float64) {
@@ -1676,105 +2031,125 @@ func getXY(keyStr string, r *http.Request) (float64, float64) {
 
 func Move(w http.ResponseWriter, r *http.Request) {
 	c := r.Context()
-	_ = r.ParseForm()
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
+	}
+	room := ref.Slug
 	keyStr := r.Form.Get("id")
 	fp := r.Form.Get("fp")
 	x, y := getXY(keyStr, r)
-	err := updateDieLocation(c, keyStr, fp, x, y)
+	d, err := updateDieLocation(c, ref.Key, keyStr, fp, x, y, getRevision(r))
 	if err != nil {
 		log.Printf("quietly not updating position of %v to (%v, %v): %v", keyStr, x, y, err)
+	} else {
+		lastAction[room] = "move"
+	}
+	writeDieResult(w, r, room, fp, d, err)
+}
+
+// getRevision is the revision of the die the client acted on, if it sent one.
+func getRevision(r *http.Request) int64 {
+	rev, err := strconv.ParseInt(r.Form.Get("rev"), 10, 64)
+	if err != nil {
+		return anyRevision
+	}
+	return rev
+}
+
+// writeDieResult answers a change to a single die. Clients get the die back so they
+// know its new revision; if it had changed under them they get a 409 with the die as
+// it is now. Other failures go back to the room as they always have.
+func writeDieResult(w http.ResponseWriter, r *http.Request, room, fp string, d Die, err error) {
+	code := http.StatusOK
+	if conflict, ok := err.(*revisionConflict); ok {
+		code = http.StatusConflict
+		d = conflict.Current
+	} else if err != nil {
+		smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(d.seenBy(fp)); err != nil {
+		log.Printf("could not write die: %v", err)
 	}
-	room := path.Base(r.Referer())
-	lastAction[room] = "move"
-	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
 }
 
 func Background(w http.ResponseWriter, r *http.Request) {
-	_ = r.ParseForm()
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
+	}
 	bg := r.Form.Get("bg")
 	c := r.Context()
-	room := path.Base(r.Referer())
-	keyStr, err := getEncodedRoomKeyFromName(c, room)
-	if err != nil {
-		log.Printf("roomname wonkiness in background: %v", err)
-	}
-	roomKey, err := datastore.DecodeKey(keyStr)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	room := ref.Slug
+	if err := setBackground(c, room, bg); err != nil {
+		log.Printf("%v", err)
 	}
-	setBackground(c, room, bg)
-	updateRoom(c, roomKey.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
 	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
 }
 
 func HandleAddingCustomSet(w http.ResponseWriter, r *http.Request) {
-	_ = r.ParseForm()
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
+	}
 	name := r.Form.Get("name")
 	entries := r.Form.Get("entries")
 	height := r.Form.Get("height")
 	width := r.Form.Get("width")
 	c := r.Context()
-	room := path.Base(r.Referer())
-	keyStr, err := getEncodedRoomKeyFromName(c, room)
-	if err != nil {
-		log.Printf("roomname wonkiness in handleAddingCustonSet: %v", err)
-	}
-	roomKey, err := datastore.DecodeKey(keyStr)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	room := ref.Slug
+	if err := addCustomSet(c, room, name, entries, height, width); err != nil {
+		log.Printf("%v", err)
 	}
-	addCustomSet(c, room, name, entries, height, width)
-	updateRoom(c, roomKey.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
 	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
 }
 
 func HandleRemovingCustomSet(w http.ResponseWriter, r *http.Request) {
-	_ = r.ParseForm()
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
+	}
 	name := r.Form.Get("deck")
 	c := r.Context()
-	room := path.Base(r.Referer())
-	keyStr, err := getEncodedRoomKeyFromName(c, room)
-	if err != nil {
-		log.Printf("roomname wonkiness in handleAddingCustomSet: %v", err)
-	}
-	roomKey, err := datastore.DecodeKey(keyStr)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	room := ref.Slug
+	if err := removeCustomSet(c, room, name); err != nil {
+		log.Printf("%v", err)
 	}
-	removeCustomSet(c, room, name)
-	updateRoom(c, roomKey.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
 	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
 }
 
 func Alert(w http.ResponseWriter, r *http.Request) {
-	_ = r.ParseForm()
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
+	}
 	message := r.Form.Get("message")
 	c := r.Context()
-	room := path.Base(r.Referer())
-	keyStr, err := getEncodedRoomKeyFromName(c, room)
-	if err != nil {
-		log.Printf("roomname wonkiness in alert: %v", err)
-	}
-	roomKey, err := datastore.DecodeKey(keyStr)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-	updateRoom(c, roomKey.Encode(), Update{Updater: "", Timestamp: time.Now().Unix(), Message: message}, 0)
-	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+	updateRoom(c, ref.KeyStr, Update{Updater: "", Timestamp: time.Now().Unix(), Message: message, Type: eventAlert}, 0)
+	smartRedirect(w, r, fmt.Sprintf("/room/%v", ref.Slug), http.StatusFound)
 }
 
 func AddImage(w http.ResponseWriter, r *http.Request) {
 	c := r.Context()
-	room := path.Base(r.Referer())
-	keyStr, err := getEncodedRoomKeyFromName(c, room)
-	if err != nil {
-		log.Printf("roomname wonkiness in roll: %v", err)
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
 	}
-	roomKey, err := datastore.DecodeKey(keyStr)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	room := ref.Slug
+	fp := r.Form.Get("fp")
+	if _, err := addImage(c, ref.Key, r.Form.Get("url"), r.Form.Get("height"), r.Form.Get("width")); err != nil {
+		log.Printf("%v", err)
 	}
-	_ = r.ParseForm()
+	lastAction[room] = "image"
+	updateRoom(c, ref.KeyStr, Update{Updater: fp, Timestamp: time.Now().Unix(), Type: eventImage}, 0)
+	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+}
+
+// addImage puts the image at url on the table, sized height by width if they're given.
+func addImage(c context.Context, roomKey *datastore.Key, url, height, width string) (Die, error) {
 	ts := time.Now().Unix()
 	lk := dieKey(roomKey, int64(ts))
 	l := Die{
@@ -1784,130 +2159,120 @@ func AddImage(w http.ResponseWriter, r *http.Request) {
 		Timestamp:    ts,
 		New:          true,
 		IsImage:      true,
-		Image:        r.Form.Get("url"),
-		CustomHeight: r.Form.Get("height"),
-		CustomWidth:  r.Form.Get("width"),
+		Image:        url,
+		CustomHeight: height,
+		CustomWidth:  width,
 	}
-	_, err = dsClient.Put(c, lk, &l)
-	if err != nil {
-		log.Printf("could not create new image: %v", err)
+	if _, err := store.Put(c, lk, &l); err != nil {
+		return l, fmt.Errorf("could not create new image: %v", err)
 	}
-	fp := r.Form.Get("fp")
-	lastAction[room] = "image"
-	updateRoom(c, keyStr, Update{Updater: fp, Timestamp: time.Now().Unix()}, 0)
-	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+	return l, nil
 }
 
 func Roll(w http.ResponseWriter, r *http.Request) {
 	c := r.Context()
-	room := path.Base(r.Referer())
-	keyStr, err := getEncodedRoomKeyFromName(c, room)
-	if err != nil {
-		log.Printf("roomname wonkiness in roll: %v", err)
-	}
-	roomKey, err := datastore.DecodeKey(keyStr)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
 	}
+	room, roomKey := ref.Slug, ref.Key
 	toRoll := map[string]string{
-		"3":      r.FormValue("d3"),
-		"4":      r.FormValue("d4"),
-		"5":      r.FormValue("d5"),
-		"6":      r.FormValue("d6"),
-		"6p":     r.FormValue("d6p"),
-		"7":      r.FormValue("d7"),
-		"8":      r.FormValue("d8"),
-		"10":     r.FormValue("d10"),
-		"12":     r.FormValue("d12"),
-		"14":     r.FormValue("d14"),
-		"16":     r.FormValue("d16"),
-		"20":     r.FormValue("d20"),
-		"24":     r.FormValue("d24"),
-		"30":     r.FormValue("d30"),
-		"100":    r.FormValue("d100"),
-		"F":      r.FormValue("dF"),
-		"H":      r.FormValue("dH"),
 		"label":  r.FormValue("label"),
 		"card":   r.FormValue("cards"),
 		"tokens": r.FormValue("tokens"),
 		"xdy":    r.FormValue("xdy"),
-		"c4":     r.FormValue("c4"),
-		"c6":     r.FormValue("c6"),
-		"c8":     r.FormValue("c8"),
-		"ct":     r.FormValue("ct"),
+	}
+	for _, size := range dieSizes {
+		toRoll[size] = r.FormValue("d" + size)
+	}
+	for _, size := range clockSizes {
+		toRoll[size] = r.FormValue(size)
 	}
 	fp := r.FormValue("fp")
 	col := r.FormValue("color")
 	mod := r.FormValue("modifier")
 	mod = strings.TrimLeft(mod, " +")
-	var modInt int
-	modInt, err = strconv.Atoi(mod)
+	modInt, err := strconv.Atoi(mod)
 	if err != nil {
 		modInt = 0
 	}
-	total, err := newRoll(c, toRoll, roomKey, col, r.FormValue("hiddenDraw"), fp)
+	total, added, err := newRoll(c, toRoll, roomKey, col, r.FormValue("hiddenDraw"), fp)
+	if ee, ok := err.(*expressionError); ok {
+		http.Error(w, ee.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		log.Printf("error in roll: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	lastRoll[room] = total
 
 	lastAction[room] = "roll"
-	updateRoom(c, roomKey.Encode(), Update{Updater: fp, Timestamp: time.Now().Unix()}, modInt)
+	updateRoom(c, roomKey.Encode(), Update{Updater: fp, Timestamp: time.Now().Unix(), Type: eventRoll, DieKeys: added}, modInt)
 	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
 }
 
 func DeleteDie(w http.ResponseWriter, r *http.Request) {
 	c := r.Context()
-	_ = r.ParseForm()
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
+	}
 	keyStr := r.Form.Get("id")
-	room := path.Base(r.Referer())
-	// Do we need to be worried dice will be deleted from other rooms?
-	err := deleteDieHelper(c, keyStr)
-	if err != nil {
+	room := ref.Slug
+	if err := deleteDieHelper(c, ref.Key, keyStr); err != nil {
 		log.Printf("error in deleteDie: %v", err)
-		smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+	} else {
+		lastAction[room] = "delete"
 	}
-	lastAction[room] = "delete"
 	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
 }
 
 func RevealDie(w http.ResponseWriter, r *http.Request) {
 	c := r.Context()
-	_ = r.ParseForm()
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
+	}
 	keyStr := r.Form.Get("id")
 	fp := r.Form.Get("fp")
-	room := path.Base(r.Referer())
+	room := ref.Slug
 	lastRoll[room] = 0
-	// Do we need to be worried dice will be revealed from other rooms?
-	err := revealDieHelper(c, keyStr, fp)
+	d, err := revealDieHelper(c, ref.Key, keyStr, fp, getRevision(r))
 	if err != nil {
 		log.Printf("error in revealDie: %v", err)
-		smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+	} else {
+		lastAction[room] = "reveal"
 	}
-	lastAction[room] = "reveal"
-	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+	writeDieResult(w, r, room, fp, d, err)
 }
 
 func HideDie(w http.ResponseWriter, r *http.Request) {
 	c := r.Context()
-	_ = r.ParseForm()
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
+	}
 	keyStr := r.Form.Get("id")
-	room := path.Base(r.Referer())
+	room := ref.Slug
 	lastRoll[room] = 0
-	// Do we need to be worried dice will be revealed from other rooms?
-	err := hideDieHelper(c, keyStr, r.Form.Get("fp"))
+	fp := r.Form.Get("fp")
+	d, err := hideDieHelper(c, ref.Key, keyStr, fp, getRevision(r))
 	if err != nil {
 		log.Printf("error in hideDie: %v", err)
-		smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+	} else {
+		lastAction[room] = "hide"
 	}
-	lastAction[room] = "hide"
-	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+	writeDieResult(w, r, room, fp, d, err)
 }
 
 func RerollDie(w http.ResponseWriter, r *http.Request) {
 	c := r.Context()
-	_ = r.ParseForm()
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
+	}
 	keyStr := r.Form.Get("id")
 	fp := r.Form.Get("fp")
 	var white bool
@@ -1916,49 +2281,86 @@ func RerollDie(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("issue with flipping token: %v", err)
 	}
-	room := path.Base(r.Referer())
+	room := ref.Slug
 	lastRoll[room] = 0
-	// Do we need to be worried dice will be rerolled from other rooms?
-	err = rerollDieHelper(c, keyStr, room, fp, white)
+	d, err := rerollDieHelper(c, ref.Key, keyStr, room, fp, white, getRevision(r))
 	if err != nil {
 		log.Printf("error in rerollDie: %v", err)
-		smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+	} else {
+		lastAction[room] = "reroll"
 	}
-	lastAction[room] = "reroll"
-	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+	writeDieResult(w, r, room, fp, d, err)
 }
 
 func HandleDecrementClock(w http.ResponseWriter, r *http.Request) {
 	c := r.Context()
-	_ = r.ParseForm()
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
+	}
 	keyStr := r.Form.Get("id")
-	room := path.Base(r.Referer())
-	err := decrementClock(c, keyStr)
-	if err != nil {
+	room := ref.Slug
+	if err := decrementClock(c, ref.Key, keyStr); err != nil {
 		log.Printf("error in decrementClock: %v", err)
-		smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+	} else {
+		lastAction[room] = "decrementClock"
 	}
-	lastAction[room] = "decrementClock"
 	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
 }
 
 func Clear(w http.ResponseWriter, r *http.Request) {
 	c := r.Context()
-	_ = r.ParseForm()
-	room := path.Base(r.Referer())
-	keyStr, err := getEncodedRoomKeyFromName(c, room)
-	if err != nil {
-		log.Printf("roomname wonkiness in clear: %v", err)
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
 	}
-	err = clearRoomDice(c, keyStr)
+	room := ref.Slug
+	removed, err := clearRoomDice(c, ref.KeyStr)
+	res := clearResult{Removed: removed}
+	code := http.StatusOK
 	if err != nil {
 		log.Printf("clear failed: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		res.Error = err.Error()
+		code = http.StatusInternalServerError
 	}
-	fp := r.Form.Get("fp")
+	// clearRoomDice has already told the room.
 	lastAction[room] = "clear"
-	updateRoom(c, keyStr, Update{Updater: fp, Timestamp: time.Now().Unix()}, 0)
-	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("could not write clear result: %v", err)
+	}
+}
+
+// clearResult tells whoever cleared the table how much went, and why it stopped
+// if it didn't all go.
+type clearResult struct {
+	Removed int
+	Error   string `json:",omitempty"`
+}
+
+// roomActions are the pages served under /room/{slug}/.
+var roomActions = map[string]func(http.ResponseWriter, *http.Request, string){
+	"audit":    Audit,
+	"events":   RoomEventStream,
+	"export":   Export,
+	"fairness": Fairness,
+	"template": SaveTemplate,
+	"ws":       RoomSocket,
+}
+
+// RoomRouter sends /room/{slug}/{action} to the matching room action and everything else to GetRoom.
+func RoomRouter(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/room/"), "/"), "/")
+	if len(parts) == 2 {
+		if action, ok := roomActions[parts[1]]; ok {
+			action(w, r, parts[0])
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	GetRoom(w, r)
 }
 
 func GetRoom(w http.ResponseWriter, r *http.Request) {
@@ -1994,6 +2396,33 @@ func GetRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	cookie := &http.Cookie{Name: "dice_room", Value: room, SameSite: http.SameSiteLaxMode}
+	http.SetCookie(w, cookie)
+
+	fp := ""
+	if cook, err := r.Cookie("fp"); err == nil {
+		fp = cook.Value
+	}
+	p := roomPasser(c, room, keyStr, fp, dice)
+	if roomKey, err := datastore.DecodeKey(keyStr); err == nil {
+		notePresence(c, roomKey, fp, false, time.Now())
+		if p.Players, err = roomPlayers(c, roomKey, time.Now()); err != nil {
+			log.Printf("could not see who is in %v: %v", room, err)
+		}
+	}
+	roomTemplate, err := parseRoomTemplate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := roomTemplate.Execute(w, p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// roomPasser works out everything the room page shows player fp, given the room's dice
+// in the order they are shown.
+func roomPasser(c context.Context, room, keyStr, fp string, dice []Die) Passer {
 	diceForTotals, err := getRoomDice(c, keyStr, "-Timestamp", "true")
 	if err != nil {
 		log.Printf("could not get dice for totals: %v", err)
@@ -2007,20 +2436,40 @@ func GetRoom(w http.ResponseWriter, r *http.Request) {
 		roomAvg         float64
 		newestTimestamp int64
 		tokenCount      int
+		expressions     = map[string]bool{}
+		lastExpression  string
+		successes       int
+		isPool          bool
 	)
 	for i, d := range diceForTotals {
 		if i == 0 {
 			newestTimestamp = d.Timestamp
 		}
+		if d.Expression != "" && newestTimestamp == d.Timestamp && !expressions[d.Expression] {
+			// The expression total already includes its dice and constants, so count it once.
+			expressions[d.Expression] = true
+			lastExpression = d.Expression
+			rollTotal += d.ExpressionTotal
+		}
+		if d.SuccessRule != "" && newestTimestamp == d.Timestamp {
+			isPool = true
+			if d.IsSuccess {
+				successes++
+			} else if d.IsFailure {
+				successes--
+			}
+		}
 		realSize := d.Size
 		if realSize == "6p" {
 			realSize = "6"
 		}
-		if _, err := strconv.Atoi(realSize); err == nil {
-			roomTotal += d.Result
+		if _, err := strconv.Atoi(realSize); err == nil && !d.IsDropped {
+			roomTotal += d.value()
 			roomCount++
 			if newestTimestamp == d.Timestamp {
-				rollTotal += d.Result
+				if d.Expression == "" {
+					rollTotal += d.value()
+				}
 				rollCount++
 			}
 		}
@@ -2032,19 +2481,31 @@ func GetRoom(w http.ResponseWriter, r *http.Request) {
 	rollAvg = float64(rollTotal) / float64(rollCount)
 	roomAvg = float64(roomTotal) / float64(roomCount)
 
-	cookie := &http.Cookie{Name: "dice_room", Value: room, SameSite: http.SameSiteLaxMode}
-	http.SetCookie(w, cookie)
-
 	var rm Room
 	var deckSize int
+	var seq int64
 	k, err := datastore.DecodeKey(keyStr)
 	if err != nil {
 		log.Printf("room: could not decode room key %v: %v", keyStr, err)
 	} else {
-		err := dsClient.Get(c, k, &rm)
+		err := store.Get(c, k, &rm)
 		if err != nil {
 			log.Printf("could not find room: %v", err)
 		} else {
+			// Visiting counts as using the room, so it doesn't get swept while people only watch.
+			if now := time.Now().Unix(); now-rm.Timestamp >= int64(roomTouchInterval/time.Second) {
+				if err := touchRoom(c, k, now); err != nil {
+					log.Printf("%v", err)
+				}
+			}
+			// The newest event carries the current modifier; rooms from before events kept it on the Room.
+			latest, ok, err := latestEvent(c, k)
+			if err != nil {
+				log.Printf("%v", err)
+			} else if ok {
+				rm.Modifier = latest.Modifier
+				seq = startSeq(keyStr, latest.Seq)
+			}
 			roomDeck, err := deck.New(deck.FromSignature(rm.Deck))
 			if err != nil {
 				log.Printf("problem with deck signature: %v", err)
@@ -2055,22 +2516,13 @@ func GetRoom(w http.ResponseWriter, r *http.Request) {
 	}
 	// Cull out cards that should not be seen...
 	filteredDice := []Die{}
-	fp := ""
-	if cook, err := r.Cookie("fp"); err == nil {
-		fp = cook.Value
-	}
 	for _, tf := range dice {
-		if tf.HiddenBy == fp || !tf.IsHidden {
-			filteredDice = append(filteredDice, tf)
-			continue
-		}
-		if tf.IsHidden && tf.IsCard {
-			tf.Image = fmt.Sprintf("https://storage.googleapis.com/%v/playing_cards/back.png", bucket)
-			tf.IsHidden = false
-			filteredDice = append(filteredDice, tf)
+		if d, ok := tf.shownTo(fp); ok {
+			filteredDice = append(filteredDice, d)
 		}
 	}
 	p := Passer{
+		Room:              room,
 		Dice:              filteredDice,
 		RoomTotal:         roomTotal,
 		RoomAvg:           roomAvg,
@@ -2081,6 +2533,12 @@ func GetRoom(w http.ResponseWriter, r *http.Request) {
 		Modifier:          rm.Modifier,
 		ModifiedRollTotal: rollTotal + rm.Modifier,
 		TokenCount:        tokenCount,
+		Expression:        lastExpression,
+		Successes:         successes,
+		IsPool:            isPool,
+		FairSeedHash:      rm.FairSeedHash,
+		IsFair:            rm.isFair(),
+		Seq:               seq,
 	}
 	var latestUpdate int64
 	for _, v := range p.Dice {
@@ -2111,17 +2569,21 @@ func GetRoom(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+	return p
+}
+
+// parseRoomTemplate reads the room page, which also defines how a single die and the
+// totals are drawn.
+func parseRoomTemplate() (*template.Template, error) {
 	content, err := ioutil.ReadFile("room.tmpl.html")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
 	}
-	roomTemplate := template.Must(template.New("room").Funcs(template.FuncMap{
+	return template.New("room").Funcs(template.FuncMap{
 		"noescape": noescape,
 		"hidden":   hidden,
-	}).Parse(string(content[:])))
-	if err := roomTemplate.Execute(w, p); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+		"marks":    marks,
+	}).Parse(string(content[:]))
 }
 
 func SafetyRoom(w http.ResponseWriter, r *http.Request) {
@@ -2155,14 +2617,20 @@ func SafetyRoom(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, cookie)
 
 	var rm Room
+	var seq int64
 	k, err := datastore.DecodeKey(keyStr)
 	if err != nil {
 		log.Printf("room: could not decode room key %v: %v", keyStr, err)
 	} else {
-		err := dsClient.Get(c, k, &rm)
+		err := store.Get(c, k, &rm)
 		if err != nil {
 			log.Printf("could not find room: %v", err)
 		}
+		if u, ok, err := latestEvent(c, k); err != nil {
+			log.Printf("%v", err)
+		} else if ok {
+			seq = startSeq(keyStr, u.Seq)
+		}
 	}
 	content, err := ioutil.ReadFile("safety.tmpl.html")
 	if err != nil {
@@ -2171,8 +2639,9 @@ func SafetyRoom(w http.ResponseWriter, r *http.Request) {
 	roomTemplate := template.Must(template.New("safety").Funcs(template.FuncMap{
 		"noescape": noescape,
 		"hidden":   hidden,
+		"marks":    marks,
 	}).Parse(string(content[:])))
-	if err := roomTemplate.Execute(w, Passer{}); err != nil {
+	if err := roomTemplate.Execute(w, Passer{Room: room, Seq: seq}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -2188,6 +2657,21 @@ func hidden(h bool) string {
 	return ""
 }
 
+// marks returns the extra CSS classes for dice that were dropped or scored in a success pool.
+func marks(d Die) string {
+	out := ""
+	if d.IsDropped {
+		out += "dropped "
+	}
+	if d.IsSuccess {
+		out += "success "
+	}
+	if d.IsFailure {
+		out += "failure "
+	}
+	return out
+}
+
 func About(w http.ResponseWriter, _ *http.Request) {
 	if out, err := ioutil.ReadFile("about.html"); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -2197,7 +2681,7 @@ func About(w http.ResponseWriter, _ *http.Request) {
 }
 
 func shuffleDiscards(c context.Context, keyStr, deckName string) error {
-	_, err := dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
+	err := store.RunInTransaction(c, func(tx Transaction) error {
 		if deckName != "" {
 			cards, err := getRoomCustomCards(c, keyStr)
 			if err != nil {
@@ -2256,12 +2740,11 @@ func shuffleDiscards(c context.Context, keyStr, deckName string) error {
 					withCards = append(withCards, cc)
 				}
 			}
-			deck.Seed()
 			d, err := deck.New(deck.WithCards(withCards...))
 			if err != nil {
 				return err
 			}
-			d.Shuffle()
+			shuffleDeck(randomSourceFor(keyStr), d)
 			sig = d.GetSignature()
 			roomKey, err := datastore.DecodeKey(keyStr)
 			if err != nil {
@@ -2289,63 +2772,68 @@ func shuffleDiscards(c context.Context, keyStr, deckName string) error {
 
 func Shuffle(w http.ResponseWriter, r *http.Request) {
 	c := r.Context()
-	_ = r.ParseForm()
-	room := path.Base(r.Referer())
-	keyStr, err := getEncodedRoomKeyFromName(c, room)
-	if err != nil {
-		log.Printf("roomname wonkiness in shuffle: %v", err)
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
 	}
-	err = shuffleDiscards(c, keyStr, r.Form.Get("deck"))
-	if err != nil {
+	room := ref.Slug
+	if err := shuffleDiscards(c, ref.KeyStr, r.Form.Get("deck")); err != nil {
+		log.Printf("shuffle failed: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	fp := r.Form.Get("fp")
 	lastAction[room] = "shuffle"
-	updateRoom(c, keyStr, Update{Updater: fp, Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
+	updateRoom(c, ref.KeyStr, Update{Updater: fp, Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventShuffle}, 0)
 	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
 }
 
 func Draw(w http.ResponseWriter, r *http.Request) {
-	_ = r.ParseForm()
 	c := r.Context()
-	room := path.Base(r.Referer())
-	keyStr, err := getEncodedRoomKeyFromName(c, room)
-	if err != nil {
-		log.Printf("roomname wonkiness in draw: %v", err)
-	}
-	roomKey, err := datastore.DecodeKey(keyStr)
-	if err != nil {
-		log.Printf("draw: could not decode room key %v: %v", keyStr, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	ref, ok := postedRoom(w, r)
+	if !ok {
+		return
 	}
+	room, roomKey, keyStr := ref.Slug, ref.Key, ref.KeyStr
 	count, err := strconv.Atoi(r.Form.Get("count"))
 	if err != nil {
 		if r.Form.Get("count") == "" {
 			count = 1
 		} else {
 			log.Printf("error in draw: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 	}
 	fp := r.Form.Get("fp")
-	dice, keys := drawCards(c, count, roomKey, r.Form.Get("deck"), r.Form.Get("hidden"), fp)
+	dice, err := drawIntoRoom(c, count, roomKey, r.Form.Get("deck"), r.Form.Get("hidden"), fp)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%v", err)
 	}
-	_, err = dsClient.RunInTransaction(c, func(tx *datastore.Transaction) error {
-		_, err = tx.PutMulti(keys, dice)
-		if err != nil {
+	added := []string{}
+	for _, d := range dice {
+		added = append(added, d.KeyStr)
+	}
+	lastAction[room] = "draw"
+	updateRoom(c, keyStr, Update{Updater: fp, Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventDraw, DieKeys: added}, 0)
+	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+}
+
+// drawIntoRoom draws count cards from deckName, or the room's deck if it's empty, and
+// puts them on the table.
+func drawIntoRoom(c context.Context, count int, roomKey *datastore.Key, deckName, hidden, fp string) ([]*Die, error) {
+	dice, keys := drawCards(c, count, roomKey, deckName, hidden, fp)
+	err := store.RunInTransaction(c, func(tx Transaction) error {
+		if _, err := tx.PutMulti(keys, dice); err != nil {
 			return fmt.Errorf("could not create new dice: %v", err)
 		}
-		if err = tx.Get(roomKey, &Room{}); err != nil {
+		if err := tx.Get(roomKey, &Room{}); err != nil {
 			return fmt.Errorf("other error in draw: %v", err)
 		}
 		return nil
 	})
 	if err != nil {
-		log.Printf("%v", err)
+		return nil, err
 	}
-	lastAction[room] = "draw"
-	updateRoom(c, keyStr, Update{Updater: fp, Timestamp: time.Now().Unix(), UpdateAll: true}, 0)
-	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+	return dice, nil
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestDieKeysStayInTheirRoom(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	mine := datastore.IDKey("Room", 1, nil)
+	theirs := datastore.IDKey("Room", 2, nil)
+	k := datastore.IDKey("Die", 1, theirs)
+	if _, err := store.Put(c, k, &Die{IsCard: true, Size: "card", ResultStr: "Q♥", IsHidden: true, HiddenBy: "alice", KeyStr: k.Encode()}); err != nil {
+		t.Fatal(err)
+	}
+	for name, act := range map[string]func() error{
+		"updateDieLocation": func() error {
+			_, err := updateDieLocation(c, mine, k.Encode(), "bob", 1, 2, anyRevision)
+			return err
+		},
+		"revealDieHelper": func() error {
+			_, err := revealDieHelper(c, mine, k.Encode(), "alice", anyRevision)
+			return err
+		},
+		"hideDieHelper": func() error {
+			_, err := hideDieHelper(c, mine, k.Encode(), "bob", anyRevision)
+			return err
+		},
+		"rerollDieHelper": func() error {
+			_, err := rerollDieHelper(c, mine, k.Encode(), "Mine", "alice", false, anyRevision)
+			return err
+		},
+		"decrementClock":  func() error { return decrementClock(c, mine, k.Encode()) },
+		"deleteDieHelper": func() error { return deleteDieHelper(c, mine, k.Encode()) },
+	} {
+		err := act()
+		if ref, ok := err.(*refusal); !ok || ref.Code != http.StatusNotFound {
+			t.Errorf("%v() through another room == %v; want a 404 refusal", name, err)
+		}
+	}
+	var d Die
+	if err := store.Get(c, k, &d); err != nil || d.X != 0 || !d.IsHidden || d.Revision != 0 {
+		t.Errorf("die after acting on it through another room == %+v, %v; want it untouched", d, err)
+	}
+}
+
+func TestActionsNameTheirRoom(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: "BusyTable"}); err != nil {
+		t.Fatal(err)
+	}
+	k := datastore.IDKey("Die", 1, rk)
+	if _, err := store.Put(c, k, &Die{IsLabel: true, ResultStr: "goblin", KeyStr: k.Encode()}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		method, body string
+		want         int
+	}{
+		{"GET", "", http.StatusMethodNotAllowed},
+		{"POST", "", http.StatusBadRequest},
+		{"POST", "room=NoSuchTable", http.StatusNotFound},
+		{"POST", "room=BusyTable", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, "/clear", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		// The Referer is no longer trusted to say which room to act on.
+		req.Header.Set("Referer", "http://localhost/room/BusyTable")
+		w := httptest.NewRecorder()
+		Clear(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%v /clear %q == %v; want %v", tc.method, tc.body, w.Code, tc.want)
+		}
+		var d Die
+		if err := store.Get(c, k, &d); (err == nil) != (tc.want != http.StatusOK) {
+			t.Errorf("after %v /clear %q the label is there: %v; want it cleared only by the last request", tc.method, tc.body, err == nil)
+		}
+	}
+}
+
+func TestOneEventPerAction(t *testing.T) {
+	defer withMemoryStore()()
+	fakeDieSVGs(6)
+	room := apiTestRoom(t)
+	var rolled apiRollResult
+	callAPI(t, "POST", room+"/roll", map[string]interface{}{"Dice": map[string]int{"d6": 1}, "Clocks": map[string]string{"c4": "Alarm"}, "Fp": "alice"}, &rolled)
+	if len(rolled.Dice) != 2 {
+		t.Fatalf("rolled %+v; want a die and a clock", rolled)
+	}
+	for _, d := range rolled.Dice {
+		action := "/reroll"
+		if d.IsClock {
+			action = "/decrement"
+		}
+		if code := callAPI(t, "POST", room+"/dice/"+d.KeyStr+action, nil, nil); code != http.StatusOK {
+			t.Fatalf("POST %v == %v; want 200", action, code)
+		}
+	}
+	req := httptest.NewRequest("POST", "/clear", strings.NewReader("room="+strings.TrimPrefix(room, "/api/v1/rooms/")))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	Clear(httptest.NewRecorder(), req)
+
+	var events refreshResponse
+	callAPI(t, "GET", room+"/events?seq=0", nil, &events)
+	counts := map[string]int{}
+	for _, e := range events.Events {
+		counts[e.Type]++
+	}
+	// The roll, the reroll, the clock winding back and the clear.
+	if counts[eventRoll] != 2 || counts[eventClock] != 1 || counts[eventClear] != 1 {
+		t.Errorf("events == %v; want two rolls, one clock and one clear", counts)
+	}
+}
@@ -0,0 +1,345 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// A snapshot is a whole room as one JSON document, so tables can be backed up and
+// moved between rooms and instances.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/adamclerk/deck"
+)
+
+// snapshotVersion is bumped whenever a change to the format would trip up older importers.
+const snapshotVersion = 1
+
+// maxSnapshotBytes caps how big an import can be.
+const maxSnapshotBytes = 32 << 20
+
+type roomSnapshot struct {
+	Version  int
+	Exported int64
+	Room     snapshotRoom
+	// Deck is the signature of the cards left in the deck.
+	Deck       string
+	CustomSets CustomSets
+	Dice       []Die
+}
+
+// snapshotRoom has the Room fields worth carrying to another room. A fair session's
+// seed is only included once it has been revealed, and only so it can be checked:
+// importing leaves the fair fields behind.
+type snapshotRoom struct {
+	Slug          string
+	Timestamp     int64
+	BgURL         string
+	Modifier      int
+	FairSeedHash  string
+	FairSeed      []byte `json:",omitempty"`
+	FairRevealed  bool
+	FairNonce     int64
+	RevealedSeeds []string
+}
+
+// exportRoom snapshots the room with the given key as player fp sees it. Things hidden
+// by anyone else keep their place and hidden state but not their faces.
+func exportRoom(c context.Context, keyStr, fp string) (roomSnapshot, error) {
+	snap := roomSnapshot{Version: snapshotVersion, Exported: time.Now().Unix()}
+	k, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		return snap, fmt.Errorf("exportRoom: could not decode room key %v: %v", keyStr, err)
+	}
+	var r Room
+	if err := store.Get(c, k, &r); err != nil {
+		return snap, fmt.Errorf("could not get room %v to export: %v", keyStr, err)
+	}
+	snap.Room = snapshotRoom{
+		Slug:          r.Slug,
+		Timestamp:     r.Timestamp,
+		BgURL:         r.BgURL,
+		Modifier:      r.Modifier,
+		FairSeedHash:  r.FairSeedHash,
+		FairRevealed:  r.FairRevealed,
+		FairNonce:     r.FairNonce,
+		RevealedSeeds: r.RevealedSeeds,
+	}
+	if r.FairRevealed {
+		snap.Room.FairSeed = r.FairSeed
+	}
+	latest, ok, err := latestEvent(c, k)
+	if err != nil {
+		return snap, err
+	}
+	if ok {
+		snap.Room.Modifier = latest.Modifier
+	}
+	snap.Deck = r.Deck
+	if snap.CustomSets, err = r.GetCustomSets(); err != nil {
+		return snap, err
+	}
+	if snap.Dice, err = getRoomDice(c, keyStr, "Timestamp", "true"); err != nil {
+		return snap, err
+	}
+	for i, d := range snap.Dice {
+		if d.IsHidden && d.HiddenBy != fp {
+			// Their SVGs show their faces too, so seenBy drops those as well.
+			snap.Dice[i] = d.seenBy(fp)
+			continue
+		}
+		// SVG is rebuilt from SVGBytes when the room loads.
+		snap.Dice[i].SVG = ""
+	}
+	return snap, nil
+}
+
+// importRoom recreates a snapshot as a new room and returns the new room's slug.
+// Dice get new keys, and exploding chains are pointed at them. Snapshots come from
+// anyone, so every die is rebuilt from what it is rather than trusted, and a fair
+// session's record isn't carried over: nothing in the file proves it was ever run here.
+func importRoom(c context.Context, snap roomSnapshot) (string, error) {
+	if snap.Version < 1 || snap.Version > snapshotVersion {
+		return "", fmt.Errorf("can't import a version %v snapshot", snap.Version)
+	}
+	rk := roomKey()
+	slug := generateRoomName(3)
+	r := Room{
+		Timestamp: time.Now().Unix(),
+		Slug:      slug,
+		Deck:      snap.Deck,
+		BgURL:     snap.Room.BgURL,
+		Modifier:  snap.Room.Modifier,
+	}
+	if _, err := deck.New(deck.FromSignature(r.Deck)); r.Deck == "" || err != nil {
+		r.Deck = newRoomEntity(rk, slug).Deck
+	}
+	if snap.CustomSets != nil {
+		if err := r.SetCustomSets(snap.CustomSets); err != nil {
+			return "", fmt.Errorf("could not save custom sets: %v", err)
+		}
+	}
+
+	newKeys := map[string]string{}
+	keys := []*datastore.Key{}
+	dice := []*Die{}
+	for i, in := range snap.Dice {
+		k := dieKey(rk, int64(i))
+		d, err := importedDie(in, k, snap.CustomSets)
+		if err != nil {
+			log.Printf("leaving %v out of imported room %v: %v", in.KeyStr, slug, err)
+			continue
+		}
+		newKeys[in.KeyStr] = k.Encode()
+		keys = append(keys, k)
+		dice = append(dice, d)
+	}
+	for _, d := range dice {
+		if d.ExplodedFrom != "" {
+			d.ExplodedFrom = newKeys[d.ExplodedFrom]
+		}
+	}
+
+	if _, err := store.Put(c, rk, &r); err != nil {
+		return "", fmt.Errorf("could not create imported room: %v", err)
+	}
+	if err := putInBatches(c, keys, dice); err != nil {
+		return slug, fmt.Errorf("could not import everything into %v: %v", slug, err)
+	}
+	updateRoom(c, rk.Encode(), Update{Updater: "safari y u no work", Timestamp: time.Now().Unix(), UpdateAll: true, Type: eventImport}, r.Modifier)
+	return slug, nil
+}
+
+// importedDie rebuilds d from a snapshot as a new die under k. Only what the die is,
+// where it is and who hid it are taken from the snapshot; its SVG and images are made
+// here, and anything that isn't a die, card, clock, label, image or token the roller
+// could have made is refused.
+func importedDie(in Die, k *datastore.Key, sets CustomSets) (*Die, error) {
+	if in.Color != "" && svgColors[in.Color] == "" {
+		return nil, fmt.Errorf("unknown color %q", in.Color)
+	}
+	var d *Die
+	switch {
+	case in.IsClock:
+		segments, ok := clockSegments[in.Size]
+		if !ok || in.Result < 0 || in.Result >= segments {
+			return nil, fmt.Errorf("no %v clock showing %v", in.Size, in.Result)
+		}
+		d = &Die{Size: in.Size, Result: in.Result, ResultStr: in.ResultStr, IsClock: true,
+			Image: fmt.Sprintf("https://storage.googleapis.com/%v/die_images/clocks/%s-%d.png", bucket, in.Size, in.Result)}
+	case in.IsCustomItem:
+		set, ok := sets[in.CustomSetName]
+		if !ok || !hasValue(set.Template, in.Image) {
+			return nil, fmt.Errorf("%q isn't in custom set %q", in.Image, in.CustomSetName)
+		}
+		d = &Die{Size: "card", Result: in.Result, Image: in.Image, IsCard: true, IsCustomItem: true,
+			CustomSetName: in.CustomSetName, CustomHeight: set.MaxHeight, CustomWidth: set.MaxWidth}
+	case in.IsCard:
+		if _, ok := cardToPNG[in.ResultStr]; !ok {
+			return nil, fmt.Errorf("no card %q", in.ResultStr)
+		}
+		img, err := getDieImageURL("card", in.ResultStr, "")
+		if err != nil {
+			return nil, err
+		}
+		d = &Die{Size: "card", ResultStr: in.ResultStr, Image: img, IsCard: true}
+	case in.IsImage:
+		u, err := url.Parse(in.Image)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("image %q isn't an http or https URL", in.Image)
+		}
+		d = &Die{ResultStr: "image", Image: in.Image, IsImage: true,
+			CustomHeight: digitsOnly(in.CustomHeight), CustomWidth: digitsOnly(in.CustomWidth)}
+	case in.IsLabel && !in.IsFunky:
+		d = &Die{ResultStr: in.ResultStr, IsLabel: true}
+	default:
+		rs, err := importedResult(in.Size, in.Result)
+		if err != nil {
+			return nil, err
+		}
+		if d, err = newDie(k, in.Size, in.Result, rs, in.Color, in.Timestamp); err != nil {
+			return nil, err
+		}
+		if in.Size == "tokens" && svgColors[in.OldColor] != "" {
+			d.OldColor = in.OldColor
+		}
+		d.Expression, d.ExpressionTotal, d.IsDropped = in.Expression, in.ExpressionTotal, in.IsDropped
+		d.ExplodeRule, d.ExplodedFrom, d.IsPenetrated = in.ExplodeRule, in.ExplodedFrom, in.IsPenetrated
+		d.SuccessRule, d.IsSuccess, d.IsFailure = in.SuccessRule, in.IsSuccess, in.IsFailure
+		d.History, d.RerollRule = in.History, in.RerollRule
+	}
+	d.Key, d.KeyStr = k, k.Encode()
+	d.X, d.Y, d.Timestamp = in.X, in.Y, in.Timestamp
+	d.IsHidden, d.HiddenBy = in.IsHidden, in.HiddenBy
+	return d, nil
+}
+
+// importedResult checks result is something a die of size could show and returns how
+// it is written.
+func importedResult(size string, result int) (string, error) {
+	lo, hi := 1, 0
+	switch size {
+	case "tokens", "H":
+		lo, hi = 0, 1
+	case "F":
+		hi = 3
+	case "6p":
+		hi = 6
+	default:
+		hi, _ = strconv.Atoi(size)
+	}
+	if hi < 1 || result < lo || result > hi {
+		return "", fmt.Errorf("no d%v shows %v", size, result)
+	}
+	return strconv.Itoa(result), nil
+}
+
+func hasValue(m map[string]string, v string) bool {
+	for _, mv := range m {
+		if mv == v {
+			return true
+		}
+	}
+	return false
+}
+
+// digitsOnly is s if it is a number of pixels, or else nothing.
+func digitsOnly(s string) string {
+	if _, err := strconv.Atoi(s); err != nil {
+		return ""
+	}
+	return s
+}
+
+// Export serves the room as a snapshot download, as the player in the fp parameter
+// sees it.
+func Export(w http.ResponseWriter, r *http.Request, room string) {
+	c := r.Context()
+	keyStr, err := getEncodedRoomKeyFromName(c, room)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	snap, err := exportRoom(c, keyStr, r.FormValue("fp"))
+	if err != nil {
+		log.Printf("export failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", room+".json"))
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		log.Printf("could not write snapshot: %v", err)
+	}
+}
+
+// Import makes a new room from a snapshot, sent either as the request body or as the
+// "snapshot" file of a form. JSON requests get the new slug back; forms are sent to the room.
+func Import(w http.ResponseWriter, r *http.Request) {
+	c := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a snapshot to import it", http.StatusMethodNotAllowed)
+		return
+	}
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxSnapshotBytes)
+	isForm := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+	if isForm {
+		f, _, err := r.FormFile("snapshot")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("no snapshot file: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		body = io.LimitReader(f, maxSnapshotBytes)
+	}
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read snapshot: %v", err), http.StatusBadRequest)
+		return
+	}
+	var snap roomSnapshot
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		http.Error(w, fmt.Sprintf("could not parse snapshot: %v", err), http.StatusBadRequest)
+		return
+	}
+	slug, err := importRoom(c, snap)
+	if err != nil {
+		log.Printf("import failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isForm {
+		http.SetCookie(w, &http.Cookie{Name: "dice_room", Value: slug, SameSite: http.SameSiteLaxMode})
+		smartRedirect(w, r, fmt.Sprintf("/room/%v", slug), http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]string{"Slug": slug}); err != nil {
+		log.Printf("could not write import result: %v", err)
+	}
+}
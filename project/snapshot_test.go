@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestExportImportRoom(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	// Imported dice get their SVGs made again.
+	for i := 1; i <= 6; i++ {
+		previousSVGs[fmt.Sprintf("d6-%v-red", i)] = []byte("<svg></svg>")
+	}
+	rk := datastore.IDKey("Room", 1, nil)
+	r := Room{Slug: "OldTable", Deck: "AcTdKs", BgURL: "https://example.com/map.png", FairSeedHash: "abc", FairSeed: []byte("secret")}
+	cs := CustomSets{"loot": {Template: map[string]string{"sword": "s.png", "gold": "g.png"}, Instance: map[string]string{"gold": "g.png"}}}
+	if err := r.SetCustomSets(cs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put(c, rk, &r); err != nil {
+		t.Fatal(err)
+	}
+	parent := datastore.IDKey("Die", 1, rk)
+	child := datastore.IDKey("Die", 2, rk)
+	for k, d := range map[*datastore.Key]*Die{
+		parent: {Size: "6", Result: 6, X: 10, Y: 20, Color: "red", KeyStr: parent.Encode(), ExplodeRule: "!", Timestamp: 1},
+		child:  {Size: "6", Result: 2, IsHidden: true, HiddenBy: "fp", Color: "red", KeyStr: child.Encode(), ExplodedFrom: parent.Encode(), Timestamp: 1},
+	} {
+		if _, err := store.Put(c, k, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updateRoom(c, rk.Encode(), Update{Updater: "fp"}, 3)
+
+	// Everyone else gets the hidden die without its face.
+	snap, err := exportRoom(c, rk.Encode(), "someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range snap.Dice {
+		if d.IsHidden && (d.Result != 0 || d.HiddenBy != "fp") {
+			t.Errorf("exportRoom() for someone else has hidden die %+v; want it still hidden but without its face", d)
+		}
+	}
+	snap, err = exportRoom(c, rk.Encode(), "fp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Room.Modifier != 3 || snap.Deck != "AcTdKs" || len(snap.CustomSets["loot"].Instance) != 1 || len(snap.Dice) != 2 {
+		t.Errorf("exportRoom() == %+v; want the modifier, deck, custom set and both dice", snap)
+	}
+	if snap.Room.FairSeed != nil {
+		t.Errorf("exportRoom() included the seed of an unrevealed fair session")
+	}
+
+	raw, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	Import(w, httptest.NewRequest("POST", "/import", bytes.NewReader(raw)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Import() == %v %v; want 201", w.Code, w.Body)
+	}
+	var res struct{ Slug string }
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Slug == "" || res.Slug == "OldTable" {
+		t.Errorf("imported room slug == %q; want a new one", res.Slug)
+	}
+	keyStr, err := getEncodedRoomKeyFromName(c, res.Slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := exportRoom(c, keyStr, "fp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Room.BgURL != r.BgURL || got.Room.Modifier != 3 || got.Deck != "AcTdKs" || len(got.CustomSets["loot"].Template) != 2 {
+		t.Errorf("imported room == %+v; want the exported room's background, modifier, deck and custom sets", got.Room)
+	}
+	if got.Room.FairSeedHash != "" {
+		t.Errorf("imported room kept an unrevealed fair session")
+	}
+	var kept, exploded *Die
+	for i, d := range got.Dice {
+		if d.KeyStr == parent.Encode() || d.KeyStr == child.Encode() {
+			t.Errorf("imported die %+v kept its old key", d)
+		}
+		if d.ExplodeRule != "" {
+			kept = &got.Dice[i]
+		} else {
+			exploded = &got.Dice[i]
+		}
+	}
+	if kept == nil || exploded == nil {
+		t.Fatalf("imported dice == %+v; want the exploding die and its chain", got.Dice)
+	}
+	if kept.X != 10 || kept.Y != 20 || kept.Color != "red" || !exploded.IsHidden || exploded.HiddenBy != "fp" || exploded.Result != 2 {
+		t.Errorf("imported dice == %+v and %+v; want positions, colors and hidden state kept", kept, exploded)
+	}
+	if exploded.ExplodedFrom != kept.KeyStr {
+		t.Errorf("imported chain points at %v; want the imported parent %v", exploded.ExplodedFrom, kept.KeyStr)
+	}
+}
+
+func TestImportRebuildsDice(t *testing.T) {
+	defer withMemoryStore()()
+	fakeDieSVGs(6)
+	c := context.Background()
+	script := "<script>alert(document.cookie)</script>"
+	snap := roomSnapshot{
+		Version: snapshotVersion,
+		Room:    snapshotRoom{FairSeedHash: "forged", FairSeed: []byte("seed"), FairRevealed: true, FairNonce: 9, RevealedSeeds: []string{"abcd"}},
+		Dice: []Die{
+			{KeyStr: "a", Size: "6", Result: 3, SVGBytes: []byte(script), Image: "javascript:alert(1)", SVGPath: script, Nonce: 4, SeedHash: "forged", X: 7},
+			{KeyStr: "b", Size: "6", Result: 9},
+			{KeyStr: "c", Size: "<svg onload=alert(1)>", Result: 1},
+			{KeyStr: "d", IsCard: true, Size: "card", ResultStr: script},
+			{KeyStr: "e", IsImage: true, Image: "javascript:alert(1)"},
+			{KeyStr: "f", IsClock: true, Size: "c4", Result: 2, Image: "javascript:alert(1)"},
+			{KeyStr: "g", Size: "6", Result: 1, Color: script},
+		},
+	}
+	raw, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	Import(w, httptest.NewRequest("POST", "/import", bytes.NewReader(raw)))
+	var res struct{ Slug string }
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("Import() == %v, %v; want 201", w.Code, err)
+	}
+	keyStr, err := getEncodedRoomKeyFromName(c, res.Slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rk, _ := datastore.DecodeKey(keyStr)
+	var r Room
+	if err := store.Get(c, rk, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.FairSeedHash != "" || r.FairSeed != nil || r.FairRevealed || r.FairNonce != 0 || len(r.RevealedSeeds) != 0 {
+		t.Errorf("imported room == %+v; want no fair session record", r)
+	}
+	dice, err := getRoomDice(c, keyStr, "Timestamp", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dice) != 2 {
+		t.Fatalf("imported %+v; want just the d6 and the clock", dice)
+	}
+	for _, d := range dice {
+		if strings.Contains(fmt.Sprintf("%+v %s", d, d.SVGBytes), "script") || strings.Contains(d.Image, "javascript") {
+			t.Errorf("imported die %+v kept the snapshot's markup", d)
+		}
+		if d.IsClock {
+			continue
+		}
+		if string(d.SVGBytes) != "<svg></svg>" || d.SVGPath != "/js/d6.svg" || d.Nonce != 0 || d.SeedHash != "" || d.X != 7 {
+			t.Errorf("imported d6 == %+v; want it rebuilt where it was, with no nonce", d)
+		}
+	}
+}
+
+func TestImportRejectsUnknownVersion(t *testing.T) {
+	defer withMemoryStore()()
+	if _, err := importRoom(context.Background(), roomSnapshot{Version: snapshotVersion + 1}); err == nil {
+		t.Errorf("importRoom() of a snapshot from the future == nil; want an error")
+	}
+}
@@ -0,0 +1,138 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Room events as Server-Sent Events, for clients that would rather not speak
+// WebSocket. Every event carries its sequence number as its id, so a reconnecting
+// EventSource picks up where it left off.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	// sseRetry tells browsers how long to wait before reconnecting, in milliseconds.
+	sseRetry = 3000
+	// sseKeepalive keeps proxies from closing quiet streams.
+	sseKeepalive = 15 * time.Second
+)
+
+// eventName is what u is called in the stream. Events from before types existed are
+// plain updates.
+func (u Update) eventName() string {
+	if u.Type == "" {
+		return "update"
+	}
+	return u.Type
+}
+
+// streamStart is the seq to stream from: the Last-Event-ID header a reconnecting
+// EventSource sends, or a lastEventId or seq parameter. New streams start from now.
+func streamStart(r *http.Request, latest func() int64) int64 {
+	for _, v := range []string{r.Header.Get("Last-Event-ID"), r.Form.Get("lastEventId"), r.Form.Get("seq")} {
+		if seq, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return seq
+		}
+	}
+	return latest()
+}
+
+// RoomEventStream streams the room's events as text/event-stream. Each event's name is
+// its type and its data is the event as JSON; presence events also list the players.
+// Passing fp leaves out that player's own changes, as /refresh does, and counts them
+// as at the table.
+func RoomEventStream(w http.ResponseWriter, r *http.Request, room string) {
+	c := r.Context()
+	_ = r.ParseForm()
+	keyStr, err := getEncodedRoomKeyFromName(c, room)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	roomKey, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported here", http.StatusInternalServerError)
+		return
+	}
+	fp := r.Form.Get("fp")
+	seq := streamStart(r, func() int64 {
+		u, _, err := latestEvent(c, roomKey)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+		return startSeq(keyStr, u.Seq)
+	})
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry)
+	flusher.Flush()
+
+	send := func(u Update) error {
+		if fp != "" && !u.visibleTo(fp) {
+			return nil
+		}
+		out := u.forPlayers(roomKey.Encode())
+		var data interface{} = out
+		if u.Type == eventPresence {
+			players, err := roomPlayers(c, roomKey, time.Now())
+			if err != nil {
+				log.Printf("could not see who is in %v: %v", room, err)
+			}
+			data = struct {
+				Update
+				Players []Player
+			}{out, players}
+		}
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", u.Seq, u.eventName(), b); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	notePresence(c, roomKey, fp, false, time.Now())
+	keepalive := func() error {
+		notePresence(c, roomKey, fp, false, time.Now())
+		if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	// A stream that fell behind just ends; the browser reconnects with Last-Event-ID.
+	_ = follow(c, roomKey, seq, sseKeepalive, send, keepalive, c.Done())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type sseEvent struct {
+	ID, Name string
+	Data     Update
+	Players  []Player
+}
+
+// readEvent reads the next event from the stream, skipping comments and retry lines.
+func readEvent(t *testing.T, br *bufio.Reader) sseEvent {
+	var ev sseEvent
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && ev.ID != "":
+			return ev
+		case strings.HasPrefix(line, "id: "):
+			ev.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.Name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var data struct {
+				Update
+				Players []Player
+			}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+				t.Fatal(err)
+			}
+			ev.Data, ev.Players = data.Update, data.Players
+		}
+	}
+}
+
+func TestRoomEventStream(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: "StreamTable"}); err != nil {
+		t.Fatal(err)
+	}
+	updateRoom(c, rk.Encode(), Update{Updater: "bob", Type: eventRoll}, 0)
+	first, _, err := latestEvent(c, rk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateRoom(c, rk.Encode(), Update{Updater: "alice", Type: eventMove, DieKey: "die"}, 0)
+	updateRoom(c, rk.Encode(), Update{Message: "X card", Type: eventAlert}, 0)
+
+	srv := httptest.NewServer(http.HandlerFunc(RoomRouter))
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"/room/StreamTable/events?fp=alice", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(first.Seq, 10))
+	ctx, cancel := context.WithTimeout(c, 5*time.Second)
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type == %q; want text/event-stream", ct)
+	}
+	br := bufio.NewReader(resp.Body)
+
+	// Alice's own move is left out, and the roll before Last-Event-ID was already seen.
+	ev := readEvent(t, br)
+	if ev.Name != eventAlert || ev.Data.Message != "X card" || ev.ID != strconv.FormatInt(ev.Data.Seq, 10) {
+		t.Errorf("first event == %+v; want the X card alert", ev)
+	}
+	ev = readEvent(t, br)
+	if ev.Name != eventPresence || len(ev.Players) != 1 || ev.Players[0].ID != playerID(rk.Encode(), "alice") {
+		t.Errorf("second event == %+v; want alice arriving", ev)
+	}
+	if ev.Data.Updater != playerID(rk.Encode(), "alice") {
+		t.Errorf("second event updater == %q; want alice's player ID", ev.Data.Updater)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, ok := roomEvents.following(rk.Encode()); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream never followed the room")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	updateRoom(c, rk.Encode(), Update{Updater: "bob", Type: eventReveal, DieKey: "card"}, 0)
+	ev = readEvent(t, br)
+	if ev.Name != eventReveal || ev.Data.DieKey != "card" {
+		t.Errorf("live event == %+v; want bob's reveal", ev)
+	}
+}
+
+func TestStreamStart(t *testing.T) {
+	latest := func() int64 { return 99 }
+	for _, tc := range []struct {
+		header, query string
+		want          int64
+	}{
+		{"", "", 99},
+		{"12", "seq=5", 12},
+		{"", "lastEventId=7", 7},
+		{"", "seq=0", 0},
+	} {
+		r := httptest.NewRequest("GET", "/room/x/events?"+tc.query, nil)
+		if tc.header != "" {
+			r.Header.Set("Last-Event-ID", tc.header)
+		}
+		_ = r.ParseForm()
+		if got := streamStart(r, latest); got != tc.want {
+			t.Errorf("streamStart(%q, %q) == %v; want %v", tc.header, tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestLegacyEventName(t *testing.T) {
+	if got := (Update{}).eventName(); got != "update" {
+		t.Errorf("untyped event is named %q; want update", got)
+	}
+}
@@ -0,0 +1,146 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Store is where rooms, dice and everything else the app keeps are saved. Entities are
+// addressed by datastore keys on every backend so keys handed to clients keep working.
+type Store interface {
+	// Get loads the entity at k into dst, returning datastore.ErrNoSuchEntity if there is none.
+	Get(c context.Context, k *datastore.Key, dst interface{}) error
+	Put(c context.Context, k *datastore.Key, src interface{}) (*datastore.Key, error)
+	Delete(c context.Context, k *datastore.Key) error
+	// GetAll runs q and appends the results to dst, a pointer to a slice of structs. dst
+	// is ignored (and may be nil) for keys only queries.
+	GetAll(c context.Context, q *Query, dst interface{}) ([]*datastore.Key, error)
+	// RunInTransaction runs f in a transaction, retrying it if it conflicts with another one.
+	RunInTransaction(c context.Context, f func(tx Transaction) error) error
+	Close() error
+}
+
+// Transaction is the view of a Store inside RunInTransaction. As with Datastore, reads
+// don't see the transaction's own writes.
+type Transaction interface {
+	Get(k *datastore.Key, dst interface{}) error
+	Put(k *datastore.Key, src interface{}) (*datastore.Key, error)
+	// PutMulti stores src, a slice of structs or struct pointers, under keys.
+	PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)
+	Delete(k *datastore.Key) error
+	DeleteMulti(keys []*datastore.Key) error
+}
+
+// store is the Store every handler uses; main picks it with the -store flag.
+var store Store
+
+// Query describes a query in terms every backend understands. It is built the same way
+// as a datastore.Query.
+type Query struct {
+	kind     string
+	ancestor *datastore.Key
+	filters  []queryFilter
+	// orders are field names, with a leading "-" for descending order.
+	orders   []string
+	limit    int
+	keysOnly bool
+}
+
+// queryFilter compares a field against a value with one of =, <, <=, > or >=.
+type queryFilter struct {
+	field string
+	op    string
+	value interface{}
+}
+
+func NewQuery(kind string) *Query {
+	return &Query{kind: kind}
+}
+
+func (q *Query) clone() *Query {
+	out := *q
+	out.filters = append([]queryFilter(nil), q.filters...)
+	out.orders = append([]string(nil), q.orders...)
+	return &out
+}
+
+// Ancestor limits the query to k and its descendants.
+func (q *Query) Ancestor(k *datastore.Key) *Query {
+	out := q.clone()
+	out.ancestor = k
+	return out
+}
+
+// Filter adds a filter written like "Slug =" or "Timestamp <".
+func (q *Query) Filter(filterStr string, value interface{}) *Query {
+	out := q.clone()
+	f := queryFilter{value: value}
+	filterStr = strings.TrimSpace(filterStr)
+	for _, op := range []string{"<=", ">=", "=", "<", ">"} {
+		if strings.HasSuffix(filterStr, op) {
+			f.field = strings.TrimSpace(strings.TrimSuffix(filterStr, op))
+			f.op = op
+			break
+		}
+	}
+	if f.op == "" {
+		f.field, f.op = filterStr, "="
+	}
+	out.filters = append(out.filters, f)
+	return out
+}
+
+func (q *Query) Order(fieldName string) *Query {
+	out := q.clone()
+	out.orders = append(out.orders, fieldName)
+	return out
+}
+
+func (q *Query) Limit(n int) *Query {
+	out := q.clone()
+	out.limit = n
+	return out
+}
+
+func (q *Query) KeysOnly() *Query {
+	out := q.clone()
+	out.keysOnly = true
+	return out
+}
+
+// openStore sets up the backend named by a -store style setting: "datastore" (the
+// default), "memory", or "bolt:<path>" for a single file on local disk.
+func openStore(c context.Context, setting, projectID string) (Store, error) {
+	switch {
+	case setting == "" || setting == "datastore":
+		client, err := datastore.NewClient(c, projectID)
+		if err != nil {
+			return nil, err
+		}
+		return &datastoreStore{client: client}, nil
+	case setting == "memory":
+		return newMemoryStore(), nil
+	case strings.HasPrefix(setting, "bolt:"):
+		return openBoltStore(strings.TrimPrefix(setting, "bolt:"))
+	}
+	return nil, fmt.Errorf("unknown store %q", setting)
+}
@@ -0,0 +1,172 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBackend keeps entities in a single BoltDB file, so the roller can run on one
+// machine without any Google services. Each kind has a bucket, holding a bucket for
+// each entity group.
+type boltBackend struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*localStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open %v: %v", path, err)
+	}
+	if err := db.Update(groupEntities); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not group the entities in %v: %v", path, err)
+	}
+	return &localStore{backend: &boltBackend{db: db}}, nil
+}
+
+// groupEntities moves entities from files written before entity groups had buckets,
+// which kept them straight in their kind's bucket, into their group's bucket.
+func groupEntities(tx *bolt.Tx) error {
+	return tx.ForEach(func(kind []byte, b *bolt.Bucket) error {
+		loose := map[string][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			// Group buckets have no value.
+			if v != nil {
+				loose[string(k)] = append([]byte(nil), v...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, v := range loose {
+			key, err := datastore.DecodeKey(k)
+			if err != nil {
+				return fmt.Errorf("could not read key %q in %s: %v", k, kind, err)
+			}
+			// A room's own key names its group, so it has to go before the group can come.
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+			group, err := b.CreateBucketIfNotExists([]byte(entityGroup(key)))
+			if err != nil {
+				return err
+			}
+			if err := group.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// groupBucket is the bucket k is kept in, or nil if there isn't one.
+func groupBucket(tx *bolt.Tx, k *datastore.Key) *bolt.Bucket {
+	kind := tx.Bucket([]byte(k.Kind))
+	if kind == nil {
+		return nil
+	}
+	return kind.Bucket([]byte(entityGroup(k)))
+}
+
+func (b *boltBackend) load(k *datastore.Key) (localEntity, bool, error) {
+	var e localEntity
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := groupBucket(tx, k)
+		if bucket == nil {
+			return nil
+		}
+		v := bucket.Get([]byte(k.Encode()))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &e)
+	})
+	return e, found, err
+}
+
+func (b *boltBackend) scan(kind string, ancestor *datastore.Key, fn func(localEntity) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kind))
+		if bucket == nil {
+			return nil
+		}
+		each := func(group *bolt.Bucket) error {
+			return group.ForEach(func(_, v []byte) error {
+				var e localEntity
+				if err := json.Unmarshal(v, &e); err != nil {
+					return err
+				}
+				return fn(e)
+			})
+		}
+		if ancestor != nil {
+			group := bucket.Bucket([]byte(entityGroup(ancestor)))
+			if group == nil {
+				return nil
+			}
+			return each(group)
+		}
+		return bucket.ForEach(func(name, _ []byte) error {
+			return each(bucket.Bucket(name))
+		})
+	})
+}
+
+func (b *boltBackend) commit(puts []localEntity, deletes []*datastore.Key) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, p := range puts {
+			kind, err := tx.CreateBucketIfNotExists([]byte(p.Key.Kind))
+			if err != nil {
+				return err
+			}
+			bucket, err := kind.CreateBucketIfNotExists([]byte(entityGroup(p.Key)))
+			if err != nil {
+				return err
+			}
+			v, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(p.Key.Encode()), v); err != nil {
+				return err
+			}
+		}
+		for _, k := range deletes {
+			bucket := groupBucket(tx, k)
+			if bucket == nil {
+				continue
+			}
+			if err := bucket.Delete([]byte(k.Encode())); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltBackend) close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,99 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+// datastoreStore keeps everything in Cloud Datastore (or its emulator).
+type datastoreStore struct {
+	client *datastore.Client
+}
+
+func (s *datastoreStore) Get(c context.Context, k *datastore.Key, dst interface{}) error {
+	return s.client.Get(c, k, dst)
+}
+
+func (s *datastoreStore) Put(c context.Context, k *datastore.Key, src interface{}) (*datastore.Key, error) {
+	return s.client.Put(c, k, src)
+}
+
+func (s *datastoreStore) Delete(c context.Context, k *datastore.Key) error {
+	return s.client.Delete(c, k)
+}
+
+func (s *datastoreStore) GetAll(c context.Context, q *Query, dst interface{}) ([]*datastore.Key, error) {
+	dq := datastore.NewQuery(q.kind)
+	if q.ancestor != nil {
+		dq = dq.Ancestor(q.ancestor)
+	}
+	for _, f := range q.filters {
+		dq = dq.Filter(f.field+" "+f.op, f.value)
+	}
+	for _, o := range q.orders {
+		dq = dq.Order(o)
+	}
+	if q.limit > 0 {
+		dq = dq.Limit(q.limit)
+	}
+	if q.keysOnly {
+		dq = dq.KeysOnly()
+		dst = nil
+	}
+	return s.client.GetAll(c, dq, dst)
+}
+
+func (s *datastoreStore) RunInTransaction(c context.Context, f func(tx Transaction) error) error {
+	_, err := s.client.RunInTransaction(c, func(tx *datastore.Transaction) error {
+		return f(datastoreTransaction{tx})
+	})
+	return err
+}
+
+func (s *datastoreStore) Close() error {
+	return s.client.Close()
+}
+
+type datastoreTransaction struct {
+	tx *datastore.Transaction
+}
+
+func (t datastoreTransaction) Get(k *datastore.Key, dst interface{}) error {
+	return t.tx.Get(k, dst)
+}
+
+// Put returns k itself; Datastore only settles incomplete keys on commit and we never use them.
+func (t datastoreTransaction) Put(k *datastore.Key, src interface{}) (*datastore.Key, error) {
+	_, err := t.tx.Put(k, src)
+	return k, err
+}
+
+func (t datastoreTransaction) PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	_, err := t.tx.PutMulti(keys, src)
+	return keys, err
+}
+
+func (t datastoreTransaction) Delete(k *datastore.Key) error {
+	return t.tx.Delete(k)
+}
+
+func (t datastoreTransaction) DeleteMulti(keys []*datastore.Key) error {
+	return t.tx.DeleteMulti(keys)
+}
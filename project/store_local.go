@@ -0,0 +1,507 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// The memory and bolt stores share everything but where the bytes live: entities are
+// kept as JSON next to a version number, grouped by kind and then by the key at the
+// root of theirs, as Datastore groups them. Queries are answered by scanning a kind, or
+// just one group of it when they have an ancestor, so reading a room's dice doesn't
+// read every room's. Transactions are optimistic, like Datastore's, failing on commit
+// if something they read has changed since.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// localEntity is a stored entity along with the version used to detect conflicts.
+type localEntity struct {
+	Key     *datastore.Key
+	Version int64
+	Data    json.RawMessage
+}
+
+// localBackend holds the entities for a localStore. localStore serializes commits,
+// so backends only need to be safe for concurrent reads.
+type localBackend interface {
+	load(k *datastore.Key) (localEntity, bool, error)
+	// scan calls fn for every entity of the given kind, or only those in the entity
+	// group of ancestor when it isn't nil.
+	scan(kind string, ancestor *datastore.Key, fn func(localEntity) error) error
+	commit(puts []localEntity, deletes []*datastore.Key) error
+	close() error
+}
+
+type localStore struct {
+	mu      sync.RWMutex
+	backend localBackend
+}
+
+// localTransactionAttempts matches the number of times Datastore tries a transaction.
+const localTransactionAttempts = 3
+
+func (s *localStore) Get(c context.Context, k *datastore.Key, dst interface{}) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok, err := s.backend.load(k)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	return json.Unmarshal(e.Data, dst)
+}
+
+func (s *localStore) Put(c context.Context, k *datastore.Key, src interface{}) (*datastore.Key, error) {
+	err := s.RunInTransaction(c, func(tx Transaction) error {
+		_, err := tx.Put(k, src)
+		return err
+	})
+	return k, err
+}
+
+func (s *localStore) Delete(c context.Context, k *datastore.Key) error {
+	return s.RunInTransaction(c, func(tx Transaction) error {
+		return tx.Delete(k)
+	})
+}
+
+// localMatch is a query result waiting to be sorted.
+type localMatch struct {
+	entity localEntity
+	fields map[string]interface{}
+}
+
+func (s *localStore) GetAll(c context.Context, q *Query, dst interface{}) ([]*datastore.Key, error) {
+	matches := []localMatch{}
+	s.mu.RLock()
+	err := s.backend.scan(q.kind, q.ancestor, func(e localEntity) error {
+		if q.ancestor != nil && !hasAncestor(e.Key, q.ancestor) {
+			return nil
+		}
+		fields, err := decodeFields(e.Data)
+		if err != nil {
+			return fmt.Errorf("could not read %v: %v", e.Key, err)
+		}
+		for _, f := range q.filters {
+			if !matchesFilter(fields[f.field], f) {
+				return nil
+			}
+		}
+		matches = append(matches, localMatch{e, fields})
+		return nil
+	})
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		for _, o := range q.orders {
+			desc := strings.HasPrefix(o, "-")
+			o = strings.TrimPrefix(o, "-")
+			cmp := compareValues(matches[i].fields[o], matches[j].fields[o])
+			if cmp != 0 {
+				return (cmp < 0) != desc
+			}
+		}
+		return matches[i].entity.Key.Encode() < matches[j].entity.Key.Encode()
+	})
+	if q.limit > 0 && len(matches) > q.limit {
+		matches = matches[:q.limit]
+	}
+	keys := make([]*datastore.Key, len(matches))
+	for i, m := range matches {
+		keys[i] = m.entity.Key
+	}
+	if q.keysOnly || dst == nil {
+		return keys, nil
+	}
+	sv := reflect.ValueOf(dst)
+	if sv.Kind() != reflect.Ptr || sv.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("GetAll needs a pointer to a slice, not %T", dst)
+	}
+	slice := sv.Elem()
+	elemType := slice.Type().Elem()
+	for _, m := range matches {
+		ptr := elemType.Kind() == reflect.Ptr
+		var v reflect.Value
+		if ptr {
+			v = reflect.New(elemType.Elem())
+		} else {
+			v = reflect.New(elemType)
+		}
+		if err := json.Unmarshal(m.entity.Data, v.Interface()); err != nil {
+			return nil, fmt.Errorf("could not load %v: %v", m.entity.Key, err)
+		}
+		if !ptr {
+			v = v.Elem()
+		}
+		slice = reflect.Append(slice, v)
+	}
+	sv.Elem().Set(slice)
+	return keys, nil
+}
+
+func (s *localStore) RunInTransaction(c context.Context, f func(tx Transaction) error) error {
+	for i := 0; i < localTransactionAttempts; i++ {
+		tx := &localTransaction{s: s, reads: map[string]localRead{}}
+		if err := f(tx); err != nil {
+			return err
+		}
+		err := s.commit(tx)
+		if err != datastore.ErrConcurrentTransaction {
+			return err
+		}
+	}
+	return datastore.ErrConcurrentTransaction
+}
+
+func (s *localStore) commit(tx *localTransaction) error {
+	if len(tx.puts) == 0 && len(tx.deletes) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range tx.reads {
+		e, _, err := s.backend.load(r.key)
+		if err != nil {
+			return err
+		}
+		if e.Version != r.version {
+			return datastore.ErrConcurrentTransaction
+		}
+	}
+	puts := []localEntity{}
+	for _, key := range tx.order {
+		p, ok := tx.puts[key]
+		if !ok {
+			continue
+		}
+		e, _, err := s.backend.load(p.Key)
+		if err != nil {
+			return err
+		}
+		p.Version = e.Version + 1
+		puts = append(puts, p)
+	}
+	deletes := []*datastore.Key{}
+	for _, k := range tx.deletes {
+		deletes = append(deletes, k)
+	}
+	return s.backend.commit(puts, deletes)
+}
+
+func (s *localStore) Close() error {
+	return s.backend.close()
+}
+
+type localTransaction struct {
+	s       *localStore
+	reads   map[string]localRead
+	puts    map[string]localEntity
+	deletes map[string]*datastore.Key
+	// order keeps puts in the order they were made.
+	order []string
+}
+
+// localRead is the version of an entity a transaction read, 0 if it didn't exist.
+type localRead struct {
+	key     *datastore.Key
+	version int64
+}
+
+func (t *localTransaction) Get(k *datastore.Key, dst interface{}) error {
+	t.s.mu.RLock()
+	defer t.s.mu.RUnlock()
+	e, ok, err := t.s.backend.load(k)
+	if err != nil {
+		return err
+	}
+	t.reads[k.Encode()] = localRead{k, e.Version}
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	return json.Unmarshal(e.Data, dst)
+}
+
+func (t *localTransaction) Put(k *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if k == nil || k.Incomplete() {
+		return nil, datastore.ErrInvalidKey
+	}
+	data, err := json.Marshal(src)
+	if err != nil {
+		return nil, fmt.Errorf("could not store %v: %v", k, err)
+	}
+	key := k.Encode()
+	if t.puts == nil {
+		t.puts = map[string]localEntity{}
+	}
+	if _, ok := t.puts[key]; !ok {
+		t.order = append(t.order, key)
+	}
+	t.puts[key] = localEntity{Key: k, Data: data}
+	delete(t.deletes, key)
+	return k, nil
+}
+
+func (t *localTransaction) PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, fmt.Errorf("PutMulti needs a slice with one entity per key")
+	}
+	for i, k := range keys {
+		if _, err := t.Put(k, v.Index(i).Interface()); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func (t *localTransaction) Delete(k *datastore.Key) error {
+	key := k.Encode()
+	if t.deletes == nil {
+		t.deletes = map[string]*datastore.Key{}
+	}
+	t.deletes[key] = k
+	delete(t.puts, key)
+	return nil
+}
+
+func (t *localTransaction) DeleteMulti(keys []*datastore.Key) error {
+	for _, k := range keys {
+		if err := t.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasAncestor reports whether a is k or one of its parents.
+// entityGroup names the group k is stored in: the key at the root of k.
+func entityGroup(k *datastore.Key) string {
+	for k.Parent != nil {
+		k = k.Parent
+	}
+	return k.Encode()
+}
+
+func hasAncestor(k, a *datastore.Key) bool {
+	for ; k != nil; k = k.Parent {
+		if k.Equal(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeFields(data []byte) (map[string]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	out := map[string]interface{}{}
+	err := d.Decode(&out)
+	return out, err
+}
+
+// matchesFilter applies f to a field value; as with Datastore, a list matches if any
+// of its elements do.
+func matchesFilter(v interface{}, f queryFilter) bool {
+	if list, ok := v.([]interface{}); ok {
+		for _, e := range list {
+			if matchesFilter(e, f) {
+				return true
+			}
+		}
+		return false
+	}
+	if v == nil {
+		return false
+	}
+	cmp := compareValues(v, f.value)
+	switch f.op {
+	case "=":
+		return cmp == 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compareValues orders decoded JSON values against each other or against the Go
+// values used in filters. Values of different types order nil, bools, numbers, strings.
+func compareValues(a, b interface{}) int {
+	ra, rb := valueRank(a), valueRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+	switch ra {
+	case 1:
+		ba, bb := a.(bool), b.(bool)
+		if ba == bb {
+			return 0
+		}
+		if !ba {
+			return -1
+		}
+		return 1
+	case 2:
+		ia, aInt := toInt(a)
+		ib, bInt := toInt(b)
+		if aInt && bInt {
+			switch {
+			case ia < ib:
+				return -1
+			case ia > ib:
+				return 1
+			}
+			return 0
+		}
+		fa, fb := toFloat(a), toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case 3:
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	}
+	return 0
+}
+
+func valueRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case json.Number, int, int32, int64, float32, float64:
+		return 2
+	}
+	return 3
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		i, err := strconv.ParseInt(string(n), 10, 64)
+		return i, err == nil
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case json.Number:
+		f, _ := n.Float64()
+		return f
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// memoryBackend keeps entities in maps; everything is lost when the process exits.
+type memoryBackend struct {
+	// kinds has each kind's entities by group and then key.
+	kinds map[string]map[string]map[string]localEntity
+}
+
+func newMemoryStore() *localStore {
+	return &localStore{backend: &memoryBackend{kinds: map[string]map[string]map[string]localEntity{}}}
+}
+
+func (m *memoryBackend) load(k *datastore.Key) (localEntity, bool, error) {
+	e, ok := m.kinds[k.Kind][entityGroup(k)][k.Encode()]
+	return e, ok, nil
+}
+
+func (m *memoryBackend) scan(kind string, ancestor *datastore.Key, fn func(localEntity) error) error {
+	groups := m.kinds[kind]
+	if ancestor != nil {
+		g := entityGroup(ancestor)
+		groups = map[string]map[string]localEntity{g: groups[g]}
+	}
+	for _, group := range groups {
+		for _, e := range group {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) commit(puts []localEntity, deletes []*datastore.Key) error {
+	for _, p := range puts {
+		groups := m.kinds[p.Key.Kind]
+		if groups == nil {
+			groups = map[string]map[string]localEntity{}
+			m.kinds[p.Key.Kind] = groups
+		}
+		g := entityGroup(p.Key)
+		if groups[g] == nil {
+			groups[g] = map[string]localEntity{}
+		}
+		groups[g][p.Key.Encode()] = p
+	}
+	for _, k := range deletes {
+		g := entityGroup(k)
+		delete(m.kinds[k.Kind][g], k.Encode())
+		if len(m.kinds[k.Kind][g]) == 0 {
+			delete(m.kinds[k.Kind], g)
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) close() error {
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	bolt "go.etcd.io/bbolt"
+)
+
+func localStores(t *testing.T) (map[string]Store, func()) {
+	dir, err := ioutil.TempDir("", "roller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := openBoltStore(filepath.Join(dir, "roller.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{"memory": newMemoryStore(), "bolt": bs}, func() {
+		_ = bs.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestLocalStoreGetPut(t *testing.T) {
+	c := context.Background()
+	stores, done := localStores(t)
+	defer done()
+	for name, s := range stores {
+		rk := datastore.IDKey("Room", 1, nil)
+		var r Room
+		if err := s.Get(c, rk, &r); err != datastore.ErrNoSuchEntity {
+			t.Errorf("%v: Get of a missing room == %v; want ErrNoSuchEntity", name, err)
+		}
+		if _, err := s.Put(c, rk, &Room{Slug: "HappyFunBall", Timestamp: 3}); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if err := s.Get(c, rk, &r); err != nil || r.Slug != "HappyFunBall" || r.Timestamp != 3 {
+			t.Errorf("%v: Get == %+v, %v; want the room that was put", name, r, err)
+		}
+		if err := s.Delete(c, rk); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if err := s.Get(c, rk, &r); err != datastore.ErrNoSuchEntity {
+			t.Errorf("%v: Get after Delete == %v; want ErrNoSuchEntity", name, err)
+		}
+	}
+}
+
+func TestLocalStoreQueries(t *testing.T) {
+	c := context.Background()
+	stores, done := localStores(t)
+	defer done()
+	for name, s := range stores {
+		rk := datastore.IDKey("Room", 1, nil)
+		other := datastore.IDKey("Room", 2, nil)
+		dice := []*Die{}
+		keys := []*datastore.Key{}
+		for i, result := range []int{4, 1, 6, 3} {
+			k := datastore.IDKey("Die", int64(i+1), rk)
+			dice = append(dice, &Die{Size: "6", Result: result, Timestamp: 1500000000000000000 + int64(i), KeyStr: k.Encode()})
+			keys = append(keys, k)
+		}
+		dice = append(dice, &Die{Size: "card", Result: 2})
+		keys = append(keys, datastore.IDKey("Die", 9, rk))
+		dice = append(dice, &Die{Size: "6", Result: 5})
+		keys = append(keys, datastore.IDKey("Die", 10, other))
+		err := s.RunInTransaction(c, func(tx Transaction) error {
+			_, err := tx.PutMulti(keys, dice)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+
+		var got []Die
+		if _, err := s.GetAll(c, NewQuery("Die").Ancestor(rk).Filter("Size =", "6").Order("-Result"), &got); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		results := []int{}
+		for _, d := range got {
+			results = append(results, d.Result)
+		}
+		if len(results) != 4 || results[0] != 6 || results[1] != 4 || results[2] != 3 || results[3] != 1 {
+			t.Errorf("%v: d6 results in descending order == %v; want [6 4 3 1]", name, results)
+		}
+
+		ks, err := s.GetAll(c, NewQuery("Die").Ancestor(rk).Filter("Timestamp >", int64(1500000000000000001)).KeysOnly(), nil)
+		if err != nil || len(ks) != 2 {
+			t.Errorf("%v: Timestamp filter found %v keys (%v); want 2", name, len(ks), err)
+		}
+		ks, err = s.GetAll(c, NewQuery("Die").Ancestor(rk).Order("Result").Limit(2).KeysOnly(), nil)
+		if err != nil || len(ks) != 2 || !ks[0].Equal(keys[1]) {
+			t.Errorf("%v: limited query == %v, %v; want the two lowest dice", name, ks, err)
+		}
+		ks, err = s.GetAll(c, NewQuery("Die").KeysOnly(), nil)
+		if err != nil || len(ks) != 6 {
+			t.Errorf("%v: query without ancestor found %v dice (%v); want 6", name, len(ks), err)
+		}
+	}
+}
+
+func TestLocalStoreScansOneGroup(t *testing.T) {
+	c := context.Background()
+	stores, done := localStores(t)
+	defer done()
+	for name, s := range stores {
+		rk := datastore.IDKey("Room", 1, nil)
+		for i, parent := range []*datastore.Key{rk, rk, datastore.IDKey("Room", 2, nil)} {
+			if _, err := s.Put(c, datastore.IDKey("Die", int64(i+1), parent), &Die{Size: "6"}); err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+		}
+		scanned := 0
+		err := s.(*localStore).backend.scan("Die", rk, func(localEntity) error {
+			scanned++
+			return nil
+		})
+		if err != nil || scanned != 2 {
+			t.Errorf("%v: scanning room 1's dice read %v (%v); want only its 2", name, scanned, err)
+		}
+	}
+}
+
+func TestLocalStoreTransactionConflict(t *testing.T) {
+	c := context.Background()
+	stores, done := localStores(t)
+	defer done()
+	for name, s := range stores {
+		rk := datastore.IDKey("Room", 1, nil)
+		if _, err := s.Put(c, rk, &Room{Modifier: 0}); err != nil {
+			t.Fatal(err)
+		}
+		attempts := 0
+		err := s.RunInTransaction(c, func(tx Transaction) error {
+			attempts++
+			var r Room
+			if err := tx.Get(rk, &r); err != nil {
+				return err
+			}
+			if attempts == 1 {
+				// Someone else gets in between our read and our write.
+				if _, err := s.Put(c, rk, &Room{Modifier: 10}); err != nil {
+					return err
+				}
+			}
+			r.Modifier++
+			_, err := tx.Put(rk, &r)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		var r Room
+		if err := s.Get(c, rk, &r); err != nil {
+			t.Fatal(err)
+		}
+		if attempts != 2 || r.Modifier != 11 {
+			t.Errorf("%v: %v attempts leaving Modifier %v; want 2 attempts and 11", name, attempts, r.Modifier)
+		}
+	}
+}
+
+func TestRollWithMemoryStore(t *testing.T) {
+	old := store
+	store = newMemoryStore()
+	defer func() { store = old }()
+	c := context.Background()
+	slug, err := newRoom(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyStr, err := getEncodedRoomKeyFromName(c, slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rk, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := newRoll(c, map[string]string{"label": "goblin", "c6": "doom"}, rk, "red", "", "fp"); err != nil {
+		t.Fatal(err)
+	}
+	dice, err := getRoomDice(c, keyStr, "Timestamp", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dice) != 2 {
+		t.Errorf("room has %v things after adding a label and a clock; want 2", len(dice))
+	}
+}
+
+// flakyStore fails every transaction after the first ok ones.
+type flakyStore struct {
+	Store
+	ok int
+}
+
+func (s *flakyStore) RunInTransaction(c context.Context, f func(tx Transaction) error) error {
+	if s.ok == 0 {
+		return errors.New("datastore is having a bad day")
+	}
+	s.ok--
+	return s.Store.RunInTransaction(c, f)
+}
+
+func TestClearRoomDiceInBatches(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: "TokenHeavyTable"}); err != nil {
+		t.Fatal(err)
+	}
+	const things = 2*maxBatch + 3
+	for i := 0; i < things; i++ {
+		if _, err := store.Put(c, datastore.IDKey("Die", int64(i+1), rk), &Die{Size: "tokens"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mem := store
+	store = &flakyStore{Store: mem, ok: 1}
+	removed, err := clearRoomDice(c, rk.Encode())
+	store = mem
+	if err == nil || removed != maxBatch {
+		t.Errorf("clearRoomDice() with a failing second batch == %v, %v; want %v and an error", removed, err, maxBatch)
+	}
+
+	after := settledSeq(rk.Encode())
+	removed, err = clearRoomDice(c, rk.Encode())
+	if err != nil || removed != things-maxBatch {
+		t.Errorf("clearRoomDice() resuming == %v, %v; want %v, nil", removed, err, things-maxBatch)
+	}
+	events, err := eventsAfter(c, rk, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	announced := 0
+	for _, u := range events {
+		if u.Type != eventClear || len(u.DieKeys) > maxBatch {
+			t.Errorf("clearing sent a %v event with %v keys; want clears of at most %v", u.Type, len(u.DieKeys), maxBatch)
+		}
+		announced += len(u.DieKeys)
+	}
+	if announced != removed {
+		t.Errorf("clear events had %v keys; want the %v things removed", announced, removed)
+	}
+	left, err := store.GetAll(c, NewQuery("Die").Ancestor(rk).KeysOnly(), nil)
+	if err != nil || len(left) != 0 {
+		t.Errorf("%v things left after clearing (%v); want 0", len(left), err)
+	}
+}
+
+func TestBoltStoreGroupsOldFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "roller.db")
+
+	// Files used to keep entities straight in their kind's bucket.
+	rk := datastore.IDKey("Room", 1, nil)
+	dk := datastore.IDKey("Die", 2, rk)
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for k, src := range map[*datastore.Key]interface{}{rk: &Room{Slug: "OldTable"}, dk: &Die{Size: "6", Result: 4}} {
+			data, err := json.Marshal(src)
+			if err != nil {
+				return err
+			}
+			v, err := json.Marshal(localEntity{Key: k, Version: 1, Data: data})
+			if err != nil {
+				return err
+			}
+			b, err := tx.CreateBucketIfNotExists([]byte(k.Kind))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(k.Encode()), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := context.Background()
+	var r Room
+	if err := s.Get(c, rk, &r); err != nil || r.Slug != "OldTable" {
+		t.Errorf("Get(room) == %+v, %v; want the old room", r, err)
+	}
+	var dice []Die
+	if _, err := s.GetAll(c, NewQuery("Die").Ancestor(rk), &dice); err != nil || len(dice) != 1 || dice[0].Result != 4 {
+		t.Errorf("room's dice == %+v, %v; want the old die", dice, err)
+	}
+}
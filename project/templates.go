@@ -0,0 +1,241 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// A room's setup is what a GM lays out before play: the background, custom sets,
+// clocks, labels, images and tokens. Saving it as a template lets the same table be
+// stamped out again for another group, with a fresh deck and nothing rolled yet.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// RoomTemplate is a saved room setup. Its pieces are TemplateItem children holding Dice.
+type RoomTemplate struct {
+	Slug       string
+	Name       string
+	FromRoom   string
+	Created    int64
+	BgURL      string
+	CustomSets []byte `datastore:",noindex"`
+}
+
+type roomSetup struct {
+	BgURL      string
+	CustomSets CustomSets
+	Items      []Die
+}
+
+// isSetup says whether d is part of the table's layout rather than something rolled or drawn.
+func (d Die) isSetup() bool {
+	return d.IsClock || d.IsImage || d.Size == "tokens" || (d.IsLabel && !d.IsFunky)
+}
+
+// setupOfRoom collects the setup of the room with the given key. Custom sets come back
+// with all their items in them.
+func setupOfRoom(c context.Context, keyStr string) (roomSetup, error) {
+	var setup roomSetup
+	k, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		return setup, fmt.Errorf("setupOfRoom: could not decode room key %v: %v", keyStr, err)
+	}
+	var r Room
+	if err := store.Get(c, k, &r); err != nil {
+		return setup, fmt.Errorf("could not get room %v: %v", keyStr, err)
+	}
+	setup.BgURL = r.BgURL
+	if setup.CustomSets, err = r.GetCustomSets(); err != nil {
+		return setup, err
+	}
+	for name, cs := range setup.CustomSets {
+		cs.shuffleDiscards(map[string]bool{})
+		setup.CustomSets[name] = cs
+	}
+	dice, err := getRoomDice(c, keyStr, "Timestamp", "true")
+	if err != nil {
+		return setup, err
+	}
+	for _, d := range dice {
+		if d.isSetup() {
+			d.SVG = ""
+			setup.Items = append(setup.Items, d)
+		}
+	}
+	return setup, nil
+}
+
+// stampRoom makes a new room laid out like setup and returns its slug.
+func stampRoom(c context.Context, setup roomSetup) (string, error) {
+	rk := roomKey()
+	slug := generateRoomName(3)
+	r := newRoomEntity(rk, slug)
+	r.BgURL = setup.BgURL
+	if len(setup.CustomSets) > 0 {
+		if err := r.SetCustomSets(setup.CustomSets); err != nil {
+			return "", fmt.Errorf("could not save custom sets: %v", err)
+		}
+	}
+	ts := time.Now().Unix()
+	keys := []*datastore.Key{}
+	items := []*Die{}
+	for i := range setup.Items {
+		d := setup.Items[i]
+		k := dieKey(rk, int64(i))
+		d.Key = k
+		d.KeyStr = k.Encode()
+		d.Timestamp = ts
+		d.New = false
+		keys = append(keys, k)
+		items = append(items, &d)
+	}
+	if _, err := store.Put(c, rk, &r); err != nil {
+		return "", fmt.Errorf("could not create room from setup: %v", err)
+	}
+	if err := putInBatches(c, keys, items); err != nil {
+		return slug, fmt.Errorf("could not lay out room %v: %v", slug, err)
+	}
+	return slug, nil
+}
+
+// saveRoomTemplate saves the setup of the room with the given key as a new template.
+func saveRoomTemplate(c context.Context, room, keyStr, name string) (RoomTemplate, error) {
+	setup, err := setupOfRoom(c, keyStr)
+	if err != nil {
+		return RoomTemplate{}, err
+	}
+	if name == "" {
+		name = room
+	}
+	t := RoomTemplate{Slug: generateRoomName(3), Name: name, FromRoom: room, Created: time.Now().Unix(), BgURL: setup.BgURL}
+	if t.CustomSets, err = json.Marshal(setup.CustomSets); err != nil {
+		return t, fmt.Errorf("could not save custom sets: %v", err)
+	}
+	tk := datastore.IDKey("RoomTemplate", time.Now().UnixNano(), nil)
+	keys := []*datastore.Key{}
+	items := []*Die{}
+	for i := range setup.Items {
+		keys = append(keys, datastore.IDKey("TemplateItem", int64(i+1), tk))
+		items = append(items, &setup.Items[i])
+	}
+	if _, err := store.Put(c, tk, &t); err != nil {
+		return t, fmt.Errorf("could not save template: %v", err)
+	}
+	if err := putInBatches(c, keys, items); err != nil {
+		return t, fmt.Errorf("could not save template items: %v", err)
+	}
+	return t, nil
+}
+
+// getRoomTemplate loads the setup saved under the template slug.
+func getRoomTemplate(c context.Context, slug string) (roomSetup, error) {
+	var setup roomSetup
+	templates := []RoomTemplate{}
+	keys, err := store.GetAll(c, NewQuery("RoomTemplate").Filter("Slug =", slug).Limit(1), &templates)
+	if err != nil {
+		return setup, fmt.Errorf("problem executing template (by Slug) query: %v", err)
+	}
+	if len(keys) == 0 {
+		return setup, fmt.Errorf("couldn't find a template called %v", slug)
+	}
+	t := templates[0]
+	setup.BgURL = t.BgURL
+	if len(t.CustomSets) > 0 {
+		if err := json.Unmarshal(t.CustomSets, &setup.CustomSets); err != nil {
+			return setup, fmt.Errorf("could not unmarshal custom sets of template %v: %v", slug, err)
+		}
+	}
+	if _, err := store.GetAll(c, NewQuery("TemplateItem").Ancestor(keys[0]), &setup.Items); err != nil {
+		return setup, fmt.Errorf("could not get items of template %v: %v", slug, err)
+	}
+	return setup, nil
+}
+
+// SaveTemplate saves the room's setup as a template and returns where to find it.
+func SaveTemplate(w http.ResponseWriter, r *http.Request, room string) {
+	c := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST to save a template", http.StatusMethodNotAllowed)
+		return
+	}
+	_ = r.ParseForm()
+	keyStr, err := getEncodedRoomKeyFromName(c, room)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	t, err := saveRoomTemplate(c, room, keyStr, strings.TrimSpace(r.Form.Get("name")))
+	if err != nil {
+		log.Printf("could not save template: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]string{"Slug": t.Slug, "Name": t.Name, "URL": "/template/" + t.Slug}); err != nil {
+		log.Printf("could not write template: %v", err)
+	}
+}
+
+// Clone makes a new room laid out like the posted one and sends the visitor there. It
+// makes a room, so like the other actions it has to be POSTed; a link or image on
+// another page can't set it off.
+func Clone(w http.ResponseWriter, r *http.Request) {
+	room, ok := postedRoom(w, r)
+	if !ok {
+		return
+	}
+	setup, err := setupOfRoom(r.Context(), room.KeyStr)
+	if err != nil {
+		log.Printf("could not clone %v: %v", room.Slug, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendToNewRoom(w, r, setup)
+}
+
+// FromTemplate stamps out a new room from the template in the path, so a template link
+// can be handed to each group.
+func FromTemplate(w http.ResponseWriter, r *http.Request) {
+	c := r.Context()
+	setup, err := getRoomTemplate(c, path.Base(r.URL.Path))
+	if err != nil {
+		log.Printf("%v", err)
+		http.NotFound(w, r)
+		return
+	}
+	sendToNewRoom(w, r, setup)
+}
+
+func sendToNewRoom(w http.ResponseWriter, r *http.Request, setup roomSetup) {
+	room, err := stampRoom(r.Context(), setup)
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "dice_room", Value: room, SameSite: http.SameSiteLaxMode})
+	smartRedirect(w, r, fmt.Sprintf("/room/%v", room), http.StatusFound)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestTemplateStampsSetupOnly(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	r := Room{Slug: "OneShot", Deck: "As", BgURL: "https://example.com/dungeon.png"}
+	cs := CustomSets{"loot": {Template: map[string]string{"sword": "s.png", "gold": "g.png"}, Instance: map[string]string{"gold": "g.png"}}}
+	if err := r.SetCustomSets(cs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put(c, rk, &r); err != nil {
+		t.Fatal(err)
+	}
+	things := []*Die{
+		{IsClock: true, Size: "c6", ResultStr: "doom"},
+		{IsLabel: true, ResultStr: "Gate"},
+		{IsImage: true, Image: "https://example.com/goblin.png", X: 40, Y: 80},
+		{Size: "tokens", Color: "red", X: 5, Y: 6},
+		{Size: "6", Result: 4},
+		{IsLabel: true, IsFunky: true, ResultStr: "3 (d7)"},
+		{IsCard: true, Size: "card", ResultStr: "A♠"},
+		{IsCustomItem: true, CustomSetName: "loot", ResultStr: "sword"},
+	}
+	for i, d := range things {
+		k := datastore.IDKey("Die", int64(i+1), rk)
+		d.KeyStr = k.Encode()
+		if _, err := store.Put(c, k, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/room/OneShot/template", strings.NewReader("name=Tomb"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	SaveTemplate(w, req, "OneShot")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("SaveTemplate() == %v %v; want 201", w.Code, w.Body)
+	}
+	var saved struct{ Slug, Name, URL string }
+	if err := json.NewDecoder(w.Body).Decode(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Name != "Tomb" || saved.URL != "/template/"+saved.Slug {
+		t.Errorf("SaveTemplate() == %+v; want the template's name and link", saved)
+	}
+
+	// Changing the room afterwards doesn't change the template.
+	if _, err := clearRoomDice(c, rk.Encode()); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	FromTemplate(w, httptest.NewRequest("GET", saved.URL, nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("FromTemplate() == %v %v; want a redirect to the new room", w.Code, w.Body)
+	}
+	slug := path.Base(w.Result().Header.Get("Location"))
+	keyStr, err := getEncodedRoomKeyFromName(c, slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nk, _ := datastore.DecodeKey(keyStr)
+	var got Room
+	if err := store.Get(c, nk, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.BgURL != r.BgURL || got.Deck == "" || got.Deck == "As" {
+		t.Errorf("stamped room == %+v; want the background and a fresh deck", got)
+	}
+	sets, err := got.GetCustomSets()
+	if err != nil || len(sets["loot"].Instance) != 2 {
+		t.Errorf("stamped room custom sets == %+v, %v; want loot with all its items back", sets, err)
+	}
+	dice, err := getRoomDice(c, keyStr, "Timestamp", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dice) != 4 {
+		t.Errorf("stamped room has %v things; want the clock, label, image and token", len(dice))
+	}
+	for _, d := range dice {
+		if !d.isSetup() {
+			t.Errorf("stamped room has %+v; want only setup", d)
+		}
+		if d.IsImage && (d.X != 40 || d.Y != 80) {
+			t.Errorf("stamped image at %v,%v; want 40,80", d.X, d.Y)
+		}
+	}
+}
+
+func TestFromMissingTemplate(t *testing.T) {
+	defer withMemoryStore()()
+	w := httptest.NewRecorder()
+	FromTemplate(w, httptest.NewRequest("GET", "/template/NoSuchThing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("FromTemplate() of a missing template == %v; want 404", w.Code)
+	}
+}
+
+func TestCloneNeedsAPost(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: "OneShot", BgURL: "https://example.com/dungeon.png"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		method, body string
+		want         int
+	}{
+		{"GET", "room=OneShot", http.StatusMethodNotAllowed},
+		{"POST", "", http.StatusBadRequest},
+		{"POST", "room=NoSuchRoom", http.StatusNotFound},
+		{"POST", "room=OneShot", http.StatusFound},
+	} {
+		req := httptest.NewRequest(tc.method, "/clone", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		Clone(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%v /clone %q == %v; want %v", tc.method, tc.body, w.Code, tc.want)
+		}
+		if tc.want != http.StatusFound {
+			continue
+		}
+		slug := path.Base(w.Result().Header.Get("Location"))
+		keyStr, err := getEncodedRoomKeyFromName(c, slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nk, _ := datastore.DecodeKey(keyStr)
+		var got Room
+		if err := store.Get(c, nk, &got); err != nil || slug == "OneShot" || got.BgURL != "https://example.com/dungeon.png" {
+			t.Errorf("cloned room %v == %+v, %v; want a new room with the background", slug, got, err)
+		}
+	}
+	rooms, err := store.GetAll(c, NewQuery("Room").KeysOnly(), nil)
+	if err != nil || len(rooms) != 2 {
+		t.Errorf("rooms after cloning == %v, %v; want the original and one clone", len(rooms), err)
+	}
+}
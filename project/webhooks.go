@@ -0,0 +1,537 @@
+//    AppEngine based Dice Roller
+//    Copyright (C) 2017 Shane Liebling
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Webhooks let a room send its rolls, draws, reveals, clears and alerts to other
+// services as they happen. Each webhook is a URL stored under the room with its own
+// secret; every event is POSTed to it as JSON, signed with HMAC-SHA256 of the secret,
+// and retried with backoff if it fails. Each attempt goes in the room's delivery log.
+//
+// Only whoever made the room through the API, holding its owner token, or an admin
+// can manage its webhooks. They are never sent to loopback, link-local or private
+// addresses, which is checked both when they are added and on every connection, so
+// a name that later resolves somewhere else is still caught.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	// maxWebhooks is the most webhooks one room may have.
+	maxWebhooks = 5
+	// webhookAttempts is how many times an event is sent before giving up on it.
+	webhookAttempts = 5
+	// webhookLogSize is how many delivery attempts each room's log keeps.
+	webhookLogSize = 100
+	// webhookCacheTTL is how long an instance trusts its list of a room's webhooks.
+	// Webhooks added or removed on another instance take up to this long to be seen.
+	webhookCacheTTL = time.Minute
+	// signatureHeader carries "sha256=" and the hex HMAC-SHA256 of the body.
+	signatureHeader = "X-Roller-Signature"
+	eventHeader     = "X-Roller-Event"
+)
+
+// webhookEvents are the event types sent to webhooks.
+var webhookEvents = map[string]bool{
+	eventRoll:   true,
+	eventDraw:   true,
+	eventReveal: true,
+	eventClear:  true,
+	eventAlert:  true,
+}
+
+var (
+	webhookClient = &http.Client{
+		Timeout: 10 * time.Second,
+		// No proxy, so the dialer sees the address each request really goes to.
+		Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: checkWebhookDial}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+	}
+	// webhookAddrAllowed says whether webhooks may be sent to ip. Tests swap it out to
+	// reach servers on loopback.
+	webhookAddrAllowed = publicAddr
+	// privateNets are this machine, the networks it might sit on and cloud metadata
+	// services, none of which webhooks may reach.
+	privateNets = parseCIDRs("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10")
+	// webhookBackoff is how long the first retry waits; each one after waits twice as long.
+	webhookBackoff = 5 * time.Second
+
+	webhookMu sync.Mutex
+	// webhookCache has each room's webhooks as this instance last loaded them.
+	webhookCache = map[string]cachedWebhooks{}
+)
+
+// Webhook is a URL that gets the room's events, keyed by ID under the room.
+type Webhook struct {
+	ID      int64
+	URL     string
+	Secret  string `datastore:",noindex"`
+	Created int64
+}
+
+// WebhookDelivery is one attempt to send an event to a webhook. Status is the HTTP
+// status the webhook answered with, or zero if it couldn't be reached.
+type WebhookDelivery struct {
+	Webhook   int64
+	URL       string
+	Seq       int64
+	Type      string
+	Attempt   int
+	Status    int
+	Error     string `datastore:",noindex"`
+	Timestamp int64
+}
+
+// webhookPayload is the body POSTed to webhooks: the event as players see it, and for
+// rolls, draws and reveals the dice as everyone at the table sees them.
+type webhookPayload struct {
+	Room  string
+	Event Update
+	Dice  []Die `json:",omitempty"`
+}
+
+type cachedWebhooks struct {
+	hooks []Webhook
+	at    time.Time
+}
+
+func webhookKey(roomKey *datastore.Key, id int64) *datastore.Key {
+	return datastore.IDKey("Webhook", id, roomKey)
+}
+
+// roomWebhooks returns the room's webhooks, from this instance's cache if it's fresh.
+func roomWebhooks(c context.Context, roomKey *datastore.Key) ([]Webhook, error) {
+	rk := roomKey.Encode()
+	webhookMu.Lock()
+	cached, ok := webhookCache[rk]
+	webhookMu.Unlock()
+	if ok && time.Since(cached.at) < webhookCacheTTL {
+		return cached.hooks, nil
+	}
+	hooks := []Webhook{}
+	if _, err := store.GetAll(c, NewQuery("Webhook").Ancestor(roomKey), &hooks); err != nil {
+		return nil, fmt.Errorf("could not get webhooks for %v: %v", rk, err)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	webhookMu.Lock()
+	webhookCache[rk] = cachedWebhooks{hooks: hooks, at: time.Now()}
+	webhookMu.Unlock()
+	return hooks, nil
+}
+
+// forgetWebhooks drops this instance's cached webhooks for the room.
+func forgetWebhooks(roomKey *datastore.Key) {
+	webhookMu.Lock()
+	delete(webhookCache, roomKey.Encode())
+	webhookMu.Unlock()
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(fmt.Sprintf("bad CIDR %q: %v", s, err))
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// publicAddr says whether ip is somewhere on the internet rather than on this machine
+// or a network next to it.
+func publicAddr(ip net.IP) bool {
+	if ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWebhookDial stops webhook connections to addresses that aren't public. It runs
+// after the name is resolved, so it sees where each connection, including those for
+// redirects, actually goes.
+func checkWebhookDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !webhookAddrAllowed(ip) {
+		return fmt.Errorf("webhooks may not be sent to %v", host)
+	}
+	return nil
+}
+
+// validWebhookURL says what's wrong with u as a webhook URL, if anything.
+func validWebhookURL(c context.Context, u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return refuse(http.StatusBadRequest, "webhook URL %q must be an absolute http or https URL", u)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(c, parsed.Hostname())
+	if err != nil {
+		return refuse(http.StatusBadRequest, "could not look up webhook host %q: %v", parsed.Hostname(), err)
+	}
+	for _, a := range addrs {
+		if !webhookAddrAllowed(a.IP) {
+			return refuse(http.StatusBadRequest, "webhook URL %q is not a public address", u)
+		}
+	}
+	return nil
+}
+
+// setRoomOwner gives the room called slug a new owner token and returns it. Only its
+// hash is kept.
+func setRoomOwner(c context.Context, slug string) (string, error) {
+	room, err := findRoom(c, slug)
+	if err != nil {
+		return "", err
+	}
+	raw := make([]byte, 32)
+	if _, err := crand.Read(raw); err != nil {
+		return "", fmt.Errorf("could not make an owner token: %v", err)
+	}
+	token := hex.EncodeToString(raw)
+	err = store.RunInTransaction(c, func(tx Transaction) error {
+		var r Room
+		if err := tx.Get(room.Key, &r); err != nil {
+			return fmt.Errorf("could not get room %v: %v", slug, err)
+		}
+		r.OwnerHash = hashOwnerToken(token)
+		if _, err := tx.Put(room.Key, &r); err != nil {
+			return fmt.Errorf("could not set owner of room %v: %v", slug, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func hashOwnerToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ownerAllowed checks the request carries the room's owner token or the admin token
+// as a bearer token.
+func ownerAllowed(c context.Context, r *http.Request, room roomRef) error {
+	if adminAllowed(r) {
+		return nil
+	}
+	var rm Room
+	if err := store.Get(c, room.Key, &rm); err != nil {
+		return fmt.Errorf("could not get room %v: %v", room.Slug, err)
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if rm.OwnerHash == "" || got == "" || subtle.ConstantTimeCompare([]byte(hashOwnerToken(got)), []byte(rm.OwnerHash)) != 1 {
+		return refuse(http.StatusForbidden, "managing webhooks needs the room's owner token")
+	}
+	return nil
+}
+
+// addWebhook registers u to get the room's events, with a new secret to sign them with.
+func addWebhook(c context.Context, roomKey *datastore.Key, u string) (Webhook, error) {
+	if err := validWebhookURL(c, u); err != nil {
+		return Webhook{}, err
+	}
+	secret := make([]byte, 32)
+	if _, err := crand.Read(secret); err != nil {
+		return Webhook{}, fmt.Errorf("could not make a webhook secret: %v", err)
+	}
+	existing, err := store.GetAll(c, NewQuery("Webhook").Ancestor(roomKey).KeysOnly(), nil)
+	if err != nil {
+		return Webhook{}, fmt.Errorf("could not count webhooks for %v: %v", roomKey.Encode(), err)
+	}
+	if len(existing) >= maxWebhooks {
+		return Webhook{}, refuse(http.StatusConflict, "the room already has %v webhooks", maxWebhooks)
+	}
+	h := Webhook{ID: nextSeq(), URL: u, Secret: hex.EncodeToString(secret), Created: time.Now().Unix()}
+	if _, err := store.Put(c, webhookKey(roomKey, h.ID), &h); err != nil {
+		return Webhook{}, fmt.Errorf("could not add webhook to %v: %v", roomKey.Encode(), err)
+	}
+	forgetWebhooks(roomKey)
+	return h, nil
+}
+
+// removeWebhook stops sending the room's events to webhook id.
+func removeWebhook(c context.Context, roomKey *datastore.Key, id int64) error {
+	k := webhookKey(roomKey, id)
+	var h Webhook
+	if err := store.Get(c, k, &h); err == datastore.ErrNoSuchEntity {
+		return refuse(http.StatusNotFound, "no webhook %v", id)
+	} else if err != nil {
+		return fmt.Errorf("could not get webhook %v: %v", id, err)
+	}
+	if err := store.Delete(c, k); err != nil {
+		return fmt.Errorf("could not delete webhook %v: %v", id, err)
+	}
+	forgetWebhooks(roomKey)
+	return nil
+}
+
+// signWebhook is the signature header value for body sent with secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhooks sends u to the room's webhooks, if it's an event they get. Sending
+// happens in the background, so slow webhooks don't hold up the table.
+func notifyWebhooks(c context.Context, roomKey *datastore.Key, u Update) {
+	if !webhookEvents[u.Type] {
+		return
+	}
+	hooks, err := roomWebhooks(c, roomKey)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	payload := webhookPayload{Event: u.forPlayers(roomKey.Encode())}
+	var r Room
+	if err := store.Get(c, roomKey, &r); err != nil {
+		log.Printf("could not get room %v for its webhooks: %v", roomKey.Encode(), err)
+	}
+	payload.Room = r.Slug
+	keys := u.DieKeys
+	if u.Type == eventReveal && u.DieKey != "" {
+		keys = []string{u.DieKey}
+	}
+	if u.Type != eventClear && len(keys) > 0 {
+		dice, err := getDice(c, keys)
+		if err != nil {
+			log.Printf("could not get dice for webhooks: %v", err)
+		}
+		for _, d := range dice {
+			payload.Dice = append(payload.Dice, d.seenBy(""))
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("could not encode webhook payload: %v", err)
+		return
+	}
+	for _, h := range hooks {
+		// The request is over by the time retries happen, so they can't use its context.
+		go deliverWebhook(context.Background(), roomKey, h, u, body)
+	}
+}
+
+// deliverWebhook POSTs body to h until it is taken, the webhook turns it down, or
+// webhookAttempts have failed, logging each attempt.
+func deliverWebhook(c context.Context, roomKey *datastore.Key, h Webhook, u Update, body []byte) {
+	wait := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		status, err := postWebhook(c, h, u.Type, body)
+		d := WebhookDelivery{Webhook: h.ID, URL: h.URL, Seq: u.Seq, Type: u.Type, Attempt: attempt, Status: status, Timestamp: time.Now().Unix()}
+		if err != nil {
+			d.Error = err.Error()
+		}
+		if err := logDelivery(c, roomKey, d); err != nil {
+			log.Printf("%v", err)
+		}
+		if err == nil || !retryable(status) || attempt == webhookAttempts {
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// retryable says whether a webhook that answered with status might take the event later.
+// Zero is a webhook that couldn't be reached.
+func retryable(status int) bool {
+	return status == 0 || status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// postWebhook sends one event to h and returns the status it answered with.
+func postWebhook(c context.Context, h Webhook, eventType string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(c)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "roller-webhooks")
+	req.Header.Set(eventHeader, eventType)
+	req.Header.Set(signatureHeader, signWebhook(h.Secret, body))
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("webhook answered %v", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// logDelivery adds d to the room's delivery log and drops the oldest attempts beyond
+// webhookLogSize.
+func logDelivery(c context.Context, roomKey *datastore.Key, d WebhookDelivery) error {
+	if _, err := store.Put(c, datastore.IDKey("WebhookDelivery", nextSeq(), roomKey), &d); err != nil {
+		return fmt.Errorf("could not log webhook delivery for %v: %v", roomKey.Encode(), err)
+	}
+	keys, err := store.GetAll(c, NewQuery("WebhookDelivery").Ancestor(roomKey).KeysOnly(), nil)
+	if err != nil {
+		return fmt.Errorf("could not trim webhook log for %v: %v", roomKey.Encode(), err)
+	}
+	if len(keys) <= webhookLogSize {
+		return nil
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID > keys[j].ID })
+	if err := deleteInBatches(c, keys[webhookLogSize:]); err != nil {
+		return fmt.Errorf("could not trim webhook log for %v: %v", roomKey.Encode(), err)
+	}
+	return nil
+}
+
+// webhookLog returns the room's delivery log, newest first.
+func webhookLog(c context.Context, roomKey *datastore.Key) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	keys, err := store.GetAll(c, NewQuery("WebhookDelivery").Ancestor(roomKey), &deliveries)
+	if err != nil {
+		return nil, fmt.Errorf("could not get webhook log for %v: %v", roomKey.Encode(), err)
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return keys[order[i]].ID > keys[order[j]].ID })
+	out := make([]WebhookDelivery, 0, len(keys))
+	for _, i := range order {
+		out = append(out, deliveries[i])
+	}
+	return out, nil
+}
+
+// apiWebhook is a webhook as the API shows it. The secret is only sent when the
+// webhook is made.
+type apiWebhook struct {
+	ID      int64
+	URL     string
+	Created int64
+	Secret  string `json:",omitempty"`
+}
+
+// apiWebhookRequest is a URL to send the room's events to.
+type apiWebhookRequest struct {
+	URL string
+}
+
+// apiWebhooks lists, adds and removes the room's webhooks, and shows its delivery log,
+// for the room's owner.
+func apiWebhooks(w http.ResponseWriter, r *http.Request, room roomRef, rest []string) {
+	c := r.Context()
+	if err := ownerAllowed(c, r, room); err != nil {
+		writeAPIFailure(w, "", err)
+		return
+	}
+	if len(rest) == 1 && rest[0] == "log" {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		deliveries, err := webhookLog(c, room.Key)
+		if err != nil {
+			writeAPIFailure(w, "", err)
+			return
+		}
+		writeAPI(w, http.StatusOK, deliveries)
+		return
+	}
+	if len(rest) == 1 {
+		if !allowMethods(w, r, http.MethodDelete) {
+			return
+		}
+		id, err := strconv.ParseInt(rest[0], 10, 64)
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, "no webhook %q", rest[0])
+			return
+		}
+		if err := removeWebhook(c, room.Key, id); err != nil {
+			writeAPIFailure(w, "", err)
+			return
+		}
+		writeAPI(w, http.StatusNoContent, nil)
+		return
+	}
+	if len(rest) > 1 {
+		writeAPIError(w, http.StatusNotFound, "no such webhook path")
+		return
+	}
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		hooks, err := roomWebhooks(c, room.Key)
+		if err != nil {
+			writeAPIFailure(w, "", err)
+			return
+		}
+		out := []apiWebhook{}
+		for _, h := range hooks {
+			out = append(out, apiWebhook{ID: h.ID, URL: h.URL, Created: h.Created})
+		}
+		writeAPI(w, http.StatusOK, out)
+		return
+	}
+	var req apiWebhookRequest
+	if !readAPIBody(w, r, &req) {
+		return
+	}
+	h, err := addWebhook(c, room.Key, req.URL)
+	if err != nil {
+		writeAPIFailure(w, "", err)
+		return
+	}
+	writeAPI(w, http.StatusCreated, apiWebhook{ID: h.ID, URL: h.URL, Created: h.Created, Secret: h.Secret})
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a local service that records what webhooks send it, answering
+// with the statuses in answers in turn and then 200s.
+type webhookReceiver struct {
+	*httptest.Server
+	got     chan *http.Request
+	bodies  chan []byte
+	answers chan int
+}
+
+func newWebhookReceiver(answers ...int) *webhookReceiver {
+	wr := &webhookReceiver{got: make(chan *http.Request, 20), bodies: make(chan []byte, 20), answers: make(chan int, len(answers))}
+	for _, a := range answers {
+		wr.answers <- a
+	}
+	wr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		wr.got <- r
+		wr.bodies <- body
+		select {
+		case code := <-wr.answers:
+			w.WriteHeader(code)
+		default:
+		}
+	}))
+	return wr
+}
+
+// next waits for the next thing sent to the receiver.
+func (wr *webhookReceiver) next(t *testing.T) (*http.Request, []byte) {
+	t.Helper()
+	select {
+	case r := <-wr.got:
+		return r, <-wr.bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook was never called")
+		return nil, nil
+	}
+}
+
+// ownedTestRoom makes a room through the API and returns its path and owner token.
+func ownedTestRoom(t *testing.T) (string, string) {
+	t.Helper()
+	var res struct{ Slug, OwnerToken string }
+	if code := callAPI(t, "POST", "/api/v1/rooms", nil, &res); code != http.StatusCreated || res.OwnerToken == "" {
+		t.Fatalf("POST /api/v1/rooms == %v %+v; want 201 and an owner token", code, res)
+	}
+	return "/api/v1/rooms/" + res.Slug, res.OwnerToken
+}
+
+// allowLoopbackWebhooks lets webhooks reach test servers on loopback until the
+// returned func is called.
+func allowLoopbackWebhooks() func() {
+	webhookAddrAllowed = func(ip net.IP) bool { return ip.IsLoopback() || publicAddr(ip) }
+	return func() { webhookAddrAllowed = publicAddr }
+}
+
+// waitForLog waits for the room's delivery log to have n attempts in it.
+func waitForLog(t *testing.T, room, token string, n int) []WebhookDelivery {
+	t.Helper()
+	var deliveries []WebhookDelivery
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		deliveries = nil
+		callAPIWithToken(t, token, "GET", room+"/webhooks/log", nil, &deliveries)
+		if len(deliveries) >= n {
+			return deliveries
+		}
+	}
+	t.Fatalf("delivery log == %+v; want %v attempts", deliveries, n)
+	return nil
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	defer withMemoryStore()()
+	defer allowLoopbackWebhooks()()
+	fakeDieSVGs(6)
+	wr := newWebhookReceiver()
+	defer wr.Close()
+	room, token := ownedTestRoom(t)
+
+	var hook apiWebhook
+	if code := callAPIWithToken(t, token, "POST", room+"/webhooks", map[string]string{"URL": wr.URL + "/wiki"}, &hook); code != http.StatusCreated || hook.Secret == "" {
+		t.Fatalf("POST webhooks == %v %+v; want 201 and a secret", code, hook)
+	}
+	var rolled apiRollResult
+	callAPI(t, "POST", room+"/roll", map[string]interface{}{"Dice": map[string]int{"d6": 2}, "Fp": "alice"}, &rolled)
+	// Moves aren't sent, so the receiver sees just the roll, the alert and the draw.
+	callAPI(t, "POST", room+"/dice/"+rolled.Dice[0].KeyStr+"/move", map[string]interface{}{"X": 5}, nil)
+	callAPI(t, "POST", room+"/alert", map[string]string{"Message": "Initiative!"}, nil)
+	callAPI(t, "POST", room+"/draw", map[string]interface{}{"Fp": "alice"}, nil)
+
+	sent := map[string][]byte{}
+	var r *http.Request
+	for i := 0; i < 3; i++ {
+		got, body := wr.next(t)
+		sent[got.Header.Get(eventHeader)] = body
+		if got.Header.Get(eventHeader) == eventRoll {
+			r = got
+		}
+	}
+	body := sent[eventRoll]
+	if r == nil || sent[eventDraw] == nil {
+		t.Fatalf("webhook got %v; want a roll, an alert and a draw", sent)
+	}
+	if r.URL.Path != "/wiki" || r.Header.Get(eventHeader) != eventRoll || r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("roll sent to %v with headers %v; want a JSON roll event at /wiki", r.URL.Path, r.Header)
+	}
+	if got, want := r.Header.Get(signatureHeader), signWebhook(hook.Secret, body); got != want {
+		t.Errorf("signature == %q; want %q", got, want)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := findRoom(context.Background(), payload.Room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if "/api/v1/rooms/"+payload.Room != room || payload.Event.Updater != playerID(ref.KeyStr, "alice") || len(payload.Dice) != 2 || payload.Dice[0].Result != rolled.Dice[0].Result {
+		t.Errorf("roll payload == %s; want the room, who rolled and both dice", body)
+	}
+	if strings.Contains(string(body), "alice") {
+		t.Errorf("roll payload has the roller's fingerprint: %s", body)
+	}
+	if strings.Contains(string(body), "<svg") {
+		t.Errorf("roll payload has the dice's SVGs: %s", body)
+	}
+	body = sent[eventAlert]
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Event.Type != eventAlert || payload.Event.Message != "Initiative!" {
+		t.Errorf("second payload == %s; want the alert", body)
+	}
+
+	if err := json.Unmarshal(sent[eventDraw], &payload); err != nil || len(payload.Dice) != 1 || !payload.Dice[0].IsCard {
+		t.Errorf("draw payload == %s; want the card", sent[eventDraw])
+	}
+	for _, d := range waitForLog(t, room, token, 3) {
+		if d.Status != http.StatusOK || d.Attempt != 1 || d.Webhook != hook.ID {
+			t.Errorf("delivery == %+v; want the %v taken first time", d, d.Type)
+		}
+	}
+
+	var hooks []apiWebhook
+	if callAPIWithToken(t, token, "GET", room+"/webhooks", nil, &hooks); len(hooks) != 1 || hooks[0].Secret != "" {
+		t.Errorf("GET webhooks == %+v; want the one webhook without its secret", hooks)
+	}
+	if code := callAPIWithToken(t, token, "DELETE", fmt.Sprintf("%v/webhooks/%v", room, hook.ID), nil, nil); code != http.StatusNoContent {
+		t.Errorf("DELETE webhook == %v; want 204", code)
+	}
+	callAPI(t, "POST", room+"/alert", map[string]string{"Message": "Anyone there?"}, nil)
+	select {
+	case r := <-wr.got:
+		t.Errorf("removed webhook still got %v", r.Header.Get(eventHeader))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	defer withMemoryStore()()
+	defer allowLoopbackWebhooks()()
+	defer func(d time.Duration) { webhookBackoff = d }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+	flaky := newWebhookReceiver(http.StatusServiceUnavailable, http.StatusInternalServerError)
+	defer flaky.Close()
+	refusing := newWebhookReceiver(http.StatusGone)
+	defer refusing.Close()
+	room, token := ownedTestRoom(t)
+	for _, u := range []string{flaky.URL, refusing.URL} {
+		if code := callAPIWithToken(t, token, "POST", room+"/webhooks", map[string]string{"URL": u}, nil); code != http.StatusCreated {
+			t.Fatalf("POST webhooks == %v; want 201", code)
+		}
+	}
+	callAPI(t, "POST", room+"/clear", nil, nil)
+
+	for i := 0; i < 3; i++ {
+		flaky.next(t)
+	}
+	refusing.next(t)
+	deliveries := waitForLog(t, room, token, 4)
+	attempts := map[string][]int{}
+	for i := len(deliveries) - 1; i >= 0; i-- {
+		d := deliveries[i]
+		attempts[d.URL] = append(attempts[d.URL], d.Status)
+	}
+	if got := attempts[flaky.URL]; len(got) != 3 || got[0] != 503 || got[1] != 500 || got[2] != 200 {
+		t.Errorf("flaky webhook answered %v; want 503, 500 and then 200", got)
+	}
+	if got := attempts[refusing.URL]; len(got) != 1 || got[0] != 410 {
+		t.Errorf("refusing webhook answered %v; want one 410 and no retries", got)
+	}
+}
+
+func TestWebhookRegistration(t *testing.T) {
+	defer withMemoryStore()()
+	room, token := ownedTestRoom(t)
+	for _, u := range []string{"", "ftp://example.com/x", "/relative", "http://"} {
+		if code := callAPIWithToken(t, token, "POST", room+"/webhooks", map[string]string{"URL": u}, nil); code != http.StatusBadRequest {
+			t.Errorf("POST webhook %q == %v; want 400", u, code)
+		}
+	}
+	for _, u := range []string{"http://127.0.0.1:8080/", "http://localhost/hook", "http://169.254.169.254/latest/meta-data", "http://10.1.2.3/", "https://192.168.0.10/", "http://[::1]/", "http://[fe80::1]/"} {
+		if code := callAPIWithToken(t, token, "POST", room+"/webhooks", map[string]string{"URL": u}, nil); code != http.StatusBadRequest {
+			t.Errorf("POST webhook %q == %v; want 400 for a private address", u, code)
+		}
+	}
+	// 203.0.113.0/24 is set aside for documentation, so nothing is ever sent there.
+	public := "https://203.0.113.10/hook"
+	for i := 0; i < maxWebhooks; i++ {
+		if code := callAPIWithToken(t, token, "POST", room+"/webhooks", map[string]string{"URL": public}, nil); code != http.StatusCreated {
+			t.Fatalf("POST webhook %q == %v; want 201", public, code)
+		}
+	}
+	if code := callAPIWithToken(t, token, "POST", room+"/webhooks", map[string]string{"URL": public}, nil); code != http.StatusConflict {
+		t.Errorf("POST webhook past the limit == %v; want 409", code)
+	}
+	if code := callAPIWithToken(t, token, "DELETE", room+"/webhooks/12345", nil, nil); code != http.StatusNotFound {
+		t.Errorf("DELETE missing webhook == %v; want 404", code)
+	}
+}
+
+func TestWebhooksNeedTheOwner(t *testing.T) {
+	defer withMemoryStore()()
+	defer func(v string) { os.Setenv("ROLLER_ADMIN_TOKEN", v) }(os.Getenv("ROLLER_ADMIN_TOKEN"))
+	os.Setenv("ROLLER_ADMIN_TOKEN", "let-me-in")
+	room, token := ownedTestRoom(t)
+	_, other := ownedTestRoom(t)
+	for _, tc := range []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusForbidden},
+		{other, http.StatusForbidden},
+		{"let-me-out", http.StatusForbidden},
+		{token, http.StatusOK},
+		{"let-me-in", http.StatusOK},
+	} {
+		for _, path := range []string{"/webhooks", "/webhooks/log"} {
+			if code := callAPIWithToken(t, tc.token, "GET", room+path, nil, nil); code != tc.want {
+				t.Errorf("GET %v with token %q == %v; want %v", path, tc.token, code, tc.want)
+			}
+		}
+	}
+	for _, method := range []string{"POST", "DELETE"} {
+		path := room + "/webhooks"
+		if method == "DELETE" {
+			path += "/1"
+		}
+		if code := callAPIWithToken(t, other, method, path, map[string]string{"URL": "https://203.0.113.10/hook"}, nil); code != http.StatusForbidden {
+			t.Errorf("%v %v with another room's token == %v; want 403", method, path, code)
+		}
+	}
+}
+
+func TestWebhooksDontDialPrivateAddresses(t *testing.T) {
+	wr := newWebhookReceiver()
+	defer wr.Close()
+	// The URL passed the check when it was added but now leads to loopback, as a
+	// name that is rebound would.
+	status, err := postWebhook(context.Background(), Webhook{URL: wr.URL, Secret: "s"}, eventRoll, []byte("{}"))
+	if err == nil || status != 0 {
+		t.Errorf("postWebhook() to %v == %v, %v; want it refused before connecting", wr.URL, status, err)
+	}
+	select {
+	case <-wr.got:
+		t.Error("the loopback server got the webhook")
+	default:
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// dialRoomSocket opens /room/{slug}/ws on srv and checks the handshake.
+func dialRoomSocket(t *testing.T, srv *httptest.Server, slug, query string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := "GET /room/" + slug + "/ws?" + query + " HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake == %v %v; want 101 and the RFC 6455 accept value", resp.Status, resp.Header)
+	}
+	return conn, br
+}
+
+// readMessage reads the next text frame from the server.
+func readMessage(t *testing.T, conn net.Conn, br *bufio.Reader) refreshResponse {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(br, head[:]); err != nil {
+			t.Fatal(err)
+		}
+		n := int(head[1] & 0x7F)
+		if n == 126 {
+			var ext [2]byte
+			if _, err := io.ReadFull(br, ext[:]); err != nil {
+				t.Fatal(err)
+			}
+			n = int(binary.BigEndian.Uint16(ext[:]))
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			t.Fatal(err)
+		}
+		if head[0]&0x0F != wsText {
+			continue
+		}
+		var out refreshResponse
+		if err := json.Unmarshal(payload, &out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+}
+
+func TestRoomSocketPushesEvents(t *testing.T) {
+	defer withMemoryStore()()
+	c := context.Background()
+	rk := datastore.IDKey("Room", 1, nil)
+	if _, err := store.Put(c, rk, &Room{Slug: "LiveTable"}); err != nil {
+		t.Fatal(err)
+	}
+	updateRoom(c, rk.Encode(), Update{Updater: "bob", Message: "before we connected"}, 0)
+
+	srv := httptest.NewServer(http.HandlerFunc(RoomRouter))
+	defer srv.Close()
+	conn, br := dialRoomSocket(t, srv, "LiveTable", "fp=alice&seq=0")
+	defer conn.Close()
+
+	got := readMessage(t, conn, br)
+	if len(got.Events) != 1 || got.Events[0].Message != "before we connected" {
+		t.Errorf("first message == %+v; want the event we missed", got)
+	}
+	got = readMessage(t, conn, br)
+	if len(got.Events) != 1 || got.Events[0].Type != eventPresence || len(got.Players) != 1 || got.Players[0].Status != playerConnected {
+		t.Errorf("second message == %+v; want alice arriving", got)
+	}
+
+	// Wait until the socket is following the room before acting in it.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, ok := roomEvents.following(rk.Encode()); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("socket never followed the room")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	updateRoom(c, rk.Encode(), Update{Updater: "alice"}, 0)
+	updateRoom(c, rk.Encode(), Update{Updater: "bob", Message: "X card"}, 0)
+
+	own := readMessage(t, conn, br)
+	if len(own.Events) != 0 || own.Seq <= got.Seq {
+		t.Errorf("message for alice's own change == %+v; want just a newer seq", own)
+	}
+	theirs := readMessage(t, conn, br)
+	if len(theirs.Events) != 1 || theirs.Events[0].Message != "X card" || theirs.Seq <= own.Seq {
+		t.Errorf("message for bob's change == %+v; want the X card", theirs)
+	}
+
+	// A masked close frame from the client ends the connection.
+	if _, err := conn.Write([]byte{0x88, 0x80, 1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, ok := roomEvents.following(rk.Encode()); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed socket still follows the room")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRoomSocketNeedsHandshake(t *testing.T) {
+	defer withMemoryStore()()
+	if _, err := store.Put(context.Background(), datastore.IDKey("Room", 1, nil), &Room{Slug: "LiveTable"}); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	RoomRouter(w, httptest.NewRequest("GET", "/room/LiveTable/ws", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("plain GET of the socket == %v; want 400", w.Code)
+	}
+}
+
+func TestFeedDropsSlowSubscribers(t *testing.T) {
+	f := newRoomFeed()
+	ch, stop := f.subscribe("room", 0)
+	defer stop()
+	for i := 1; i <= feedBuffer+1; i++ {
+		f.publish("room", Update{Seq: int64(i)})
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != feedBuffer {
+		t.Errorf("slow subscriber got %v events before being dropped; want %v", n, feedBuffer)
+	}
+	f.publish("room", Update{Seq: 1})
+	if _, ok := f.following("room"); ok {
+		t.Errorf("room is still followed after its only subscriber was dropped")
+	}
+}